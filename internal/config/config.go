@@ -1,25 +1,172 @@
 package config
 
 import (
+	"time"
+
 	"github.com/zeromicro/go-zero/core/stores/redis"
 	"github.com/zeromicro/go-zero/rest"
 )
 
 type Config struct {
 	rest.RestConf
-	RedisConf      redis.RedisConf
-	DataSyncConfig *DataSyncConfig
-	RateLimit      *RateLimit
-	AccessKey      string
-	AccessSecret   string
+	RedisConf         redis.RedisConf
+	Provider          string `json:",default=ipdatacloud,options=ipdatacloud|maxmind|ip2region|csv|chain"` // 离线库提供方
+	DataSyncConfig    *DataSyncConfig
+	IpDataCloudConfig *IpDataCloudConfig `json:",optional"`
+	MaxMindConfig     *MaxMindConfig     `json:",optional"`
+	Ip2RegionConfig   *Ip2RegionConfig   `json:",optional"`
+	CsvConfig         *CsvConfig         `json:",optional"`
+	ChainConfig       *ChainConfig       `json:",optional"`
+	OverrideConfig    *OverrideConfig    `json:",optional"`
+	ClusterSync       *ClusterSyncConfig `json:",optional"` // 多实例协调刷新，为空时各实例独立刷新
+	RateLimit         *RateLimit
+	AccessKey         string // 管理接口的访问凭证，为空则禁用管理接口
+	AccessSecret      string
 }
 
 // 离线数据同步配置
 type DataSyncConfig struct {
-	DownloadUrl    string // 离线数据下载地址
-	SyncCron       string // 离线数据同步周期
-	ForTest        bool   // 是否用于测试，用于测试时，不走cron表达式，改为每个一段时间更新一次
+	DownloadUrl    string   // 离线数据下载地址
+	Mirrors        []string `json:",optional"` // 备用下载地址，DownloadUrl失败后按顺序尝试，如内部制品库、同级节点
+	DownloadUrlV6  string   `json:",optional"` // IPv6离线数据下载地址，为空则不支持IPv6查询
+	MirrorsV6      []string `json:",optional"` // IPv6离线数据的备用下载地址
+	SyncCron       string   // 离线数据同步周期
+	ForTest        bool     // 是否用于测试，用于测试时，不走cron表达式，改为每个一段时间更新一次
 	RereshInterval string
+	BandwidthLimit int64             `json:",optional"` // 下载限速，单位字节/秒，0表示不限速
+	Retry          RetryPolicy       // 每个下载地址的重试策略
+	Verify         VerifyConfig      // 下载文件的校验，失败时不切换离线库
+	Archive        ArchiveConfig     // 压缩包的处理
+	Storage        string            `json:",default=disk,options=disk|memory"` // 下载文件的存放位置，memory表示全程不写磁盘
+	WorkDir        string            `json:",optional"`                         // 下载文件的存放目录，为空时使用系统临时目录
+	Quality        QualityGateConfig // 切换前的质量检查，任一项不通过时不切换离线库
+	CacheDir       string            `json:",optional"`                          // 本地快照缓存目录，为空时不缓存；启动时先加载最新的有效快照，再在后台刷新
+	CacheKeep      int               `json:",default=2"`                         // 缓存目录中保留的快照数
+	SourceType     string            `json:",default=http,options=http|file|s3"` // 数据源类型，决定下载地址及镜像的含义：http为http(s)地址；file从WatchDir读取，为其中文件名的通配符；s3从对象存储读取，为对象键或s3://bucket/key；与类型不符时启动报错
+	WatchDir       string            `json:",optional"`                          // file数据源监听的目录，有新文件时刷新，定时任务作为兜底
+	SettleTime     time.Duration     `json:",default=5s"`                        // file数据源中文件最后修改后需保持不变的时间，避免读到写入中的文件
+	S3             S3Config          // s3数据源配置
+	Peers          []string          `json:",optional"`   // 同伴实例地址，如https://ip-geo-0.ip-geo:8888；启动时没有本地缓存则先从同伴获取快照，都失败后再下载，需配置AccessKey
+	PeerTimeout    time.Duration     `json:",default=5m"` // 从一个同伴获取快照的超时时间
+	InsecurePeers  bool              `json:",optional"`   // 允许以http访问同伴，AccessKey和AccessSecret将明文传输，仅用于可信的内网
+}
+
+// S3兼容对象存储，下载地址为对象键，也可以是s3://bucket/key的形式以指定其他桶
+// 凭证优先从文件读取，未配置文件时读取环境变量，都没有时匿名访问
+type S3Config struct {
+	Endpoint         string `json:",optional"`                      // 服务地址，如http://minio:9000，为空时使用AWS对应区域的地址
+	Region           string `json:",default=us-east-1"`             // 签名使用的区域
+	Bucket           string `json:",optional"`                      // 默认桶
+	PathStyle        bool   `json:",default=true"`                  // 是否以路径形式访问桶，MinIO等通常需要
+	AccessKeyFile    string `json:",optional"`                      // 包含Access Key的文件，如挂载的密钥
+	SecretKeyFile    string `json:",optional"`                      // 包含Secret Key的文件
+	SessionTokenFile string `json:",optional"`                      // 包含临时凭证Session Token的文件
+	AccessKeyEnv     string `json:",default=AWS_ACCESS_KEY_ID"`     // Access Key的环境变量名
+	SecretKeyEnv     string `json:",default=AWS_SECRET_ACCESS_KEY"` // Secret Key的环境变量名
+	SessionTokenEnv  string `json:",default=AWS_SESSION_TOKEN"`     // Session Token的环境变量名
+}
+
+// 切换离线库前的质量检查，未配置的项不检查
+type QualityGateConfig struct {
+	GoldenSet       []GoldenRecord `json:",optional"`     // 新库必须满足的查询结果
+	MaxRecordDelta  float64        `json:",optional"`     // 记录数相对当前库的最大变化比例，如0.1表示增减不超过10%，0表示不检查
+	SampleSize      int            `json:",default=1000"` // 与当前库对比的随机公网IPv4地址数
+	MaxChangedRatio float64        `json:",optional"`     // 抽样中国家变化的最大比例，0表示不检查
+}
+
+// 黄金集中的一条断言，期望值为空的字段不比较
+type GoldenRecord struct {
+	Ip          string
+	Country     string `json:",optional"`
+	CountryCode string `json:",optional"`
+	Region      string `json:",optional"`
+}
+
+// 下载重试策略，重试间隔按指数退避并加入随机抖动
+type RetryPolicy struct {
+	MaxAttempts    int           `json:",default=2"`   // 每个下载地址的最大尝试次数
+	InitialBackoff time.Duration `json:",default=1s"`  // 首次重试前的等待时间
+	MaxBackoff     time.Duration `json:",default=1m"`  // 最长等待时间
+	Multiplier     float64       `json:",default=2"`   // 每次重试等待时间的倍数
+	Jitter         float64       `json:",default=0.2"` // 等待时间的随机抖动比例，0~1
+	AttemptTimeout time.Duration `json:",default=30m"` // 单次尝试的超时时间
+}
+
+// 压缩包处理配置，支持zip、tar.gz、gzip和未压缩的原始文件
+type ArchiveConfig struct {
+	EntryPattern string  `json:",optional"`           // 选择压缩包中文件的通配符，匹配完整路径或文件名，为空时按离线库类型选择
+	MaxSize      int64   `json:",default=4294967296"` // 解压后的最大字节数
+	MaxRatio     float64 `json:",default=100"`        // 解压后与压缩包的最大大小比例，0表示不限制
+}
+
+// 下载文件的完整性和来源校验，校验文件与下载文件位于同一地址（含镜像），路径加对应后缀
+type VerifyConfig struct {
+	Sha256Sidecar bool              `json:",optional"`                                   // 校验路径加.sha256后缀的校验文件
+	Sha256        map[string]string `json:",optional"`                                   // 指定下载文件的sha256，键为主下载地址
+	SignatureType string            `json:",default=none,options=none|ed25519|minisign"` // 签名类型，签名文件后缀分别为.sig、.minisig
+	PublicKey     string            `json:",optional"`                                   // ed25519为base64编码的公钥，minisign为公钥文件中的base64公钥
+}
+
+// ipdatacloud离线库配置
+type IpDataCloudConfig struct {
+	// 记录各位置的字段名，空串或"-"表示忽略，为空则根据字段数自动识别
+	// 可用字段：continent、country、province、city、district、line、isp、area_code、country_code、
+	// longitude、latitude、zip_code、asn、domain、idc、station、time_zone
+	Fields []string `json:",optional"`
+}
+
+// MaxMind离线库配置，City库下载地址复用DataSyncConfig.DownloadUrl
+type MaxMindConfig struct {
+	AsnDownloadUrl string   `json:",optional"`      // ASN库下载地址，为空则不返回ASN信息
+	AsnMirrors     []string `json:",optional"`      // ASN库的备用下载地址
+	Language       string   `json:",default=zh-CN"` // 地名语言，缺失时回退到en
+}
+
+// ip2region xdb离线库配置，下载地址复用DataSyncConfig.DownloadUrl
+type Ip2RegionConfig struct {
+	CachePolicy string `json:",default=content,options=content|vectorIndex"` // content: 整个文件载入内存；vectorIndex: 仅缓存向量索引
+}
+
+// CSV区间离线库配置，下载地址复用DataSyncConfig.DownloadUrl
+type CsvConfig struct {
+	EntrySuffix string            `json:",optional"` // 压缩包中CSV文件的后缀，为空则取第一个文件
+	Delimiter   string            `json:",optional"` // 分隔符，默认为逗号
+	HasHeader   bool              `json:",optional"` // 首行是否为表头
+	Columns     map[string]string // 字段到列的映射，列为下标或表头名；字段为start_ip、end_ip及GeoInfo的json名
+}
+
+// 多提供方组合配置，Provider为chain时生效
+type ChainConfig struct {
+	Members         []ChainMember
+	FieldPrecedence map[string][]string `json:",optional"` // 字段 -> 成员名称的优先顺序，相关字段成组取自同一成员，同组字段的配置须一致；未配置的按Members顺序
+}
+
+// 组合中的一个提供方，未配置的部分沿用全局配置
+type ChainMember struct {
+	Name              string             // 成员名称，用于标识字段来源
+	Provider          string             `json:",options=ipdatacloud|maxmind|ip2region|csv"`
+	DataSyncConfig    *DataSyncConfig    `json:",optional"`
+	IpDataCloudConfig *IpDataCloudConfig `json:",optional"`
+	MaxMindConfig     *MaxMindConfig     `json:",optional"`
+	Ip2RegionConfig   *Ip2RegionConfig   `json:",optional"`
+	CsvConfig         *CsvConfig         `json:",optional"`
+}
+
+// CIDR覆盖规则配置
+type OverrideConfig struct {
+	File           string // 规则文件，yaml或csv格式
+	ReloadInterval string `json:",default=30s"` // 检查规则文件变更的间隔
+	AuditFile      string `json:",optional"`    // 规则变更审计记录文件，为空则只记录日志
+}
+
+// 多实例通过Redis协调刷新：持有锁的实例下载并检查，通过后通知其他实例从它获取快照，各实例在约定时间一起切换
+// 依赖CacheDir提供快照，且各实例需配置相同的AccessKey
+type ClusterSyncConfig struct {
+	KeyPrefix    string        `json:",default=ipgeo:sync:"` // Redis键的前缀
+	AdvertiseUrl string        `json:",optional"`            // 本实例供同伴访问的地址，如https://10.0.0.1:8888，为空时其他实例从DataSyncConfig.Peers获取；http地址需其他实例开启InsecurePeers
+	LockTtl      time.Duration `json:",default=5m"`          // 刷新锁的有效期，持有期间自动续期，完成后不释放，同一轮中其他实例不再下载；须小于刷新间隔
+	SwitchDelay  time.Duration `json:",default=30s"`         // 通知后等待多久切换，留给其他实例获取和加载快照；其他实例订阅通知并随领导实例的切换消息切换，收不到时最多再等SwitchDelay，订阅中断时按约定时间切换
+	WaitTimeout  time.Duration `json:",optional"`            // 未获得锁的实例等待通知的上限，0表示领导实例持有锁期间一直等待，锁过期或易主时独立刷新；设置时须不小于单个下载地址的重试预算
 }
 
 type RateLimit struct {
@@ -3,4 +3,5 @@ package consts
 const (
 	ErrCode_InternalError = iota + 4000
 	ErrCode_QueryDbError
+	ErrCode_OverrideDisabled
 )
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"net/http"
+
+	"ip_geo/internal/logic/admin"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+	xhttp "github.com/zeromicro/x/http"
+)
+
+func AddOverrideHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req types.AddOverrideRequest
+		if err := httpx.Parse(r, &req); err != nil {
+			httpx.ErrorCtx(r.Context(), w, err)
+			return
+		}
+
+		l := admin.NewAddOverrideLogic(r.Context(), svcCtx)
+		err := l.AddOverride(&req)
+		if err != nil {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, err)
+		} else {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, nil)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"net/http"
+
+	"ip_geo/internal/logic/admin"
+	"ip_geo/internal/svc"
+
+	xhttp "github.com/zeromicro/x/http"
+)
+
+func GetSyncStatusHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := admin.NewGetSyncStatusLogic(r.Context(), svcCtx)
+		resp, err := l.GetSyncStatus()
+		if err != nil {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, err)
+		} else {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, resp)
+		}
+	}
+}
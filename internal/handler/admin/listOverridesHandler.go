@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"net/http"
+
+	"ip_geo/internal/logic/admin"
+	"ip_geo/internal/svc"
+
+	xhttp "github.com/zeromicro/x/http"
+)
+
+func ListOverridesHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := admin.NewListOverridesLogic(r.Context(), svcCtx)
+		resp, err := l.ListOverrides()
+		if err != nil {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, err)
+		} else {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, resp)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package peer
+
+import (
+	"net/http"
+
+	"ip_geo/internal/logic/peer"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+	xhttp "github.com/zeromicro/x/http"
+)
+
+// 成功时由logic直接写出文件内容，失败时返回json格式的错误
+func GetSnapshotFileHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req types.GetSnapshotFileRequest
+		if err := httpx.Parse(r, &req); err != nil {
+			httpx.ErrorCtx(r.Context(), w, err)
+			return
+		}
+
+		l := peer.NewGetSnapshotFileLogic(r.Context(), svcCtx, w)
+		err := l.GetSnapshotFile(&req)
+		if err != nil {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package peer
+
+import (
+	"net/http"
+
+	"ip_geo/internal/logic/peer"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+	xhttp "github.com/zeromicro/x/http"
+)
+
+func ListSnapshotsHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req types.ListSnapshotsRequest
+		if err := httpx.Parse(r, &req); err != nil {
+			httpx.ErrorCtx(r.Context(), w, err)
+			return
+		}
+
+		l := peer.NewListSnapshotsLogic(r.Context(), svcCtx)
+		resp, err := l.ListSnapshots(&req)
+		if err != nil {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, err)
+		} else {
+			xhttp.JsonBaseResponseCtx(r.Context(), w, resp)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"time"
 
+	admin "ip_geo/internal/handler/admin"
 	healthz "ip_geo/internal/handler/healthz"
+	peer "ip_geo/internal/handler/peer"
 	"ip_geo/internal/svc"
 
 	"github.com/zeromicro/go-zero/rest"
@@ -36,4 +38,64 @@ func RegisterHandlers(server *rest.Server, serverCtx *svc.ServiceContext) {
 		},
 		rest.WithTimeout(100*time.Millisecond),
 	)
+
+	server.AddRoutes(
+		rest.WithMiddlewares(
+			[]rest.Middleware{serverCtx.AdminAuthMiddleware},
+			[]rest.Route{
+				{
+					Method:  http.MethodGet,
+					Path:    "/overrides",
+					Handler: admin.ListOverridesHandler(serverCtx),
+				},
+				{
+					Method:  http.MethodPost,
+					Path:    "/overrides",
+					Handler: admin.AddOverrideHandler(serverCtx),
+				},
+				{
+					Method:  http.MethodDelete,
+					Path:    "/overrides",
+					Handler: admin.RemoveOverrideHandler(serverCtx),
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/sync/status",
+					Handler: admin.GetSyncStatusHandler(serverCtx),
+				},
+			}...,
+		),
+		rest.WithPrefix("/admin"),
+		rest.WithTimeout(5000*time.Millisecond),
+	)
+
+	server.AddRoutes(
+		rest.WithMiddlewares(
+			[]rest.Middleware{serverCtx.AdminAuthMiddleware},
+			[]rest.Route{
+				{
+					Method:  http.MethodGet,
+					Path:    "/snapshots",
+					Handler: peer.ListSnapshotsHandler(serverCtx),
+				},
+			}...,
+		),
+		rest.WithPrefix("/internal"),
+		rest.WithTimeout(5000*time.Millisecond),
+	)
+
+	server.AddRoutes(
+		rest.WithMiddlewares(
+			[]rest.Middleware{serverCtx.AdminAuthMiddleware},
+			[]rest.Route{
+				{
+					Method:  http.MethodGet,
+					Path:    "/snapshots/file",
+					Handler: peer.GetSnapshotFileHandler(serverCtx),
+				},
+			}...,
+		),
+		rest.WithPrefix("/internal"),
+		rest.WithTimeout(600000*time.Millisecond),
+	)
 }
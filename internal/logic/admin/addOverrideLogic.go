@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"context"
+
+	"ip_geo/internal/model"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type AddOverrideLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+}
+
+func NewAddOverrideLogic(ctx context.Context, svcCtx *svc.ServiceContext) *AddOverrideLogic {
+	return &AddOverrideLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+	}
+}
+
+func (l *AddOverrideLogic) AddOverride(req *types.AddOverrideRequest) error {
+	l.Infof("AddOverride, req: %+v", *req)
+	if l.svcCtx.OverrideHelper == nil {
+		return errOverrideDisabled
+	}
+
+	err := l.svcCtx.OverrideHelper.AddRule(model.OverrideRule{
+		Cidr:    req.Cidr,
+		Fields:  req.Fields,
+		Comment: req.Comment,
+	}, overrideActor(l.ctx, req.Operator))
+	if err != nil {
+		l.Errorf("add override rule failed, err: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"context"
+	"ip_geo/internal/consts"
+	"ip_geo/internal/middleware"
+	"ip_geo/internal/model"
+
+	xerrors "github.com/zeromicro/x/errors"
+)
+
+var errOverrideDisabled = xerrors.New(consts.ErrCode_OverrideDisabled, "override rules not configured")
+
+// 审计记录中的操作人。X-Operator由调用方自报，持有AccessKey即可填写任意名称，
+// 因此同时记录请求来源地址；未传X-Operator时记为unknown
+func overrideActor(ctx context.Context, op string) model.OverrideActor {
+	if op == "" {
+		op = "unknown"
+	}
+	caller := middleware.AdminCallerFromContext(ctx)
+	return model.OverrideActor{Operator: op, RemoteAddr: caller.RemoteAddr, ForwardedFor: caller.ForwardedFor}
+}
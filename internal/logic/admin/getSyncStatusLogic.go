@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"context"
+	"time"
+
+	"ip_geo/internal/model"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type GetSyncStatusLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+}
+
+func NewGetSyncStatusLogic(ctx context.Context, svcCtx *svc.ServiceContext) *GetSyncStatusLogic {
+	return &GetSyncStatusLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+	}
+}
+
+func (l *GetSyncStatusLogic) GetSyncStatus() (resp *types.GetSyncStatusResponse, err error) {
+	statuses := model.DownloadStatuses()
+	resp = &types.GetSyncStatusResponse{Downloads: make([]types.DownloadStatus, 0, len(statuses))}
+	for _, s := range statuses {
+		resp.Downloads = append(resp.Downloads, types.DownloadStatus{
+			Url:        s.Url,
+			State:      s.State,
+			Bytes:      s.Bytes,
+			Total:      s.Total,
+			Rate:       s.Rate,
+			Eta:        s.Eta,
+			Resumed:    s.Resumed,
+			Verified:   s.Verified,
+			StartTime:  s.StartTime.Format(time.RFC3339),
+			UpdateTime: s.UpdateTime.Format(time.RFC3339),
+			Error:      s.Error,
+		})
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"context"
+
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type ListOverridesLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+}
+
+func NewListOverridesLogic(ctx context.Context, svcCtx *svc.ServiceContext) *ListOverridesLogic {
+	return &ListOverridesLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+	}
+}
+
+func (l *ListOverridesLogic) ListOverrides() (resp *types.ListOverridesResponse, err error) {
+	if l.svcCtx.OverrideHelper == nil {
+		return nil, errOverrideDisabled
+	}
+
+	rules := l.svcCtx.OverrideHelper.ListRules()
+	resp = &types.ListOverridesResponse{Rules: make([]types.OverrideRule, 0, len(rules))}
+	for _, rule := range rules {
+		resp.Rules = append(resp.Rules, types.OverrideRule{
+			Cidr:    rule.Cidr,
+			Fields:  rule.Fields,
+			Comment: rule.Comment,
+		})
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"context"
+
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type RemoveOverrideLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+}
+
+func NewRemoveOverrideLogic(ctx context.Context, svcCtx *svc.ServiceContext) *RemoveOverrideLogic {
+	return &RemoveOverrideLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+	}
+}
+
+func (l *RemoveOverrideLogic) RemoveOverride(req *types.RemoveOverrideRequest) error {
+	l.Infof("RemoveOverride, req: %+v", *req)
+	if l.svcCtx.OverrideHelper == nil {
+		return errOverrideDisabled
+	}
+
+	err := l.svcCtx.OverrideHelper.RemoveRule(req.Cidr, overrideActor(l.ctx, req.Operator))
+	if err != nil {
+		l.Errorf("remove override rule failed, err: %v", err)
+		return err
+	}
+
+	return nil
+}
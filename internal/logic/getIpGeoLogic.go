@@ -34,6 +34,8 @@ func (l *GetIpGeoLogic) GetIpGeo(req *types.GetIpGeoRequest) (resp *types.GetIpG
 
 	resp = &types.GetIpGeoResponse{
 		DBVersion:     info.DBVersion,
+		DBLoadTime:    info.DBLoadTime,
+		AddressType:   info.AddressType,
 		ContinentCode: info.Continent,
 		Country:       info.Country,
 		CountryCode:   info.CountryCode,
@@ -47,6 +49,12 @@ func (l *GetIpGeoLogic) GetIpGeo(req *types.GetIpGeoRequest) (resp *types.GetIpG
 		Latitude:      info.Latitude,
 		Longitude:     info.Longitude,
 		Timezone:      info.Timezone,
+		Line:          info.Line,
+		Asn:           info.Asn,
+		AsnOrg:        info.AsnOrg,
+		Idc:           info.Idc,
+		Station:       info.Station,
+		Sources:       info.Sources,
 	}
 
 	return resp, nil
@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"ip_geo/internal/model"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 每写出这么多字节flush一次，路由的超时处理会缓存未flush的内容
+const snapshotFileChunkSize = 256 * 1024
+
+type GetSnapshotFileLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+	w      http.ResponseWriter
+}
+
+func NewGetSnapshotFileLogic(ctx context.Context, svcCtx *svc.ServiceContext, w http.ResponseWriter) *GetSnapshotFileLogic {
+	return &GetSnapshotFileLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+		w:      w,
+	}
+}
+
+// 开始写出文件后出错只记录日志，同伴按大小和哈希发现不完整的文件
+func (l *GetSnapshotFileLogic) GetSnapshotFile(req *types.GetSnapshotFileRequest) error {
+	f, file, err := model.OpenServedSnapshotFile(req.Id, req.Name, req.Hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := l.w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	l.w.WriteHeader(http.StatusOK)
+
+	flusher, _ := l.w.(http.Flusher)
+	buf := make([]byte, snapshotFileChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := l.w.Write(buf[:n]); werr != nil {
+				l.Errorf("write snapshot file failed, id: %s, name: %s, err: %v", req.Id, req.Name, werr)
+				return nil
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			l.Errorf("read snapshot file failed, id: %s, name: %s, err: %v", req.Id, req.Name, err)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package peer
+
+import (
+	"context"
+	"time"
+
+	"ip_geo/internal/model"
+	"ip_geo/internal/svc"
+	"ip_geo/internal/types"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type ListSnapshotsLogic struct {
+	logx.Logger
+	ctx    context.Context
+	svcCtx *svc.ServiceContext
+}
+
+func NewListSnapshotsLogic(ctx context.Context, svcCtx *svc.ServiceContext) *ListSnapshotsLogic {
+	return &ListSnapshotsLogic{
+		Logger: logx.WithContext(ctx),
+		ctx:    ctx,
+		svcCtx: svcCtx,
+	}
+}
+
+// 时间保留纳秒，同伴据此做条件下载时与本实例一致
+func (l *ListSnapshotsLogic) ListSnapshots(req *types.ListSnapshotsRequest) (resp *types.ListSnapshotsResponse, err error) {
+	snaps := model.ServedSnapshots(req.Hash)
+	resp = &types.ListSnapshotsResponse{Snapshots: make([]types.Snapshot, 0, len(snaps))}
+	for _, s := range snaps {
+		snap := types.Snapshot{
+			Id:       s.Id,
+			Provider: s.Provider,
+			Version:  s.Version,
+			Hash:     s.Hash,
+			SavedAt:  s.SavedAt.Format(time.RFC3339Nano),
+			Files:    make([]types.SnapshotFile, 0, len(s.Files)),
+		}
+		for _, f := range s.Files {
+			snap.Files = append(snap.Files, types.SnapshotFile{
+				Url:          f.Url,
+				Name:         f.Name,
+				Size:         f.Size,
+				Hash:         f.Hash,
+				Source:       f.Source,
+				ETag:         f.ETag,
+				LastModified: f.LastModified.Format(time.RFC3339Nano),
+				EntryModTime: f.EntryModTime.Format(time.RFC3339Nano),
+				DownloadHash: f.DownloadHash,
+				DownloadSize: f.DownloadSize,
+				Verified:     f.Verified,
+			})
+		}
+		resp.Snapshots = append(resp.Snapshots, snap)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"ip_geo/internal/config"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/rest/httpx"
+)
+
+const (
+	accessKeyHeader    = "X-Access-Key"
+	accessSecretHeader = "X-Access-Secret"
+)
+
+type adminCallerKey struct{}
+
+// 通过鉴权的调用方，AccessKey为共享凭证，无法区分具体的人，只能记录请求来源
+type AdminCaller struct {
+	RemoteAddr   string // 连接的对端地址
+	ForwardedFor string // X-Forwarded-For请求头，可由代理或调用方设置，仅供参考
+}
+
+// 未经过管理接口鉴权时返回空值
+func AdminCallerFromContext(ctx context.Context) AdminCaller {
+	caller, _ := ctx.Value(adminCallerKey{}).(AdminCaller)
+	return caller
+}
+
+// 管理接口鉴权，校验请求头中的AccessKey和AccessSecret，未配置AccessKey时拒绝所有请求
+type AdminAuthMiddleware struct {
+	cfgPtr *atomic.Pointer[config.Config]
+}
+
+func NewAdminAuthMiddleware(cfgPtr *atomic.Pointer[config.Config]) *AdminAuthMiddleware {
+	return &AdminAuthMiddleware{
+		cfgPtr: cfgPtr,
+	}
+}
+
+func (m *AdminAuthMiddleware) Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := m.cfgPtr.Load()
+		if c == nil || c.AccessKey == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := r.Header.Get(accessKeyHeader)
+		secret := r.Header.Get(accessSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(key), []byte(c.AccessKey)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(secret), []byte(c.AccessSecret)) != 1 {
+			logx.Alert("admin auth failed, ip: " + httpx.GetRemoteAddr(r))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		caller := AdminCaller{RemoteAddr: r.RemoteAddr, ForwardedFor: r.Header.Get("X-Forwarded-For")}
+		next(w, r.WithContext(context.WithValue(r.Context(), adminCallerKey{}, caller)))
+	}
+}
@@ -0,0 +1,132 @@
+package model
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var (
+	_ IpGeoHelper = (*SpecialAddressHelper)(nil)
+)
+
+// 地址类型，参考RFC 6890及IANA特殊用途地址注册表
+const (
+	AddressTypePublic        = "public"        // 公网地址，由离线库查询
+	AddressTypeUnspecified   = "unspecified"   // 未指定地址
+	AddressTypeThisNetwork   = "this_network"  // 本网络
+	AddressTypePrivate       = "private"       // 私有地址
+	AddressTypeLoopback      = "loopback"      // 环回地址
+	AddressTypeLinkLocal     = "link_local"    // 链路本地地址
+	AddressTypeCgnat         = "cgnat"         // 运营商级NAT共享地址
+	AddressTypeMulticast     = "multicast"     // 组播地址
+	AddressTypeBroadcast     = "broadcast"     // 受限广播地址
+	AddressTypeDocumentation = "documentation" // 文档示例地址
+	AddressTypeBenchmarking  = "benchmarking"  // 基准测试地址
+	AddressTypeReserved      = "reserved"      // 其他保留地址
+)
+
+type specialPrefix struct {
+	prefix      netip.Prefix
+	addressType string
+}
+
+// 特殊用途地址段，更具体的前缀在前
+var specialPrefixes = []specialPrefix{
+	// IPv4
+	{netip.MustParsePrefix("255.255.255.255/32"), AddressTypeBroadcast},
+	{netip.MustParsePrefix("0.0.0.0/32"), AddressTypeUnspecified},
+	{netip.MustParsePrefix("192.0.2.0/24"), AddressTypeDocumentation},
+	{netip.MustParsePrefix("198.51.100.0/24"), AddressTypeDocumentation},
+	{netip.MustParsePrefix("203.0.113.0/24"), AddressTypeDocumentation},
+	{netip.MustParsePrefix("192.0.0.0/24"), AddressTypeReserved},
+	{netip.MustParsePrefix("192.88.99.0/24"), AddressTypeReserved},
+	{netip.MustParsePrefix("169.254.0.0/16"), AddressTypeLinkLocal},
+	{netip.MustParsePrefix("192.168.0.0/16"), AddressTypePrivate},
+	{netip.MustParsePrefix("198.18.0.0/15"), AddressTypeBenchmarking},
+	{netip.MustParsePrefix("172.16.0.0/12"), AddressTypePrivate},
+	{netip.MustParsePrefix("100.64.0.0/10"), AddressTypeCgnat},
+	{netip.MustParsePrefix("0.0.0.0/8"), AddressTypeThisNetwork},
+	{netip.MustParsePrefix("10.0.0.0/8"), AddressTypePrivate},
+	{netip.MustParsePrefix("127.0.0.0/8"), AddressTypeLoopback},
+	{netip.MustParsePrefix("224.0.0.0/4"), AddressTypeMulticast},
+	{netip.MustParsePrefix("240.0.0.0/4"), AddressTypeReserved},
+
+	// IPv6，IPv4映射地址（::ffff:0:0/96）和NAT64知名前缀（64:ff9b::/96）中的地址会先转换为IPv4
+	{netip.MustParsePrefix("::/128"), AddressTypeUnspecified},
+	{netip.MustParsePrefix("::1/128"), AddressTypeLoopback},
+	{netip.MustParsePrefix("100::/64"), AddressTypeReserved},
+	{netip.MustParsePrefix("2001:2::/48"), AddressTypeBenchmarking},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), AddressTypeReserved}, // 本地使用的NAT64前缀
+	{netip.MustParsePrefix("2001:db8::/32"), AddressTypeDocumentation},
+	{netip.MustParsePrefix("2001::/23"), AddressTypeReserved}, // IETF协议分配，包括Teredo、ORCHID等
+	{netip.MustParsePrefix("3fff::/20"), AddressTypeDocumentation},
+	{netip.MustParsePrefix("5f00::/16"), AddressTypeReserved},
+	{netip.MustParsePrefix("fe80::/10"), AddressTypeLinkLocal},
+	{netip.MustParsePrefix("ff00::/8"), AddressTypeMulticast},
+	{netip.MustParsePrefix("fc00::/7"), AddressTypePrivate},
+}
+
+// NAT64知名前缀，后32位为IPv4地址（RFC 6052）
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// IPv4映射地址和NAT64知名前缀中的地址转换为其中的IPv4地址，按IPv4分类和查询
+// 去掉区域标识，否则带区域的地址不匹配任何前缀
+func embeddedIPv4(addr netip.Addr) netip.Addr {
+	addr = addr.WithZone("").Unmap()
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		return netip.AddrFrom4([4]byte(b[12:]))
+	}
+	return addr
+}
+
+// 返回地址类型，非特殊用途地址返回AddressTypePublic
+func ClassifyAddress(addr netip.Addr) string {
+	addr = embeddedIPv4(addr)
+	for _, p := range specialPrefixes {
+		if p.prefix.Contains(addr) {
+			return p.addressType
+		}
+	}
+	return AddressTypePublic
+}
+
+// 在查询离线库之前识别特殊用途地址，特殊地址直接返回地址类型，地理字段为空
+type SpecialAddressHelper struct {
+	inner IpGeoHelper
+}
+
+func NewSpecialAddressHelper(inner IpGeoHelper) *SpecialAddressHelper {
+	return &SpecialAddressHelper{inner: inner}
+}
+
+func (helper *SpecialAddressHelper) QueryGeo(ipAddr string) (*GeoInfo, error) {
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return nil, errors.New("invalid ip")
+	}
+	if t := ClassifyAddress(addr); t != AddressTypePublic {
+		return &GeoInfo{AddressType: t}, nil
+	}
+	// 内嵌IPv4的地址按IPv4地址查询离线库
+	if v4 := embeddedIPv4(addr); v4.Is4() {
+		ipAddr = v4.String()
+	}
+
+	resp, err := helper.inner.QueryGeo(ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	resp.AddressType = AddressTypePublic
+	return resp, nil
+}
+
+// 初始化db
+func (helper *SpecialAddressHelper) Init() error {
+	return helper.inner.Init()
+}
+
+// 清理
+func (helper *SpecialAddressHelper) Clean() error {
+	return helper.inner.Clean()
+}
@@ -0,0 +1,221 @@
+package model
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// 各特殊地址段的首尾地址及段外相邻的地址
+var classifyAddressCases = []struct {
+	addr string
+	want string
+}{
+	// IPv4
+	{"255.255.255.255", AddressTypeBroadcast},
+	{"255.255.255.254", AddressTypeReserved},
+	{"0.0.0.0", AddressTypeUnspecified},
+	{"0.0.0.1", AddressTypeThisNetwork},
+	{"0.255.255.255", AddressTypeThisNetwork},
+	{"1.0.0.0", AddressTypePublic},
+	{"192.0.2.0", AddressTypeDocumentation},
+	{"192.0.2.255", AddressTypeDocumentation},
+	{"192.0.1.255", AddressTypePublic},
+	{"192.0.3.0", AddressTypePublic},
+	{"198.51.100.0", AddressTypeDocumentation},
+	{"198.51.100.255", AddressTypeDocumentation},
+	{"198.51.99.255", AddressTypePublic},
+	{"198.51.101.0", AddressTypePublic},
+	{"203.0.113.0", AddressTypeDocumentation},
+	{"203.0.113.255", AddressTypeDocumentation},
+	{"203.0.112.255", AddressTypePublic},
+	{"203.0.114.0", AddressTypePublic},
+	{"192.0.0.0", AddressTypeReserved},
+	{"192.0.0.255", AddressTypeReserved},
+	{"191.255.255.255", AddressTypePublic},
+	{"192.0.1.0", AddressTypePublic},
+	{"192.88.99.0", AddressTypeReserved},
+	{"192.88.99.255", AddressTypeReserved},
+	{"192.88.98.255", AddressTypePublic},
+	{"192.88.100.0", AddressTypePublic},
+	{"169.254.0.0", AddressTypeLinkLocal},
+	{"169.254.255.255", AddressTypeLinkLocal},
+	{"169.253.255.255", AddressTypePublic},
+	{"169.255.0.0", AddressTypePublic},
+	{"192.168.0.0", AddressTypePrivate},
+	{"192.168.255.255", AddressTypePrivate},
+	{"192.167.255.255", AddressTypePublic},
+	{"192.169.0.0", AddressTypePublic},
+	{"198.18.0.0", AddressTypeBenchmarking},
+	{"198.19.255.255", AddressTypeBenchmarking},
+	{"198.17.255.255", AddressTypePublic},
+	{"198.20.0.0", AddressTypePublic},
+	{"172.16.0.0", AddressTypePrivate},
+	{"172.31.255.255", AddressTypePrivate},
+	{"172.15.255.255", AddressTypePublic},
+	{"172.32.0.0", AddressTypePublic},
+	{"100.64.0.0", AddressTypeCgnat},
+	{"100.127.255.255", AddressTypeCgnat},
+	{"100.63.255.255", AddressTypePublic},
+	{"100.128.0.0", AddressTypePublic},
+	{"10.0.0.0", AddressTypePrivate},
+	{"10.255.255.255", AddressTypePrivate},
+	{"9.255.255.255", AddressTypePublic},
+	{"11.0.0.0", AddressTypePublic},
+	{"127.0.0.0", AddressTypeLoopback},
+	{"127.255.255.255", AddressTypeLoopback},
+	{"126.255.255.255", AddressTypePublic},
+	{"128.0.0.0", AddressTypePublic},
+	{"224.0.0.0", AddressTypeMulticast},
+	{"239.255.255.255", AddressTypeMulticast},
+	{"223.255.255.255", AddressTypePublic},
+	{"240.0.0.0", AddressTypeReserved},
+
+	// IPv4映射地址按IPv4分类
+	{"::ffff:0.0.0.0", AddressTypeUnspecified},
+	{"::ffff:10.0.0.1", AddressTypePrivate},
+	{"::ffff:8.8.8.8", AddressTypePublic},
+	{"::ffff:255.255.255.255", AddressTypeBroadcast},
+	// NAT64知名前缀按内嵌的IPv4分类
+	{"64:ff9b::", AddressTypeUnspecified},
+	{"64:ff9b::127.0.0.1", AddressTypeLoopback},
+	{"64:ff9b::10.0.0.1", AddressTypePrivate},
+	{"64:ff9b::8.8.8.8", AddressTypePublic},
+	{"64:ff9b::ffff:ffff", AddressTypeBroadcast},
+	{"64:ff9b::1:0:0", AddressTypePublic},
+
+	// IPv6
+	{"::", AddressTypeUnspecified},
+	{"::1", AddressTypeLoopback},
+	{"100::", AddressTypeReserved},
+	{"100::ffff:ffff:ffff:ffff", AddressTypeReserved},
+	{"ff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"100:0:0:1::", AddressTypePublic},
+	{"2001:2::", AddressTypeBenchmarking},
+	{"2001:2:0:ffff:ffff:ffff:ffff:ffff", AddressTypeBenchmarking},
+	{"2001:1:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeReserved},
+	{"2001:2:1::", AddressTypeReserved},
+	{"64:ff9b:1::", AddressTypeReserved},
+	{"64:ff9b:1:ffff:ffff:ffff:ffff:ffff", AddressTypeReserved},
+	{"64:ff9b:0:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"64:ff9b:2::", AddressTypePublic},
+	{"2001:db8::", AddressTypeDocumentation},
+	{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeDocumentation},
+	{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"2001:db9::", AddressTypePublic},
+	{"2001::", AddressTypeReserved},
+	{"2001:0:4136:e378:8000:63bf:3fff:fdd2", AddressTypeReserved}, // Teredo
+	{"2001:10::1", AddressTypeReserved},                           // ORCHID
+	{"2001:1ff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeReserved},
+	{"2000:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"2001:200::", AddressTypePublic},
+	{"3fff::", AddressTypeDocumentation},
+	{"3fff:fff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeDocumentation},
+	{"3ffe:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"3fff:1000::", AddressTypePublic},
+	{"5f00::", AddressTypeReserved},
+	{"5f00:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeReserved},
+	{"5eff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"5f01::", AddressTypePublic},
+	{"fe80::", AddressTypeLinkLocal},
+	{"fe80::1%eth0", AddressTypeLinkLocal},
+	{"febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeLinkLocal},
+	{"fe7f:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"fec0::", AddressTypePublic},
+	{"ff00::", AddressTypeMulticast},
+	{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypeMulticast},
+	{"feff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"fc00::", AddressTypePrivate},
+	{"fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePrivate},
+	{"fbff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", AddressTypePublic},
+	{"fe00::", AddressTypePublic},
+	{"2001:4860:4860::8888", AddressTypePublic},
+}
+
+func TestClassifyAddress(t *testing.T) {
+	for _, tt := range classifyAddressCases {
+		if got := ClassifyAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// 段中的最后一个地址
+func lastPrefixAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 96
+	}
+	for i := p.Bits() + offset; i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// 新增的地址段须在用例中列出首尾地址
+func TestClassifyAddressCasesCoverPrefixes(t *testing.T) {
+	listed := make(map[netip.Addr]bool)
+	for _, tt := range classifyAddressCases {
+		listed[netip.MustParseAddr(tt.addr).WithZone("")] = true
+	}
+	for _, p := range specialPrefixes {
+		for _, addr := range []netip.Addr{p.prefix.Masked().Addr(), lastPrefixAddr(p.prefix)} {
+			if !listed[addr] {
+				t.Errorf("%s: boundary %s not covered", p.prefix, addr)
+			}
+		}
+	}
+}
+
+type recordGeoHelper struct {
+	fakeGeoHelper
+	queried []string
+}
+
+func (h *recordGeoHelper) QueryGeo(ipAddr string) (*GeoInfo, error) {
+	h.queried = append(h.queried, ipAddr)
+	return h.fakeGeoHelper.QueryGeo(ipAddr)
+}
+
+func TestSpecialAddressHelperQueryGeo(t *testing.T) {
+	tests := []struct {
+		addr        string
+		wantType    string
+		wantQueried string // 为空表示不查询离线库
+	}{
+		{"8.8.8.8", AddressTypePublic, "8.8.8.8"},
+		{"2001:4860:4860::8888", AddressTypePublic, "2001:4860:4860::8888"},
+		// 内嵌IPv4的地址按IPv4查询
+		{"::ffff:8.8.8.8", AddressTypePublic, "8.8.8.8"},
+		{"64:ff9b::808:808", AddressTypePublic, "8.8.8.8"},
+		{"10.0.0.1", AddressTypePrivate, ""},
+		{"::ffff:192.168.1.1", AddressTypePrivate, ""},
+		{"64:ff9b::7f00:1", AddressTypeLoopback, ""},
+	}
+	for _, tt := range tests {
+		inner := &recordGeoHelper{fakeGeoHelper: fakeGeoHelper{info: &GeoInfo{CountryCode: "US"}}}
+		info, err := NewSpecialAddressHelper(inner).QueryGeo(tt.addr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.addr, err)
+			continue
+		}
+		if info.AddressType != tt.wantType {
+			t.Errorf("%s: address type = %s, want %s", tt.addr, info.AddressType, tt.wantType)
+		}
+		var queried string
+		if len(inner.queried) > 0 {
+			queried = inner.queried[0]
+		}
+		if queried != tt.wantQueried || len(inner.queried) > 1 {
+			t.Errorf("%s: queried %v, want %q", tt.addr, inner.queried, tt.wantQueried)
+		}
+	}
+
+	if _, err := NewSpecialAddressHelper(&fakeGeoHelper{}).QueryGeo("1.2.3"); err == nil {
+		t.Error("want error for invalid ip")
+	}
+}
@@ -1,5 +1,23 @@
 package model
 
+import (
+	"fmt"
+	"ip_geo/internal/config"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 离线库提供方
+const (
+	ProviderIpDataCloud = "ipdatacloud"
+	ProviderMaxMind     = "maxmind"
+	ProviderIp2Region   = "ip2region"
+	ProviderCsv         = "csv"
+	ProviderChain       = "chain"
+)
+
 type IpGeoHelper interface {
 	Init() error                              // 做初始化工作
 	Clean() error                             // 做清理工作
@@ -8,6 +26,8 @@ type IpGeoHelper interface {
 
 type GeoInfo struct {
 	DBVersion   string `json:"db_version"`     // 数据库版本
+	DBLoadTime  string `json:"db_load_time"`   // 数据库加载时间
+	AddressType string `json:"address_type"`   // 地址类型，如public、private、loopback等
 	Continent   string `json:"continent_code"` // 大洲代码
 	Country     string `json:"country"`        // 国家/地区
 	CountryCode string `json:"country_code"`   // 国家代码
@@ -21,4 +41,59 @@ type GeoInfo struct {
 	Latitude    string `json:"latitude"`       // 纬度
 	Longitude   string `json:"longitude"`      // 经度
 	Timezone    string `json:"timezone"`       // 时区
+	Line        string `json:"line"`           // 线路
+	Asn         uint32 `json:"asn"`            // 自治域编号
+	AsnOrg      string `json:"asn_org"`        // 自治域所属组织
+	Idc         string `json:"idc"`            // idc
+	Station     string `json:"station"`        // 基站
+
+	Sources map[string]string `json:"sources,omitempty"` // 字段 -> 提供该字段的成员名称，仅组合查询时返回
+}
+
+// 根据配置的离线库提供方创建查询助手，cluster不为nil时各实例协调刷新
+func NewIpGeoHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (IpGeoHelper, error) {
+	switch provider := cfgPtr.Load().Provider; provider {
+	case ProviderIpDataCloud, "":
+		return NewIpCloudDataHelper(cfgPtr, cluster)
+	case ProviderMaxMind:
+		return NewMaxMindHelper(cfgPtr, cluster)
+	case ProviderIp2Region:
+		return NewIp2RegionHelper(cfgPtr, cluster)
+	case ProviderCsv:
+		return NewCsvRangeHelper(cfgPtr, cluster)
+	case ProviderChain:
+		return NewChainHelper(cfgPtr, cluster)
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", provider)
+	}
+}
+
+// 初始化失败时按重试策略退避后重试，不限次数，直到成功或stop关闭；stop关闭时返回false
+// 首次启动没有可用的缓存且下载失败时保持未就绪，不退出进程
+func InitWithRetry(name string, helper IpGeoHelper, policy config.RetryPolicy, stop <-chan struct{}) bool {
+	return initWithRetry(name, helper, policy, stop, 0)
+}
+
+// 从第retry次重试开始，已失败过一次时retry为1，先等待再重试
+func initWithRetry(name string, helper IpGeoHelper, policy config.RetryPolicy, stop <-chan struct{}, retry int) bool {
+	// 不限次数重试，等待时间需要有上限
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = time.Minute
+	}
+	for ; ; retry++ {
+		if retry > 0 {
+			backoff := retryBackoff(policy, retry)
+			logx.Infof("retry init %s in %s, attempt: %d", name, backoff, retry+1)
+			select {
+			case <-stop:
+				return false
+			case <-time.After(backoff):
+			}
+		}
+		err := helper.Init()
+		if err == nil {
+			return true
+		}
+		logx.Errorf("init %s failed, attempt: %d, err: %v", name, retry+1, err)
+	}
 }
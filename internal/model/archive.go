@@ -0,0 +1,343 @@
+package model
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"path"
+	"strings"
+	"time"
+)
+
+// 压缩包处理：按文件名选择条目，限制解压后的大小和压缩比，防止压缩炸弹
+
+// 未指定文件名规则时忽略的说明类文件
+var archiveDocPatterns = []string{"readme*", "license*", "changelog*", "*.txt", "*.md", "*.pdf", "*.htm", "*.html"}
+
+// tar头部中魔数的位置
+const (
+	tarMagicOffset = 257
+	tarMagic       = "ustar"
+)
+
+// 下载文件的格式
+const (
+	archiveFormatRaw = iota
+	archiveFormatGzip
+	archiveFormatTarGzip
+	archiveFormatZip
+)
+
+// 下载文件中选中的离线库文件
+type dbEntry struct {
+	format  int
+	name    string    // 压缩包内的文件名，未压缩或gzip时为空
+	modTime time.Time // 压缩包内文件的修改时间，未压缩时为零值
+}
+
+// 检查下载文件，支持zip、tar.gz和gzip格式，其他格式视为未压缩的原始文件
+// entrySuffix为离线库类型对应的文件后缀，未配置EntryPattern时用于选择文件
+// 边解压边计算所选文件的哈希和大小，不保存解压后的内容，加载时再通过openDbEntry解压
+func inspectDbFile(blob *dbBlob, entrySuffix string,
+	archiveCfg *config.ArchiveConfig) (entry dbEntry, fileHash string, size int64, err error) {
+	sr, closer, err := blob.open()
+	if err != nil {
+		return entry, "", 0, err
+	}
+	defer closer.Close()
+
+	// 根据文件头判断格式，gzip以0x1f8b开头，zip以PK开头
+	magic := make([]byte, 4)
+	n, _ := sr.ReadAt(magic, 0)
+	switch magic = magic[:n]; {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return inspectGzip(sr, entrySuffix, archiveCfg)
+	case bytes.HasPrefix(magic, []byte("PK")):
+		return inspectZip(sr, entrySuffix, archiveCfg)
+	default:
+		entry.format = archiveFormatRaw
+		fileHash, size, err = hashReader(sr)
+		return entry, fileHash, size, err
+	}
+}
+
+func inspectZip(sr *io.SectionReader, entrySuffix string,
+	archiveCfg *config.ArchiveConfig) (entry dbEntry, fileHash string, size int64, err error) {
+	zr, err := zip.NewReader(sr, sr.Size())
+	if err != nil {
+		return entry, "", 0, err
+	}
+
+	var files []*zip.File
+	var names []string
+	for _, zf := range zr.File {
+		if !zf.FileInfo().IsDir() {
+			files = append(files, zf)
+			names = append(names, zf.Name)
+		}
+	}
+	i, err := selectArchiveEntry(names, archiveCfg.EntryPattern, entrySuffix)
+	if err != nil {
+		return entry, "", 0, err
+	}
+	f := files[i]
+
+	// 先按头部信息检查，解压时再按实际大小检查，头部信息可能被伪造
+	limiter := newInflateLimiter(nil, int64(f.CompressedSize64), archiveCfg)
+	if err = limiter.check(int64(f.UncompressedSize64)); err != nil {
+		return entry, "", 0, fmt.Errorf("zip entry %s: %w", f.Name, err)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return entry, "", 0, err
+	}
+	defer rc.Close()
+	limiter.r = rc
+
+	entry = dbEntry{format: archiveFormatZip, name: f.Name, modTime: f.Modified}
+	fileHash, size, err = hashReader(limiter)
+	return entry, fileHash, size, err
+}
+
+// gzip内为tar时按条目选择文件，否则解压后的内容即为离线库文件
+func inspectGzip(sr *io.SectionReader, entrySuffix string,
+	archiveCfg *config.ArchiveConfig) (entry dbEntry, fileHash string, size int64, err error) {
+	gr, br, isTar, err := openGzip(sr, archiveCfg)
+	if err != nil {
+		return entry, "", 0, err
+	}
+	defer gr.Close()
+	if !isTar {
+		entry = dbEntry{format: archiveFormatGzip, modTime: gr.ModTime}
+		fileHash, size, err = hashReader(br)
+		return entry, fileHash, size, err
+	}
+
+	// tar只能顺序读取，需读完所有条目才能确认只有一个匹配的文件
+	entry.format = archiveFormatTarGzip
+	var names []string
+	tr := tar.NewReader(br)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entry, "", 0, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		names = append(names, hdr.Name)
+		if _, err := selectArchiveEntry([]string{hdr.Name}, archiveCfg.EntryPattern, entrySuffix); err != nil {
+			continue
+		}
+		if entry.name != "" {
+			return entry, "", 0, fmt.Errorf("multiple entries matched in archive: %s, %s", entry.name, hdr.Name)
+		}
+		entry.name, entry.modTime = hdr.Name, hdr.ModTime
+		fileHash, size, err = hashReader(tr)
+		if err != nil {
+			return entry, "", 0, err
+		}
+	}
+	if entry.name == "" {
+		_, err = selectArchiveEntry(names, archiveCfg.EntryPattern, entrySuffix)
+		return entry, "", 0, err
+	}
+	return entry, fileHash, size, nil
+}
+
+// 打开gzip流，整个解压流都计入大小限制，tar中跳过的条目也不例外
+func openGzip(sr *io.SectionReader, archiveCfg *config.ArchiveConfig) (*gzip.Reader, *bufio.Reader, bool, error) {
+	gr, err := gzip.NewReader(sr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	br := bufio.NewReader(newInflateLimiter(gr, sr.Size(), archiveCfg))
+	header, _ := br.Peek(tarMagicOffset + len(tarMagic))
+	return gr, br, bytes.HasSuffix(header, []byte(tarMagic)), nil
+}
+
+// 打开inspectDbFile选中的文件，边读边解压
+func openDbEntry(blob *dbBlob, entry dbEntry, archiveCfg *config.ArchiveConfig) (rc io.ReadCloser, err error) {
+	sr, closer, err := blob.open()
+	if err != nil {
+		return nil, err
+	}
+	r := &entryReader{closers: []io.Closer{closer}}
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	switch entry.format {
+	case archiveFormatRaw:
+		r.Reader = sr
+	case archiveFormatZip:
+		zr, err := zip.NewReader(sr, sr.Size())
+		if err != nil {
+			return nil, err
+		}
+		var f *zip.File
+		for _, zf := range zr.File {
+			if zf.Name == entry.name {
+				f = zf
+				break
+			}
+		}
+		if f == nil {
+			return nil, fmt.Errorf("entry %s not found in archive", entry.name)
+		}
+		zrc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		r.closers = append(r.closers, zrc)
+		r.Reader = newInflateLimiter(zrc, int64(f.CompressedSize64), archiveCfg)
+	case archiveFormatGzip, archiveFormatTarGzip:
+		gr, br, _, err := openGzip(sr, archiveCfg)
+		if err != nil {
+			return nil, err
+		}
+		r.closers = append(r.closers, gr)
+		r.Reader = br
+		if entry.format == archiveFormatGzip {
+			break
+		}
+		tr := tar.NewReader(br)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("entry %s not found in archive", entry.name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg && hdr.Name == entry.name {
+				break
+			}
+		}
+		r.Reader = tr
+	default:
+		return nil, fmt.Errorf("unknown archive format: %d", entry.format)
+	}
+	return r, nil
+}
+
+// 解压中的文件，关闭时由内向外关闭各层
+type entryReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *entryReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// 选择条目：配置了通配符时按通配符匹配完整路径或文件名，否则按后缀匹配，
+// 都未指定时忽略说明类文件。忽略目录和隐藏文件，匹配结果必须唯一
+func selectArchiveEntry(names []string, pattern string, suffix string) (int, error) {
+	var matched []int
+	for i, name := range names {
+		base := path.Base(name)
+		if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") || strings.Contains(name, "/__MACOSX/") {
+			continue
+		}
+		switch {
+		case pattern != "":
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return -1, fmt.Errorf("invalid archive entry pattern %q: %v", pattern, err)
+			}
+			if baseOk, _ := path.Match(pattern, base); !ok && !baseOk {
+				continue
+			}
+		case suffix != "":
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+		default:
+			if isArchiveDoc(base) {
+				continue
+			}
+		}
+		matched = append(matched, i)
+	}
+
+	switch len(matched) {
+	case 0:
+		return -1, fmt.Errorf("no entry matched in archive, pattern: %q, suffix: %q, entries: %v", pattern, suffix, names)
+	case 1:
+		return matched[0], nil
+	default:
+		var ambiguous []string
+		for _, i := range matched {
+			ambiguous = append(ambiguous, names[i])
+		}
+		return -1, fmt.Errorf("multiple entries matched in archive: %v", ambiguous)
+	}
+}
+
+func isArchiveDoc(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range archiveDocPatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 压缩炸弹
+var errArchiveTooLarge = errors.New("archive too large")
+
+// 限制解压输出的大小和相对压缩输入的比例
+type inflateLimiter struct {
+	r          io.Reader
+	n          int64
+	compressed int64
+	maxSize    int64
+	maxRatio   float64
+}
+
+func newInflateLimiter(r io.Reader, compressed int64, archiveCfg *config.ArchiveConfig) *inflateLimiter {
+	return &inflateLimiter{
+		r:          r,
+		compressed: compressed,
+		maxSize:    archiveCfg.MaxSize,
+		maxRatio:   archiveCfg.MaxRatio,
+	}
+}
+
+func (l *inflateLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if checkErr := l.check(l.n); checkErr != nil {
+		return n, checkErr
+	}
+	return n, err
+}
+
+func (l *inflateLimiter) check(size int64) error {
+	if l.maxSize > 0 && size > l.maxSize {
+		return fmt.Errorf("%w: uncompressed size exceeds %d bytes", errArchiveTooLarge, l.maxSize)
+	}
+	if l.maxRatio > 0 && l.compressed > 0 && float64(size)/float64(l.compressed) > l.maxRatio {
+		return fmt.Errorf("%w: compression ratio exceeds %g", errArchiveTooLarge, l.maxRatio)
+	}
+	return nil
+}
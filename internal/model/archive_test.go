@@ -0,0 +1,234 @@
+package model
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"hash/crc32"
+	"io"
+	"ip_geo/internal/config"
+	"strings"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content string
+}
+
+func testZip(t *testing.T, entries ...testArchiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGzip(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(content)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTarGzip(t *testing.T, entries ...testArchiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg})
+		io.WriteString(tw, e.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return testGzip(t, buf.Bytes())
+}
+
+// 头部声明的解压大小小于实际大小的zip
+func testForgedZip(t *testing.T, name string, content []byte, declared uint64) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	fw.Write(content)
+	fw.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(content),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: declared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(compressed.Bytes())
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspectDbFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		suffix      string
+		pattern     string
+		wantFormat  int
+		wantEntry   string
+		wantContent string
+		wantErr     string
+	}{
+		{name: "raw", data: []byte("raw db"), wantFormat: archiveFormatRaw, wantContent: "raw db"},
+		{name: "gzip", data: testGzip(t, []byte("gzip db")), wantFormat: archiveFormatGzip, wantContent: "gzip db"},
+		{name: "zip single", data: testZip(t, testArchiveEntry{"db.bin", "zip db"}),
+			wantFormat: archiveFormatZip, wantEntry: "db.bin", wantContent: "zip db"},
+		{name: "zip docs excluded", data: testZip(t,
+			testArchiveEntry{"README", "read me"},
+			testArchiveEntry{"LICENSE.txt", "license"},
+			testArchiveEntry{"dir/notes.md", "notes"},
+			testArchiveEntry{"dir/ipv4.dat", "zip db"}),
+			wantFormat: archiveFormatZip, wantEntry: "dir/ipv4.dat", wantContent: "zip db"},
+		{name: "zip hidden and macos entries ignored", data: testZip(t,
+			testArchiveEntry{"__MACOSX/._ipv4.xdb", "resource fork"},
+			testArchiveEntry{"data/.ipv4.xdb", "hidden"},
+			testArchiveEntry{"data/ipv4.xdb", "xdb"}),
+			suffix: ".xdb", wantFormat: archiveFormatZip, wantEntry: "data/ipv4.xdb", wantContent: "xdb"},
+		{name: "zip by suffix", data: testZip(t,
+			testArchiveEntry{"GeoLite2-City.mmdb", "city"},
+			testArchiveEntry{"GeoLite2-City.csv", "csv"}),
+			suffix: ".mmdb", wantFormat: archiveFormatZip, wantEntry: "GeoLite2-City.mmdb", wantContent: "city"},
+		{name: "zip ambiguous", data: testZip(t,
+			testArchiveEntry{"a/db.mmdb", "a"},
+			testArchiveEntry{"b/db.mmdb", "b"}),
+			suffix: ".mmdb", wantErr: "multiple entries matched"},
+		{name: "zip ambiguous without suffix", data: testZip(t,
+			testArchiveEntry{"ipv4.dat", "v4"},
+			testArchiveEntry{"ipv6.dat", "v6"}),
+			wantErr: "multiple entries matched"},
+		{name: "zip pattern matches base name", data: testZip(t,
+			testArchiveEntry{"v4/ipv4.dat", "v4"},
+			testArchiveEntry{"v6/ipv6.dat", "v6"}),
+			suffix: ".dat", pattern: "ipv6.*", wantFormat: archiveFormatZip, wantEntry: "v6/ipv6.dat", wantContent: "v6"},
+		{name: "zip no match", data: testZip(t, testArchiveEntry{"README.md", "read me"}),
+			suffix: ".mmdb", wantErr: "no entry matched"},
+		{name: "zip invalid pattern", data: testZip(t, testArchiveEntry{"db.bin", "db"}),
+			pattern: "[", wantErr: "invalid archive entry pattern"},
+		{name: "tar.gz by suffix", data: testTarGzip(t,
+			testArchiveEntry{"GeoLite2-City_20240101/COPYRIGHT.txt", "copyright"},
+			testArchiveEntry{"GeoLite2-City_20240101/GeoLite2-City.mmdb", "city"}),
+			suffix: ".mmdb", wantFormat: archiveFormatTarGzip, wantEntry: "GeoLite2-City_20240101/GeoLite2-City.mmdb", wantContent: "city"},
+		{name: "tar.gz docs excluded", data: testTarGzip(t,
+			testArchiveEntry{"CHANGELOG", "changes"},
+			testArchiveEntry{"ipv4.dat", "tar db"}),
+			wantFormat: archiveFormatTarGzip, wantEntry: "ipv4.dat", wantContent: "tar db"},
+		{name: "tar.gz ambiguous", data: testTarGzip(t,
+			testArchiveEntry{"a.mmdb", "a"},
+			testArchiveEntry{"b.mmdb", "b"}),
+			suffix: ".mmdb", wantErr: "multiple entries matched"},
+		{name: "tar.gz no match", data: testTarGzip(t, testArchiveEntry{"README", "read me"}),
+			wantErr: "no entry matched"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiveCfg := &config.ArchiveConfig{EntryPattern: tt.pattern, MaxSize: 1 << 20, MaxRatio: 100}
+			blob := &dbBlob{mem: tt.data}
+			entry, fileHash, size, err := inspectDbFile(blob, tt.suffix, archiveCfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("inspect: %v", err)
+			}
+			if entry.format != tt.wantFormat || entry.name != tt.wantEntry {
+				t.Errorf("entry = %d %q, want %d %q", entry.format, entry.name, tt.wantFormat, tt.wantEntry)
+			}
+			wantHash, wantSize, _ := hashReader(strings.NewReader(tt.wantContent))
+			if fileHash != wantHash || size != wantSize {
+				t.Errorf("hash, size = %s, %d, want %s, %d", fileHash, size, wantHash, wantSize)
+			}
+
+			rc, err := openDbEntry(blob, entry, archiveCfg)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer rc.Close()
+			if b, _ := io.ReadAll(rc); string(b) != tt.wantContent {
+				t.Errorf("content = %q, want %q", b, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestInspectDbFileLimits(t *testing.T) {
+	zeros := make([]byte, 1<<20)
+	tests := []struct {
+		name     string
+		data     []byte
+		suffix   string
+		maxSize  int64
+		maxRatio float64
+		wantErr  error
+	}{
+		{name: "zip within limits", data: testZip(t, testArchiveEntry{"db.bin", string(zeros)}), maxSize: 1 << 20, maxRatio: 0},
+		{name: "zip max size", data: testZip(t, testArchiveEntry{"db.bin", string(zeros)}), maxSize: 1<<20 - 1, wantErr: errArchiveTooLarge},
+		{name: "zip max ratio", data: testZip(t, testArchiveEntry{"db.bin", string(zeros)}), maxSize: 1 << 30, maxRatio: 100, wantErr: errArchiveTooLarge},
+		// 头部声明的大小可以伪造，解压超出声明大小时即报错
+		{name: "zip forged header", data: testForgedZip(t, "db.bin", zeros, 10), maxSize: 1 << 10, wantErr: zip.ErrFormat},
+		{name: "gzip within limits", data: testGzip(t, zeros), maxSize: 1 << 20, maxRatio: 0},
+		{name: "gzip max size", data: testGzip(t, zeros), maxSize: 1 << 19, wantErr: errArchiveTooLarge},
+		{name: "gzip max ratio", data: testGzip(t, zeros), maxSize: 1 << 30, maxRatio: 100, wantErr: errArchiveTooLarge},
+		// tar中未选中的条目同样计入解压大小
+		{name: "tar.gz skipped entry", data: testTarGzip(t,
+			testArchiveEntry{"padding.bin", string(zeros)},
+			testArchiveEntry{"db.mmdb", "db"}), suffix: ".mmdb", maxSize: 1 << 19, wantErr: errArchiveTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiveCfg := &config.ArchiveConfig{MaxSize: tt.maxSize, MaxRatio: tt.maxRatio}
+			_, _, _, err := inspectDbFile(&dbBlob{mem: tt.data}, tt.suffix, archiveCfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// 检查后收紧限制，加载时解压同样受限
+	data := testGzip(t, zeros)
+	blob := &dbBlob{mem: data}
+	entry, _, _, err := inspectDbFile(blob, "", &config.ArchiveConfig{MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	rc, err := openDbEntry(blob, entry, &config.ArchiveConfig{MaxSize: 1 << 10})
+	if err == nil {
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+	if !errors.Is(err, errArchiveTooLarge) {
+		t.Errorf("open with smaller max size: err = %v, want too large", err)
+	}
+}
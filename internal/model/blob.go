@@ -0,0 +1,167 @@
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"os"
+)
+
+// 下载文件的存放：内存或工作目录，以及开始前的磁盘空间和内存检查
+
+// 下载文件的存放位置
+const (
+	DbStorageDisk   = "disk"
+	DbStorageMemory = "memory"
+)
+
+// 下载的原始文件，存放在内存或工作目录的文件中
+type dbBlob struct {
+	path string // 磁盘存放时的文件路径
+	mem  []byte // 内存存放时的内容
+	keep bool   // 为本地缓存中的文件，不删除
+}
+
+func newDbBlob(dsCfg *config.DataSyncConfig) (*dbBlob, error) {
+	if dsCfg.Storage == DbStorageMemory {
+		return &dbBlob{}, nil
+	}
+	f, err := os.CreateTemp(dsCfg.WorkDir, "ipgeo-*")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &dbBlob{path: f.Name()}, nil
+}
+
+func (b *dbBlob) inMemory() bool {
+	return b.path == ""
+}
+
+// 预留内存的上限，size来自服务端的Content-Length等，不可信，超出部分在写入时按需扩容
+const dbBlobMaxReserve = 64 << 20
+
+// 预留内存，减少下载过程中的扩容
+func (b *dbBlob) reserve(size int64) {
+	size = min(size, dbBlobMaxReserve)
+	if b.inMemory() && size > int64(cap(b.mem)) {
+		mem := make([]byte, len(b.mem), size)
+		copy(mem, b.mem)
+		b.mem = mem
+	}
+}
+
+// 从offset处开始写入，丢弃offset之后已有的内容
+func (b *dbBlob) writer(offset int64) (io.WriteCloser, error) {
+	if b.inMemory() {
+		if offset > int64(len(b.mem)) {
+			return nil, fmt.Errorf("write offset %d exceeds size %d", offset, len(b.mem))
+		}
+		b.mem = b.mem[:offset]
+		return memBlobWriter{b}, nil
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(offset); err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+type memBlobWriter struct {
+	b *dbBlob
+}
+
+func (w memBlobWriter) Write(p []byte) (int, error) {
+	w.b.mem = append(w.b.mem, p...)
+	return len(p), nil
+}
+
+func (w memBlobWriter) Close() error {
+	return nil
+}
+
+// 只读打开，返回的reader支持随机读取，用完后需关闭closer
+func (b *dbBlob) open() (*io.SectionReader, io.Closer, error) {
+	if b.inMemory() {
+		return io.NewSectionReader(bytes.NewReader(b.mem), 0, int64(len(b.mem))), io.NopCloser(nil), nil
+	}
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return io.NewSectionReader(f, 0, fi.Size()), f, nil
+}
+
+// 读出全部内容，内存存放时直接返回，不可修改
+func (b *dbBlob) bytes() ([]byte, error) {
+	if b.inMemory() {
+		return b.mem, nil
+	}
+	return os.ReadFile(b.path)
+}
+
+// 计算内容的sha256，用于标识离线库文件
+func (b *dbBlob) hash() (string, error) {
+	sr, closer, err := b.open()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+	hash, _, err := hashReader(sr)
+	return hash, err
+}
+
+func (b *dbBlob) remove() {
+	if b.path != "" && !b.keep {
+		removeFile(b.path)
+	}
+	*b = dbBlob{}
+}
+
+// 计算读出内容的sha256，同时返回读出的字节数
+func hashReader(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// 检查剩余磁盘空间和内存是否足够，无法获取剩余量时不检查
+// disk为下载文件需要的磁盘空间，内存存放时计入内存；mem为解析需要的内存
+func checkDbResources(dsCfg *config.DataSyncConfig, disk int64, mem int64) error {
+	if dsCfg.Storage == DbStorageMemory {
+		disk, mem = 0, mem+disk
+	}
+	if disk > 0 {
+		dir := dsCfg.WorkDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		if avail, ok := availableDisk(dir); ok && avail < disk {
+			return fmt.Errorf("insufficient disk space in %s, need %d bytes, available %d bytes", dir, disk, avail)
+		}
+	}
+	if mem > 0 {
+		if avail, ok := availableMemory(); ok && avail < mem {
+			return fmt.Errorf("insufficient memory, need %d bytes, available %d bytes", mem, avail)
+		}
+	}
+	return nil
+}
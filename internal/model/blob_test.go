@@ -0,0 +1,102 @@
+package model
+
+import (
+	"bytes"
+	"io"
+	"ip_geo/internal/config"
+	"strings"
+	"testing"
+)
+
+// 写入超过预留上限的内容，超出部分按需扩容，内容完整
+func TestDbBlobMemoryOverReserve(t *testing.T) {
+	size := dbBlobMaxReserve + 3<<20 + 7
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(i % 251)
+	}
+	want := bytes.Repeat(chunk, size/len(chunk)+1)[:size]
+
+	blob, err := newDbBlob(&config.DataSyncConfig{Storage: DbStorageMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := blob.writer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(want[:10])
+	// 声明的大小不可信，预留不超过上限，已写入的内容保留
+	blob.reserve(int64(size) << 4)
+	if cap(blob.mem) != dbBlobMaxReserve || !bytes.Equal(blob.mem, want[:10]) {
+		t.Fatalf("reserved cap %d, content %v", cap(blob.mem), blob.mem)
+	}
+	if _, err = io.Copy(w, bytes.NewReader(want[10:])); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	got, _ := blob.bytes()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content mismatch, got %d bytes, want %d", len(got), len(want))
+	}
+	wantHash, _, _ := hashReader(bytes.NewReader(want))
+	if hash, err := blob.hash(); err != nil || hash != wantHash {
+		t.Errorf("hash = %s, %v, want %s", hash, err, wantHash)
+	}
+
+	// 从中间续写时丢弃之后的内容
+	offset := int64(dbBlobMaxReserve + 1)
+	if w, err = blob.writer(offset); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("tail"))
+	w.Close()
+	got, _ = blob.bytes()
+	if int64(len(got)) != offset+4 || !bytes.Equal(got[:offset], want[:offset]) || string(got[offset:]) != "tail" {
+		t.Errorf("after rewrite: %d bytes, tail %q", len(got), got[offset:])
+	}
+	if _, err = blob.writer(int64(len(got)) + 1); err == nil {
+		t.Error("expected error for offset beyond size")
+	}
+}
+
+func TestCheckDbResources(t *testing.T) {
+	dir := t.TempDir()
+	avail, ok := availableDisk(dir)
+	if !ok {
+		t.Skip("disk space not available on this platform")
+	}
+	diskCfg := &config.DataSyncConfig{Storage: DbStorageDisk, WorkDir: dir}
+	memCfg := &config.DataSyncConfig{Storage: DbStorageMemory}
+	tests := []struct {
+		name    string
+		dsCfg   *config.DataSyncConfig
+		disk    int64
+		mem     int64
+		wantErr string
+	}{
+		{"enough", diskCfg, 1 << 10, 1 << 10, ""},
+		{"low disk space", diskCfg, avail + 1<<30, 0, "insufficient disk space in " + dir},
+		{"low memory", diskCfg, 0, 1 << 62, "insufficient memory"},
+		// 内存存放时下载文件计入内存，不检查磁盘
+		{"memory storage counts download", memCfg, 1 << 62, 0, "insufficient memory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := availableMemory(); !ok && strings.Contains(tt.wantErr, "memory") {
+				t.Skip("available memory unknown")
+			}
+			err := checkDbResources(tt.dsCfg, tt.disk, tt.mem)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 本地快照缓存：每次切换成功后保存解压后的离线库文件及来源信息，
+// 启动时先加载最新的有效快照，下载不可用时也能提供服务
+
+const (
+	snapshotCacheMetaFile  = "meta.json"
+	snapshotCacheDirPrefix = "snap-"
+	snapshotCacheTmpPrefix = ".tmp-"
+)
+
+// 缓存中的一个快照
+type cachedSnapshot struct {
+	Provider string
+	Version  string
+	SavedAt  time.Time
+	Files    []cachedDbFile
+}
+
+type cachedDbFile struct {
+	Url  string // 主下载地址，与dbFileRequest.Url对应
+	Name string // 快照目录中的文件名
+	Meta dbFileMeta
+}
+
+type snapshotCache struct {
+	id       string // 由提供方和下载地址确定，配置相同的实例间一致
+	dir      string // 为空表示未启用
+	keep     int
+	provider string
+	reqs     []dbFileRequest
+}
+
+// 按提供方和下载地址划分缓存目录，不同数据源的快照互不混用
+func newSnapshotCache(dsCfg *config.DataSyncConfig, provider string, reqs []dbFileRequest) *snapshotCache {
+	h := sha256.New()
+	for _, req := range reqs {
+		h.Write([]byte(req.Url + "\n"))
+	}
+	c := &snapshotCache{
+		id:       provider + "-" + hex.EncodeToString(h.Sum(nil))[:12],
+		keep:     max(dsCfg.CacheKeep, 1),
+		provider: provider,
+		reqs:     reqs,
+	}
+	if dsCfg.CacheDir != "" {
+		c.dir = filepath.Join(dsCfg.CacheDir, c.id)
+	}
+	return c
+}
+
+func (c *snapshotCache) enabled() bool {
+	return c.dir != ""
+}
+
+// 保存已切换的快照并清理旧快照，保存后的快照同时提供给同伴实例
+// 失败只记录日志，不影响已切换的离线库
+func (c *snapshotCache) save(files []dbFile, version string) {
+	if !c.enabled() {
+		return
+	}
+	name, snap, err := c.doSave(files, version)
+	if err != nil {
+		// 已切换的离线库与缓存中的快照不一致，不再提供给同伴
+		unpublishSnapshot(c.id)
+		logx.Errorf("save snapshot cache failed, dir: %s, err: %v", c.dir, err)
+		return
+	}
+	c.publish(name, snap)
+}
+
+// 协调刷新中在切换前保存快照，只作为待切换的快照提供给跟随同一通知的实例，
+// 当前提供的快照不变，切换后再调用publish
+func (c *snapshotCache) stage(files []dbFile, version string) (name string, snap cachedSnapshot, err error) {
+	if !c.enabled() {
+		return "", snap, errors.New("snapshot cache not enabled")
+	}
+	if name, snap, err = c.doSave(files, version); err != nil {
+		return "", snap, err
+	}
+	pendSnapshot(c.id, filepath.Join(c.dir, name), snap)
+	return name, snap, nil
+}
+
+// 提供已切换的快照并清理旧快照
+func (c *snapshotCache) publish(name string, snap cachedSnapshot) {
+	publishSnapshot(c.id, filepath.Join(c.dir, name), snap)
+	c.prune()
+}
+
+// 先写入临时目录，完整写入后再重命名，避免启动时读到半个快照
+func (c *snapshotCache) doSave(files []dbFile, version string) (name string, snap cachedSnapshot, err error) {
+	if err = os.MkdirAll(c.dir, 0o755); err != nil {
+		return "", snap, err
+	}
+	tmpDir, err := os.MkdirTemp(c.dir, snapshotCacheTmpPrefix)
+	if err != nil {
+		return "", snap, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	snap = cachedSnapshot{Provider: c.provider, Version: version, SavedAt: time.Now().UTC()}
+	for i := range files {
+		name := strconv.Itoa(i) + ".db"
+		if err = writeDbFile(&files[i], filepath.Join(tmpDir, name)); err != nil {
+			return "", snap, err
+		}
+		snap.Files = append(snap.Files, cachedDbFile{Url: files[i].Url, Name: name, Meta: files[i].Meta})
+	}
+	meta, err := json.Marshal(snap)
+	if err != nil {
+		return "", snap, err
+	}
+	if err = os.WriteFile(filepath.Join(tmpDir, snapshotCacheMetaFile), meta, 0o644); err != nil {
+		return "", snap, err
+	}
+
+	name = snapshotCacheDirPrefix + strconv.FormatInt(snap.SavedAt.UnixNano(), 10)
+	if err = os.Rename(tmpDir, filepath.Join(c.dir, name)); err != nil {
+		return "", snap, err
+	}
+	logx.Infof("snapshot cache saved, dir: %s, name: %s", c.dir, name)
+	return name, snap, nil
+}
+
+func writeDbFile(file *dbFile, path string) error {
+	rc, err := file.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, rc); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 只保留最新的keep个快照，同时清理写入中断留下的临时目录
+func (c *snapshotCache) prune() {
+	names, err := c.snapshotNames()
+	if err != nil {
+		logx.Errorf("list snapshot cache failed, dir: %s, err: %v", c.dir, err)
+		return
+	}
+	for _, name := range names[min(c.keep, len(names)):] {
+		if err := os.RemoveAll(filepath.Join(c.dir, name)); err != nil {
+			logx.Errorf("remove snapshot cache failed, name: %s, err: %v", name, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(c.dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), snapshotCacheTmpPrefix) {
+			os.RemoveAll(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+// 按保存时间从新到旧排列的快照目录名
+func (c *snapshotCache) snapshotNames() ([]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type named struct {
+		name    string
+		savedAt int64
+	}
+	var snaps []named
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), snapshotCacheDirPrefix) {
+			continue
+		}
+		savedAt, err := strconv.ParseInt(strings.TrimPrefix(e.Name(), snapshotCacheDirPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, named{e.Name(), savedAt})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].savedAt > snaps[j].savedAt })
+
+	names := make([]string, 0, len(snaps))
+	for _, s := range snaps {
+		names = append(names, s.name)
+	}
+	return names, nil
+}
+
+// 启动时在刷新锁内加载最新的有效快照，未启用缓存或没有可用的快照时返回false
+func loadSnapshotCache(refreshMu *sync.Mutex, cache *snapshotCache, apply func(files []dbFile) error) (ok bool) {
+	if !cache.enabled() {
+		return false
+	}
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			logx.Errorf("load snapshot cache panic: %v", panicErr)
+			ok = false
+		}
+	}()
+
+	if err := cache.load(apply); err != nil {
+		logx.Infof("no snapshot cache loaded, download instead: %v", err)
+		return false
+	}
+	return true
+}
+
+// 从新到旧依次尝试缓存的快照，校验通过后交给apply加载，直至成功
+// 没有可用的快照时返回错误
+func (c *snapshotCache) load(apply func(files []dbFile) error) error {
+	if !c.enabled() {
+		return errors.New("snapshot cache not enabled")
+	}
+	names, err := c.snapshotNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		snap, files, err := c.loadSnapshot(name)
+		if err == nil {
+			err = apply(files)
+		}
+		if err != nil {
+			logx.Errorf("load snapshot cache failed, dir: %s, name: %s, err: %v", c.dir, name, err)
+			continue
+		}
+		publishSnapshot(c.id, filepath.Join(c.dir, name), snap)
+		logx.Infof("snapshot cache loaded, dir: %s, name: %s", c.dir, name)
+		return nil
+	}
+	return fmt.Errorf("no valid snapshot in cache dir %s", c.dir)
+}
+
+// 读取快照的来源信息并按文件哈希校验内容，文件作为未压缩的原始文件加载
+func (c *snapshotCache) loadSnapshot(name string) (snap cachedSnapshot, files []dbFile, err error) {
+	dir := filepath.Join(c.dir, name)
+	b, err := os.ReadFile(filepath.Join(dir, snapshotCacheMetaFile))
+	if err != nil {
+		return snap, nil, err
+	}
+	if err = json.Unmarshal(b, &snap); err != nil {
+		return snap, nil, fmt.Errorf("invalid snapshot meta: %v", err)
+	}
+	if err = c.checkSnapshot(snap); err != nil {
+		return snap, nil, err
+	}
+
+	files = make([]dbFile, len(snap.Files))
+	for i, cf := range snap.Files {
+		blob := &dbBlob{path: filepath.Join(dir, filepath.Base(cf.Name)), keep: true}
+		if files[i], err = c.snapshotFile(i, cf, blob); err != nil {
+			return snap, nil, err
+		}
+	}
+	return snap, files, nil
+}
+
+// 快照的提供方和文件须与本实例的配置一致
+func (c *snapshotCache) checkSnapshot(snap cachedSnapshot) error {
+	if snap.Provider != c.provider || len(snap.Files) != len(c.reqs) {
+		return fmt.Errorf("snapshot does not match provider %s with %d files", c.provider, len(c.reqs))
+	}
+	for i, cf := range snap.Files {
+		if cf.Url != c.reqs[i].Url {
+			return fmt.Errorf("snapshot file %d url mismatch, expected %s, but got %s", i, c.reqs[i].Url, cf.Url)
+		}
+	}
+	return nil
+}
+
+// 按文件哈希校验快照中的第i个文件，作为未压缩的原始文件加载
+func (c *snapshotCache) snapshotFile(i int, cf cachedDbFile, blob *dbBlob) (dbFile, error) {
+	hash, err := blob.hash()
+	if err != nil {
+		return dbFile{}, err
+	}
+	if hash != cf.Meta.FileHash {
+		return dbFile{}, fmt.Errorf("snapshot file %s sha256 mismatch, expected %s, but got %s", cf.Name, cf.Meta.FileHash, hash)
+	}
+	return dbFile{
+		dbFileRequest: c.reqs[i],
+		Meta:          cf.Meta,
+		blob:          blob,
+		entry:         dbEntry{format: archiveFormatRaw, modTime: cf.Meta.EntryModTime},
+		archive:       &config.ArchiveConfig{},
+	}, nil
+}
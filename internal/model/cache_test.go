@@ -0,0 +1,141 @@
+package model
+
+import (
+	"ip_geo/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSnapshotCache(t *testing.T, keep int) *snapshotCache {
+	t.Helper()
+	dsCfg := &config.DataSyncConfig{CacheDir: t.TempDir(), CacheKeep: keep}
+	return newSnapshotCache(dsCfg, "cachetest", []dbFileRequest{{Url: "http://example.com/cache.db"}})
+}
+
+// 保存内容为content的快照，返回快照目录名
+func saveTestSnapshot(t *testing.T, c *snapshotCache, content string) string {
+	t.Helper()
+	blob := &dbBlob{mem: []byte(content)}
+	hash, _ := blob.hash()
+	files := []dbFile{{
+		dbFileRequest: c.reqs[0],
+		Meta:          dbFileMeta{FileHash: hash, FileSize: int64(len(content))},
+		blob:          blob,
+		entry:         dbEntry{format: archiveFormatRaw},
+		archive:       &config.ArchiveConfig{},
+	}}
+	before, _ := c.snapshotNames()
+	c.save(files, content)
+	names, _ := c.snapshotNames()
+	if len(names) == 0 || len(before) > 0 && names[0] == before[0] {
+		t.Fatalf("snapshot %q not saved", content)
+	}
+	return names[0]
+}
+
+// 加载缓存，返回加载的快照内容
+func loadTestSnapshot(c *snapshotCache) (string, error) {
+	var content string
+	err := c.load(func(files []dbFile) error {
+		b, err := files[0].readAll()
+		content = string(b)
+		return err
+	})
+	return content, err
+}
+
+func TestSnapshotCacheLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string)
+		want    string
+	}{
+		{name: "newest valid", want: "v3"},
+		{name: "truncated file", corrupt: func(t *testing.T, dir string) {
+			os.Truncate(filepath.Join(dir, "0.db"), 1)
+		}, want: "v2"},
+		// 大小相同但内容被修改
+		{name: "hash mismatch", corrupt: func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, "0.db"), []byte("x3"), 0o644)
+		}, want: "v2"},
+		{name: "missing file", corrupt: func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "0.db"))
+		}, want: "v2"},
+		{name: "invalid meta", corrupt: func(t *testing.T, dir string) {
+			os.WriteFile(filepath.Join(dir, snapshotCacheMetaFile), []byte("{"), 0o644)
+		}, want: "v2"},
+		{name: "other provider", corrupt: func(t *testing.T, dir string) {
+			other := &snapshotCache{dir: filepath.Dir(dir), keep: 3, provider: "other", reqs: []dbFileRequest{{}}}
+			os.RemoveAll(dir)
+			saveTestSnapshot(t, other, "other")
+		}, want: "v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestSnapshotCache(t, 3)
+			saveTestSnapshot(t, c, "v1")
+			saveTestSnapshot(t, c, "v2")
+			newest := saveTestSnapshot(t, c, "v3")
+			if tt.corrupt != nil {
+				tt.corrupt(t, filepath.Join(c.dir, newest))
+			}
+			got, err := loadTestSnapshot(c)
+			if err != nil || got != tt.want {
+				t.Errorf("loaded %q, err = %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// 写入中断留下的临时目录不会被加载，保存新快照时清理
+func TestSnapshotCacheLeftoverTmpDir(t *testing.T) {
+	c := newTestSnapshotCache(t, 2)
+	name := saveTestSnapshot(t, c, "v1")
+	tmpDir := filepath.Join(c.dir, snapshotCacheTmpPrefix+"interrupted")
+	os.MkdirAll(tmpDir, 0o755)
+	meta, _ := os.ReadFile(filepath.Join(c.dir, name, snapshotCacheMetaFile))
+	os.WriteFile(filepath.Join(tmpDir, snapshotCacheMetaFile), meta, 0o644)
+	os.WriteFile(filepath.Join(tmpDir, "0.db"), []byte("v2"), 0o644)
+
+	if names, _ := c.snapshotNames(); len(names) != 1 || names[0] != name {
+		t.Errorf("snapshots = %v, want only %s", names, name)
+	}
+	if got, err := loadTestSnapshot(c); err != nil || got != "v1" {
+		t.Errorf("loaded %q, err = %v, want v1", got, err)
+	}
+
+	saveTestSnapshot(t, c, "v2")
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("tmp dir not removed: %v", err)
+	}
+}
+
+func TestSnapshotCachePrune(t *testing.T) {
+	c := newTestSnapshotCache(t, 2)
+	var saved []string
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		saved = append(saved, saveTestSnapshot(t, c, v))
+	}
+	names, err := c.snapshotNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != saved[3] || names[1] != saved[2] {
+		t.Errorf("snapshots = %v, want newest two %v", names, saved[2:])
+	}
+	// 非快照目录不受影响
+	os.MkdirAll(filepath.Join(c.dir, "other"), 0o755)
+	c.prune()
+	if _, err = os.Stat(filepath.Join(c.dir, "other")); err != nil {
+		t.Errorf("other dir removed: %v", err)
+	}
+
+	// 全部快照都无效时报错
+	for _, name := range names {
+		os.Remove(filepath.Join(c.dir, name, "0.db"))
+	}
+	if _, err = loadTestSnapshot(c); err == nil {
+		t.Error("want error without valid snapshot")
+	}
+}
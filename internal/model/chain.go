@@ -0,0 +1,247 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"ip_geo/internal/config"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+var (
+	_ IpGeoHelper = (*ChainHelper)(nil)
+)
+
+// 相互关联的字段作为一组，同组字段取自同一成员，避免如asn与asn_org、isp来自不同成员而相互矛盾
+// 位置组只取自国家代码与国家组结果一致的成员
+var chainFieldGroups = [][]string{
+	{"continent_code", "country", "country_code"},
+	{"region", "city", "district", "area_code", "zip_code", "latitude", "longitude", "timezone"},
+	{"isp", "isp_domain", "line", "asn", "asn_org"},
+	{"idc"},
+	{"station"},
+}
+
+const chainLocationGroup = 1
+
+// 组合多个查询助手，按字段组的优先级合并结果，前面的成员查不到或同组字段都为空时由后面的成员补齐
+// 各成员独立初始化，未就绪的成员不参与查询
+type ChainHelper struct {
+	members    []*chainMember
+	precedence [][]int // 字段组 -> 成员下标的优先顺序，与chainFieldGroups对应
+	done       chan struct{}
+	cleanOnce  sync.Once
+}
+
+type chainMember struct {
+	name   string
+	helper IpGeoHelper
+	cfgPtr *atomic.Pointer[config.Config]
+	ready  atomic.Bool
+}
+
+func NewChainHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (*ChainHelper, error) {
+	cfg := cfgPtr.Load()
+	if cfg.ChainConfig == nil || len(cfg.ChainConfig.Members) == 0 {
+		return nil, errors.New("chain members missing")
+	}
+
+	helper := &ChainHelper{done: make(chan struct{})}
+	memberIdx := make(map[string]int)
+	for i, m := range cfg.ChainConfig.Members {
+		if _, ok := memberIdx[m.Name]; ok || m.Name == "" {
+			return nil, fmt.Errorf("empty or duplicate chain member name: %q", m.Name)
+		}
+		if m.Provider == ProviderChain {
+			return nil, fmt.Errorf("chain member %s can not be a chain", m.Name)
+		}
+		memberIdx[m.Name] = i
+
+		// 成员使用独立的配置，未覆盖的部分沿用全局配置
+		memberCfg := *cfg
+		memberCfg.Provider = m.Provider
+		memberCfg.ChainConfig = nil
+		if m.DataSyncConfig != nil {
+			memberCfg.DataSyncConfig = m.DataSyncConfig
+		}
+		if m.IpDataCloudConfig != nil {
+			memberCfg.IpDataCloudConfig = m.IpDataCloudConfig
+		}
+		if m.MaxMindConfig != nil {
+			memberCfg.MaxMindConfig = m.MaxMindConfig
+		}
+		if m.Ip2RegionConfig != nil {
+			memberCfg.Ip2RegionConfig = m.Ip2RegionConfig
+		}
+		if m.CsvConfig != nil {
+			memberCfg.CsvConfig = m.CsvConfig
+		}
+		memberCfgPtr := &atomic.Pointer[config.Config]{}
+		memberCfgPtr.Store(&memberCfg)
+
+		h, err := NewIpGeoHelper(memberCfgPtr, cluster)
+		if err != nil {
+			return nil, fmt.Errorf("new chain member %s failed: %v", m.Name, err)
+		}
+		helper.members = append(helper.members, &chainMember{name: m.Name, helper: h, cfgPtr: memberCfgPtr})
+	}
+
+	var err error
+	helper.precedence, err = chainPrecedence(cfg.ChainConfig.FieldPrecedence, memberIdx)
+	if err != nil {
+		return nil, err
+	}
+	return helper, nil
+}
+
+// 按字段的优先级配置得到各字段组的优先顺序，同组字段的配置必须一致，未配置的组按成员顺序
+func chainPrecedence(fieldPrecedence map[string][]string, memberIdx map[string]int) ([][]int, error) {
+	groupOf := make(map[string]int)
+	for g, fields := range chainFieldGroups {
+		for _, field := range fields {
+			groupOf[field] = g
+		}
+	}
+
+	precedence := make([][]int, len(chainFieldGroups))
+	configuredBy := make([]string, len(chainFieldGroups))
+	for field, names := range fieldPrecedence {
+		g, ok := groupOf[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown chain field: %s", field)
+		}
+		order := make([]int, 0, len(names))
+		for _, name := range names {
+			i, ok := memberIdx[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown chain member %s in precedence of field %s", name, field)
+			}
+			order = append(order, i)
+		}
+		if configuredBy[g] != "" && !slices.Equal(precedence[g], order) {
+			return nil, fmt.Errorf("fields %s and %s must share the same precedence, they are taken from the same member",
+				configuredBy[g], field)
+		}
+		precedence[g], configuredBy[g] = order, field
+	}
+	for g := range precedence {
+		if configuredBy[g] == "" {
+			for i := 0; i < len(memberIdx); i++ {
+				precedence[g] = append(precedence[g], i)
+			}
+		}
+	}
+	return precedence, nil
+}
+
+func (helper *ChainHelper) QueryGeo(ipAddr string) (*GeoInfo, error) {
+	infos := make([]*GeoInfo, len(helper.members))
+	var firstErr error
+	for i, m := range helper.members {
+		if !m.ready.Load() {
+			continue
+		}
+		info, err := m.helper.QueryGeo(ipAddr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", m.name, err)
+			}
+			continue
+		}
+		infos[i] = info
+	}
+
+	resp := &GeoInfo{Sources: make(map[string]string)}
+	found := false
+	for _, info := range infos {
+		if info != nil {
+			resp.DBVersion = info.DBVersion // 版本取第一个查到的成员
+			resp.DBLoadTime = info.DBLoadTime
+			found = true
+			break
+		}
+	}
+	if !found {
+		if firstErr == nil {
+			firstErr = errors.New("no chain member ready")
+		}
+		return nil, firstErr
+	}
+
+	for g, fields := range chainFieldGroups {
+		for _, i := range helper.precedence[g] {
+			info := infos[i]
+			if info == nil || !hasGeoField(info, fields) {
+				continue
+			}
+			if g == chainLocationGroup && resp.CountryCode != "" && info.CountryCode != resp.CountryCode {
+				continue
+			}
+			for _, field := range fields {
+				f := geoFields[field]
+				if v := f.get(info); v != "" {
+					f.set(resp, v)
+					resp.Sources[field] = helper.members[i].name
+				}
+			}
+			break
+		}
+	}
+
+	return resp, nil
+}
+
+func hasGeoField(info *GeoInfo, fields []string) bool {
+	for _, field := range fields {
+		if geoFields[field].get(info) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 各成员独立初始化，至少一个成员就绪即可提供查询，失败的成员在后台按重试策略继续初始化
+func (helper *ChainHelper) Init() error {
+	var failed []*chainMember
+	var errs []error
+	for _, m := range helper.members {
+		if m.ready.Load() {
+			continue
+		}
+		if err := m.helper.Init(); err != nil {
+			logx.Errorf("init chain member %s failed: %v", m.name, err)
+			failed = append(failed, m)
+			errs = append(errs, fmt.Errorf("%s: %v", m.name, err))
+			continue
+		}
+		m.ready.Store(true)
+		logx.Infof("chain member %s ready", m.name)
+	}
+	if len(failed) == len(helper.members) {
+		return fmt.Errorf("no chain member ready: %v", errors.Join(errs...))
+	}
+
+	for _, m := range failed {
+		go func(m *chainMember) {
+			if initWithRetry("chain member "+m.name, m.helper, m.cfgPtr.Load().DataSyncConfig.Retry, helper.done, 1) {
+				m.ready.Store(true)
+				logx.Infof("chain member %s ready", m.name)
+			}
+		}(m)
+	}
+	return nil
+}
+
+// 清理
+func (helper *ChainHelper) Clean() error {
+	helper.cleanOnce.Do(func() { close(helper.done) })
+	for _, m := range helper.members {
+		if err := m.helper.Clean(); err != nil {
+			logx.Errorf("clean chain member %s failed: %v", m.name, err)
+		}
+	}
+	return nil
+}
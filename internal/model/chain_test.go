@@ -0,0 +1,159 @@
+package model
+
+import (
+	"errors"
+	"ip_geo/internal/config"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeGeoHelper struct {
+	info    *GeoInfo
+	initErr error
+}
+
+func (h *fakeGeoHelper) Init() error  { return h.initErr }
+func (h *fakeGeoHelper) Clean() error { return nil }
+func (h *fakeGeoHelper) QueryGeo(string) (*GeoInfo, error) {
+	if h.info == nil {
+		return nil, errors.New("not found")
+	}
+	info := *h.info
+	return &info, nil
+}
+
+func newTestChain(t *testing.T, fieldPrecedence map[string][]string, members ...*chainMember) *ChainHelper {
+	t.Helper()
+	memberIdx := make(map[string]int)
+	for i, m := range members {
+		memberIdx[m.name] = i
+	}
+	precedence, err := chainPrecedence(fieldPrecedence, memberIdx)
+	if err != nil {
+		t.Fatalf("chain precedence: %v", err)
+	}
+	return &ChainHelper{members: members, precedence: precedence, done: make(chan struct{})}
+}
+
+func TestChainFieldGroupsCoverGeoFields(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, fields := range chainFieldGroups {
+		for _, field := range fields {
+			if _, ok := geoFields[field]; !ok || seen[field] {
+				t.Errorf("unknown or duplicate field in groups: %s", field)
+			}
+			seen[field] = true
+		}
+	}
+	for _, field := range geoFieldNames {
+		if !seen[field] {
+			t.Errorf("field %s not in any group", field)
+		}
+	}
+}
+
+func TestChainQueryGeo(t *testing.T) {
+	cn := &GeoInfo{DBVersion: "a-1", CountryCode: "CN", Country: "China", City: "Beijing", Isp: "ChinaNet", Line: "telecom"}
+	mm := &GeoInfo{DBVersion: "b-1", CountryCode: "CN", Country: "China", City: "Haidian", Latitude: "39.9",
+		Asn: 4134, AsnOrg: "CHINANET-BACKBONE"}
+	us := &GeoInfo{DBVersion: "c-1", CountryCode: "US", Country: "United States", City: "Ashburn", Timezone: "America/New_York"}
+
+	tests := []struct {
+		name            string
+		members         map[string]*GeoInfo
+		order           []string
+		fieldPrecedence map[string][]string
+		want            *GeoInfo
+	}{
+		{
+			name:    "member order",
+			members: map[string]*GeoInfo{"a": cn, "b": mm},
+			order:   []string{"a", "b"},
+			want: &GeoInfo{DBVersion: "a-1", CountryCode: "CN", Country: "China", City: "Beijing", Isp: "ChinaNet", Line: "telecom",
+				Sources: map[string]string{"country_code": "a", "country": "a", "city": "a", "isp": "a", "line": "a"}},
+		},
+		{
+			// 网络组整体取自b，不会出现a的isp与b的asn混合
+			name:            "network group precedence",
+			members:         map[string]*GeoInfo{"a": cn, "b": mm},
+			order:           []string{"a", "b"},
+			fieldPrecedence: map[string][]string{"asn": {"b", "a"}, "city": {"b", "a"}},
+			want: &GeoInfo{DBVersion: "a-1", CountryCode: "CN", Country: "China", City: "Haidian", Latitude: "39.9",
+				Asn: 4134, AsnOrg: "CHINANET-BACKBONE",
+				Sources: map[string]string{"country_code": "a", "country": "a", "city": "b", "latitude": "b", "asn": "b", "asn_org": "b"}},
+		},
+		{
+			// 位置组跳过国家代码不一致的成员
+			name:            "location follows country",
+			members:         map[string]*GeoInfo{"a": cn, "c": us},
+			order:           []string{"a", "c"},
+			fieldPrecedence: map[string][]string{"city": {"c", "a"}},
+			want: &GeoInfo{DBVersion: "a-1", CountryCode: "CN", Country: "China", City: "Beijing", Isp: "ChinaNet", Line: "telecom",
+				Sources: map[string]string{"country_code": "a", "country": "a", "city": "a", "isp": "a", "line": "a"}},
+		},
+		{
+			name:    "first member not found",
+			members: map[string]*GeoInfo{"a": nil, "c": us},
+			order:   []string{"a", "c"},
+			want: &GeoInfo{DBVersion: "c-1", CountryCode: "US", Country: "United States", City: "Ashburn", Timezone: "America/New_York",
+				Sources: map[string]string{"country_code": "c", "country": "c", "city": "c", "timezone": "c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var members []*chainMember
+			for _, name := range tt.order {
+				m := &chainMember{name: name, helper: &fakeGeoHelper{info: tt.members[name]}}
+				m.ready.Store(true)
+				members = append(members, m)
+			}
+			got, err := newTestChain(t, tt.fieldPrecedence, members...).QueryGeo("1.2.3.4")
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainPrecedenceConflict(t *testing.T) {
+	memberIdx := map[string]int{"a": 0, "b": 1}
+	_, err := chainPrecedence(map[string][]string{"asn": {"b", "a"}, "asn_org": {"a", "b"}}, memberIdx)
+	if err == nil {
+		t.Errorf("want error for conflicting precedence in the same group")
+	}
+	if _, err = chainPrecedence(map[string][]string{"asn": {"b", "a"}, "asn_org": {"b", "a"}}, memberIdx); err != nil {
+		t.Errorf("same precedence in a group: %v", err)
+	}
+}
+
+func TestChainInitIndependently(t *testing.T) {
+	a := &chainMember{name: "a", helper: &fakeGeoHelper{initErr: errors.New("download failed")}}
+	b := &chainMember{name: "b", helper: &fakeGeoHelper{info: &GeoInfo{CountryCode: "JP"}}}
+	chain := newTestChain(t, nil, a, b)
+	// 后台重试的等待时间足够长，测试期间不会再次初始化
+	cfg := &config.Config{DataSyncConfig: &config.DataSyncConfig{Retry: config.RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour}}}
+	a.cfgPtr = &atomic.Pointer[config.Config]{}
+	a.cfgPtr.Store(cfg)
+	defer chain.Clean()
+
+	if err := chain.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if a.ready.Load() || !b.ready.Load() {
+		t.Fatalf("ready = %v/%v, want false/true", a.ready.Load(), b.ready.Load())
+	}
+	got, err := chain.QueryGeo("1.2.3.4")
+	if err != nil || got.CountryCode != "JP" || got.Sources["country_code"] != "b" {
+		t.Errorf("query = %+v, %v, want JP from b", got, err)
+	}
+
+	c := &chainMember{name: "c", helper: &fakeGeoHelper{initErr: errors.New("download failed")}}
+	if err := newTestChain(t, nil, c).Init(); err == nil {
+		t.Errorf("want error when no member ready")
+	}
+}
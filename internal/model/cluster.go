@@ -0,0 +1,580 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ip_geo/internal/config"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	red "github.com/go-redis/redis/v8"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/proc"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+	"github.com/zeromicro/go-zero/core/stringx"
+)
+
+// 多实例协调刷新：同一离线库只由持有Redis锁的实例下载和检查，通过后发布通知，
+// 其他实例收到后从该实例获取快照并加载，领导实例切换时再发布一次，其他实例随之切换；
+// Redis不可用、锁过期或易主仍未收到通知、领导实例刷新失败时，各实例独立刷新
+
+const (
+	clusterLockKey     = "lock:"
+	clusterAnnounceKey = "announce:"
+	// 发布通知的频道，各离线库共用
+	clusterChannel = "announce"
+	// 未获得锁的实例检查通知和锁的间隔
+	clusterWaitInterval = time.Second
+	// 订阅失败后重试的最大间隔
+	clusterMaxResubscribeInterval = time.Minute
+)
+
+// 仍由本轮的持有者持有时才续期
+const clusterRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+// 写入通知键供晚到的实例补读，同时发布到频道
+const clusterAnnounceScript = `redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+return redis.call("PUBLISH", ARGV[3], ARGV[1])`
+
+// 领导实例刷新后写入的通知
+type clusterAnnouncement struct {
+	Id       string    // 快照标识
+	Round    string    // 本轮刷新锁的值，其他实例据此判断是否为本轮的通知
+	Instance string    // 写入通知的实例
+	Leader   string    // 领导实例供同伴访问的地址，为空时从Peers获取
+	Version  string    // 新版本，文件未变化时为空
+	Hash     string    // 领导实例当前的快照哈希，没有可提供的快照时为空
+	Error    string    // 领导实例刷新失败的原因，其他实例收到后独立刷新
+	SwitchAt time.Time // 各实例切换的时间
+	Switched bool      // 领导实例已切换
+}
+
+// go-redis的阻塞连接支持订阅
+type clusterSubscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *red.PubSub
+}
+
+// 使用服务的Redis客户端写入和发布通知，订阅使用由其创建的阻塞连接；
+// go-zero的阻塞连接不支持TLS，订阅失败时未获得锁的实例在自己的定时任务中轮询通知键
+type ClusterSync struct {
+	cfg        *config.ClusterSyncConfig
+	store      *redis.Redis
+	instance   string
+	subscribed atomic.Bool // 订阅正常时跟随领导实例的切换消息，否则按约定时间切换
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	datasets map[string]*clusterDataset
+}
+
+// 参与协调刷新的一个离线库，加载流程见dbDataset
+type clusterDataset struct {
+	sync     *ClusterSync
+	id       string
+	db       *dbDataset
+	notified chan struct{} // 收到通知时唤醒等待通知的定时任务
+
+	mu    sync.Mutex
+	round *clusterRound // 最近跟随的一轮
+}
+
+// 同一轮的通知只跟随一次，订阅和定时任务先到者跟随，后到者等待其完成
+type clusterRound struct {
+	round    string
+	switched chan struct{} // 领导实例已切换时关闭
+	done     chan struct{} // 跟随完成时关闭
+}
+
+// 未配置ClusterSync时返回nil，各实例独立刷新
+func NewClusterSync(cfg *config.Config, store *redis.Redis) (*ClusterSync, error) {
+	if cfg.ClusterSync == nil {
+		return nil, nil
+	}
+	if cfg.ClusterSync.LockTtl < time.Second {
+		return nil, fmt.Errorf("cluster sync lock ttl less than 1 second: %s", cfg.ClusterSync.LockTtl)
+	}
+
+	hostname, _ := os.Hostname()
+	c := &ClusterSync{
+		cfg:      cfg.ClusterSync,
+		store:    store,
+		instance: hostname + "-" + stringx.Randn(8),
+		done:     make(chan struct{}),
+		datasets: make(map[string]*clusterDataset),
+	}
+	go c.subscribe()
+	proc.AddShutdownListener(c.Close)
+	logx.Infof("cluster sync enabled, instance: %s", c.instance)
+	return c, nil
+}
+
+// 停止订阅
+func (c *ClusterSync) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// 协调刷新依赖快照缓存向其他实例提供快照
+// 锁的有效期须小于刷新间隔，否则上一轮的锁和通知会被当作本轮的；
+// 设置了等待上限时须不小于单个下载地址的重试预算，否则领导实例正常下载时其他实例也会各自下载
+func (c *ClusterSync) register(db *dbDataset) (*clusterDataset, error) {
+	cache := db.cache()
+	if !cache.enabled() {
+		return nil, fmt.Errorf("cluster sync requires cache dir, id: %s", cache.id)
+	}
+	dsCfg := db.cfgPtr.Load().DataSyncConfig
+	interval, err := syncInterval(dsCfg)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.LockTtl >= interval {
+		return nil, fmt.Errorf("cluster sync lock ttl %s must be less than refresh interval %s, id: %s",
+			c.cfg.LockTtl, interval, cache.id)
+	}
+	if budget := downloadRetryBudget(dsCfg.Retry); c.cfg.WaitTimeout > 0 && c.cfg.WaitTimeout < budget {
+		return nil, fmt.Errorf("cluster sync wait timeout %s less than download retry budget %s, id: %s",
+			c.cfg.WaitTimeout, budget, cache.id)
+	}
+	ds := &clusterDataset{sync: c, id: cache.id, db: db, notified: make(chan struct{}, 1)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.datasets[ds.id]; ok {
+		return nil, fmt.Errorf("duplicate cluster sync dataset: %s", ds.id)
+	}
+	c.datasets[ds.id] = ds
+	return ds, nil
+}
+
+func (c *ClusterSync) key(name string) string {
+	return c.cfg.KeyPrefix + name
+}
+
+// 订阅通知频道，失败后重新订阅，直到Close
+func (c *ClusterSync) subscribe() {
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(min(time.Duration(retry)*clusterWaitInterval, clusterMaxResubscribeInterval)):
+			}
+		}
+		err := c.receive()
+		c.subscribed.Store(false)
+		if err == nil {
+			return
+		}
+		logx.Errorf("subscribe cluster announcements failed, poll announcement key instead, err: %v", err)
+	}
+}
+
+// 订阅成功后分发收到的通知，Close时返回nil
+func (c *ClusterSync) receive() error {
+	node, err := redis.CreateBlockingNode(c.store)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	subscriber, ok := node.(clusterSubscriber)
+	if !ok {
+		return fmt.Errorf("redis node %T does not support subscribe", node)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pubsub := subscriber.Subscribe(ctx, c.key(clusterChannel))
+	defer pubsub.Close()
+	// 确认订阅成功，之后连接断开时go-redis自动重新订阅，期间错过的通知由通知键补读
+	if _, err = pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	c.subscribed.Store(true)
+	logx.Infof("cluster announcements subscribed, channel: %s", c.key(clusterChannel))
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return errors.New("cluster announcement subscription closed")
+			}
+			c.dispatch(msg.Payload)
+		}
+	}
+}
+
+// 交给对应的离线库跟随，忽略本实例发布的通知
+func (c *ClusterSync) dispatch(payload string) {
+	var ann clusterAnnouncement
+	if err := json.Unmarshal([]byte(payload), &ann); err != nil {
+		logx.Errorf("invalid cluster announcement: %v", err)
+		return
+	}
+	if ann.Instance == c.instance {
+		return
+	}
+	c.mu.Lock()
+	ds := c.datasets[ann.Id]
+	c.mu.Unlock()
+	if ds != nil {
+		ds.notify(ann)
+	}
+}
+
+// 收到通知后立即跟随，不等本实例的定时任务；领导实例的切换消息通知正在跟随的一轮切换
+func (ds *clusterDataset) notify(ann clusterAnnouncement) {
+	select {
+	case ds.notified <- struct{}{}:
+	default:
+	}
+	r, first := ds.claim(ann)
+	if !first {
+		if ann.Switched {
+			r.markSwitched()
+		}
+		return
+	}
+	go func() {
+		defer close(r.done)
+		if err := ds.follow(ann, r); err != nil {
+			logx.Errorf("error refreshing %s: %v", ds.db.name, err)
+		}
+	}()
+}
+
+// 认领一轮通知，first为false时该轮已由其他调用跟随
+func (ds *clusterDataset) claim(ann clusterAnnouncement) (r *clusterRound, first bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.round != nil && ds.round.round == ann.Round {
+		return ds.round, false
+	}
+	r = &clusterRound{round: ann.Round, switched: make(chan struct{}), done: make(chan struct{})}
+	if ann.Switched {
+		close(r.switched)
+	}
+	ds.round = r
+	return r, true
+}
+
+func (r *clusterRound) markSwitched() {
+	select {
+	case <-r.switched:
+	default:
+		close(r.switched)
+	}
+}
+
+// 通知保留到本轮的锁过期之后，晚到或订阅中断的实例也能读到
+func (ds *clusterDataset) announce(ann clusterAnnouncement) {
+	c := ds.sync
+	ann.Instance = c.instance
+	b, _ := json.Marshal(ann)
+	ttl := 2*c.cfg.LockTtl + c.cfg.SwitchDelay
+	_, err := c.store.Eval(clusterAnnounceScript, []string{c.key(clusterAnnounceKey + ds.id)},
+		string(b), int(ttl/time.Second), c.key(clusterChannel))
+	if err != nil {
+		logx.Errorf("publish cluster announcement failed, id: %s, err: %v", ds.id, err)
+		return
+	}
+	logx.Infof("cluster announcement published, id: %s, version: %s, hash: %s, switch at: %s, switched: %t, error: %s",
+		ann.Id, ann.Version, ann.Hash, ann.SwitchAt.Format(time.RFC3339), ann.Switched, ann.Error)
+}
+
+// 读取最近一次的通知，没有时返回空值
+func (ds *clusterDataset) readAnnouncement() (ann clusterAnnouncement, err error) {
+	v, err := ds.sync.store.Get(ds.sync.key(clusterAnnounceKey + ds.id))
+	if err != nil || v == "" {
+		return ann, err
+	}
+	if err = json.Unmarshal([]byte(v), &ann); err != nil {
+		return ann, fmt.Errorf("invalid cluster announcement: %v", err)
+	}
+	return ann, nil
+}
+
+// 定时刷新：获得锁的实例下载并通知，其他实例等待本轮的通知后跟随，已由订阅跟随时等待其完成；
+// Redis出错，或锁过期、易主时仍未收到通知，则独立刷新
+// 锁完成后不释放，有效期内同一轮中晚到的实例不再重复下载
+func (ds *clusterDataset) refreshInCluster() error {
+	c := ds.sync
+	lockKey := c.key(clusterLockKey + ds.id)
+	round := c.instance + "-" + stringx.Randn(8)
+	ok, err := c.store.SetnxEx(lockKey, round, int(c.cfg.LockTtl/time.Second))
+	if err != nil {
+		logx.Errorf("acquire refresh lock failed, refresh independently, id: %s, err: %v", ds.id, err)
+		return ds.db.doRefresh()
+	}
+	if ok {
+		stop := ds.renewLock(lockKey, round)
+		defer stop()
+		logx.Infof("refresh lock acquired, id: %s, round: %s", ds.id, round)
+		return ds.lead(round)
+	}
+
+	holder, err := c.store.Get(lockKey)
+	if err == nil && holder == "" {
+		err = errors.New("refresh lock expired")
+	}
+	if err == nil {
+		logx.Infof("refresh lock held by %s, waiting for announcement, id: %s", holder, ds.id)
+		var ann clusterAnnouncement
+		if ann, err = ds.waitAnnouncement(lockKey, holder); err == nil {
+			r, first := ds.claim(ann)
+			if !first {
+				<-r.done
+				return nil
+			}
+			defer close(r.done)
+			return ds.follow(ann, r)
+		}
+	}
+	logx.Errorf("no announcement to follow, refresh independently, id: %s, err: %v", ds.id, err)
+	return ds.db.doRefresh()
+}
+
+// 持有锁期间定期续期
+func (ds *clusterDataset) renewLock(lockKey string, round string) (stop func()) {
+	c := ds.sync
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(max(c.cfg.LockTtl/3, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ok, err := c.store.Eval(clusterRenewScript, []string{lockKey}, round, c.cfg.LockTtl.Milliseconds())
+				if err != nil || ok != int64(1) {
+					logx.Errorf("renew refresh lock failed, id: %s, result: %v, err: %v", ds.id, ok, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// 等待holder这一轮的通知，领导实例持有锁期间一直等待，配置了WaitTimeout时最多等待该时长
+// 先读锁再读通知，锁过期前写入的通知不会错过
+func (ds *clusterDataset) waitAnnouncement(lockKey string, holder string) (clusterAnnouncement, error) {
+	c := ds.sync
+	var deadline time.Time
+	if c.cfg.WaitTimeout > 0 {
+		deadline = time.Now().Add(c.cfg.WaitTimeout)
+	}
+	for {
+		current, err := c.store.Get(lockKey)
+		if err != nil {
+			return clusterAnnouncement{}, err
+		}
+		ann, err := ds.readAnnouncement()
+		if err != nil {
+			return ann, err
+		}
+		if ann.Round == holder {
+			return ann, nil
+		}
+		if current != holder {
+			return ann, fmt.Errorf("refresh lock of %s expired or taken over without announcement", holder)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return ann, fmt.Errorf("no announcement within %s", c.cfg.WaitTimeout)
+		}
+		select {
+		case <-ds.notified:
+		case <-time.After(clusterWaitInterval):
+		}
+	}
+}
+
+// 领导实例：下载并检查，保存快照供其他实例获取，通知后在约定时间切换并再次通知，切换后才作为当前快照提供给同伴
+func (ds *clusterDataset) lead(round string) (err error) {
+	ds.db.refreshMu.Lock()
+	defer ds.db.refreshMu.Unlock()
+
+	c := ds.sync
+	cfg, cache := ds.db.cfgPtr.Load(), ds.db.cache()
+	ann := clusterAnnouncement{Id: ds.id, Round: round, Leader: c.cfg.AdvertiseUrl}
+	published := false
+	// 未通知新版本时，在返回前通知结果
+	defer func() {
+		if published {
+			return
+		}
+		// 新版本未通过质量检查时其他实例保持当前版本，不必各自下载再检查
+		var gateErr *QualityGateError
+		if errors.As(err, &gateErr) {
+			ann.Hash, ann.SwitchAt = ds.currentHash(cache), time.Now()
+		} else if err != nil {
+			ann.Error = err.Error()
+		}
+		ds.announce(ann)
+	}()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("%v", panicErr)
+		}
+	}()
+
+	files, err := fetchDbFiles(ds.db.ctx, cfg.DataSyncConfig, cache.reqs, ds.db.fileMetas)
+	if errors.Is(err, errDbNotModified) {
+		// 通知当前版本，错过上次通知的实例据此追上
+		logx.Infof("db not modified, announce current snapshot, id: %s", ds.id)
+		ann.Hash, ann.SwitchAt = ds.currentHash(cache), time.Now()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer removeDbFiles(files)
+
+	version, commit, err := ds.db.stage(files)
+	if err != nil {
+		return err
+	}
+	// 切换前只作为待切换的快照提供给其他实例，切换后才作为当前快照提供
+	name, snap, err := cache.stage(files, version)
+	if err != nil {
+		// 其他实例无法获取快照，通知失败后各自刷新，本实例照常切换
+		commit()
+		unpublishSnapshot(ds.id)
+		return fmt.Errorf("save snapshot cache failed: %v", err)
+	}
+	defer unpendSnapshot(ds.id)
+	ann.Version, ann.Hash = version, dbFilesHash(files)
+	ann.SwitchAt = time.Now().Add(c.cfg.SwitchDelay)
+	ds.announce(ann)
+	published = true
+
+	time.Sleep(time.Until(ann.SwitchAt))
+	commit()
+	cache.publish(name, snap)
+	ann.Switched = true
+	ds.announce(ann)
+	return nil
+}
+
+// 跟随通知：从领导实例或同伴获取相同的快照，加载后随领导实例切换
+// 领导实例下载失败或获取快照失败时独立刷新
+func (ds *clusterDataset) follow(ann clusterAnnouncement, r *clusterRound) error {
+	err := ds.doFollow(ann, r)
+	if err == nil {
+		return nil
+	}
+	logx.Errorf("follow cluster announcement failed, refresh independently, id: %s, err: %v", ds.id, err)
+	return ds.db.doRefresh()
+}
+
+func (ds *clusterDataset) doFollow(ann clusterAnnouncement, r *clusterRound) (err error) {
+	if ann.Error != "" {
+		return fmt.Errorf("leader refresh failed: %s", ann.Error)
+	}
+	if ann.Hash == "" {
+		return nil
+	}
+	ds.db.refreshMu.Lock()
+	defer ds.db.refreshMu.Unlock()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("%v", panicErr)
+		}
+	}()
+
+	cfg, cache := ds.db.cfgPtr.Load(), ds.db.cache()
+	if ann.Hash == ds.currentHash(cache) {
+		logx.Infof("already on announced snapshot, id: %s, hash: %s", ds.id, ann.Hash)
+		return nil
+	}
+
+	peers := cfg.DataSyncConfig.Peers
+	if ann.Leader != "" {
+		peers = append([]string{ann.Leader}, peers...)
+	}
+	var files []dbFile
+	for _, peer := range peers {
+		if files, err = fetchPeerSnapshot(cfg, peer, cache, ann.Hash); err == nil {
+			break
+		}
+		logx.Errorf("fetch announced snapshot failed, peer: %s, id: %s, err: %v", peer, ds.id, err)
+	}
+	if files == nil {
+		return fmt.Errorf("announced snapshot %s not available from any peer", ann.Hash)
+	}
+	defer removeDbFiles(files)
+
+	version, commit, err := ds.db.stage(files)
+	if err != nil {
+		return err
+	}
+	// 保存后同样可提供给跟随同一通知的其他实例
+	name, snap, saveErr := cache.stage(files, version)
+	if saveErr == nil {
+		defer unpendSnapshot(ds.id)
+	}
+	ds.waitSwitch(ann, r)
+	commit()
+	if saveErr != nil {
+		// 已切换的离线库与提供的快照不一致，不再提供给同伴
+		unpublishSnapshot(ds.id)
+		logx.Errorf("save snapshot cache failed, id: %s, err: %v", ds.id, saveErr)
+		return nil
+	}
+	cache.publish(name, snap)
+	return nil
+}
+
+// 订阅正常时等待领导实例的切换消息，不受各实例时钟偏差和定时任务延迟的影响，
+// 最多等到约定时间后再过SwitchDelay；订阅中断时按约定时间切换
+func (ds *clusterDataset) waitSwitch(ann clusterAnnouncement, r *clusterRound) {
+	c := ds.sync
+	if !c.subscribed.Load() {
+		if wait := time.Until(ann.SwitchAt); wait > 0 {
+			time.Sleep(wait)
+		} else {
+			logx.Errorf("announced snapshot loaded %s after switch time, id: %s", -wait, ds.id)
+		}
+		return
+	}
+	timer := time.NewTimer(time.Until(ann.SwitchAt) + c.cfg.SwitchDelay)
+	defer timer.Stop()
+	select {
+	case <-r.switched:
+	case <-timer.C:
+		logx.Errorf("no switch message from leader, switch anyway, id: %s, round: %s", ds.id, ann.Round)
+	}
+}
+
+// 当前库的快照哈希，与提供给同伴的快照哈希一致
+func (ds *clusterDataset) currentHash(cache *snapshotCache) string {
+	metas := ds.db.fileMetas
+	fileHashes := make([]string, 0, len(cache.reqs))
+	for _, req := range cache.reqs {
+		meta, ok := metas[req.Url]
+		if !ok {
+			return ""
+		}
+		fileHashes = append(fileHashes, meta.FileHash)
+	}
+	return snapshotHash(fileHashes)
+}
+
+func dbFilesHash(files []dbFile) string {
+	fileHashes := make([]string, 0, len(files))
+	for _, f := range files {
+		fileHashes = append(fileHashes, f.Meta.FileHash)
+	}
+	return snapshotHash(fileHashes)
+}
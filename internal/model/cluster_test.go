@@ -0,0 +1,411 @@
+package model
+
+import (
+	"context"
+	"io"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/zeromicro/go-zero/core/stores/redis"
+	xhttp "github.com/zeromicro/x/http"
+)
+
+// 模拟同伴接口，提供本进程中已保存的快照
+func newTestPeerServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(peerSnapshotsPath, func(w http.ResponseWriter, r *http.Request) {
+		xhttp.JsonBaseResponse(w, map[string]any{"snapshots": ServedSnapshots(r.URL.Query().Get("hash"))})
+	})
+	mux.HandleFunc(peerSnapshotFilePath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		f, _, err := OpenServedSnapshotFile(query.Get("id"), query.Get("name"), query.Get("hash"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		io.Copy(w, f)
+	})
+	return httptest.NewServer(mux)
+}
+
+// 模拟离线库的下载地址，记录下载次数，前failures次下载失败
+type testVendor struct {
+	hits     atomic.Int32
+	failures int32
+	version  string
+}
+
+func (v *testVendor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v.hits.Add(1) <= v.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, v.version)
+}
+
+// 文件内容即为版本号的离线库，订阅收到通知时在后台切换
+type testClusterDb struct {
+	mu       sync.Mutex
+	version  string
+	switched time.Time
+}
+
+func (db *testClusterDb) get() (string, time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.version, db.switched
+}
+
+func newTestClusterDataset(t *testing.T, c *ClusterSync, vendorUrl string) (*testClusterDb, *clusterDataset) {
+	t.Helper()
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{AccessKey: "key", AccessSecret: "secret", DataSyncConfig: &config.DataSyncConfig{
+		DownloadUrl:    vendorUrl,
+		ForTest:        true,
+		RereshInterval: "1h",
+		Storage:        DbStorageMemory,
+		Retry:          config.RetryPolicy{MaxAttempts: 1, AttemptTimeout: 5 * time.Second},
+		Archive:        config.ArchiveConfig{MaxSize: 1 << 20},
+		CacheDir:       t.TempDir(),
+		CacheKeep:      2,
+		PeerTimeout:    5 * time.Second,
+		InsecurePeers:  true,
+	}})
+	db := &testClusterDb{}
+	dataset := &dbDataset{
+		ctx:      context.Background(),
+		name:     "test db",
+		provider: "test",
+		cfgPtr:   cfgPtr,
+		reqs: func(cfg *config.Config) []dbFileRequest {
+			return []dbFileRequest{{Url: cfg.DataSyncConfig.DownloadUrl}}
+		},
+		stageFiles: func(files []dbFile) (string, func(), error) {
+			b, err := files[0].readAll()
+			if err != nil {
+				return "", nil, err
+			}
+			version := string(b)
+			return version, func() {
+				db.mu.Lock()
+				defer db.mu.Unlock()
+				db.version, db.switched = version, time.Now()
+			}, nil
+		},
+	}
+	ds, err := c.register(dataset)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	return db, ds
+}
+
+func newTestClusterSync(t *testing.T, mr *miniredis.Miniredis, advertiseUrl string) *ClusterSync {
+	t.Helper()
+	c, err := NewClusterSync(&config.Config{ClusterSync: &config.ClusterSyncConfig{
+		KeyPrefix:    "test:",
+		AdvertiseUrl: advertiseUrl,
+		LockTtl:      2 * time.Second,
+		SwitchDelay:  time.Second,
+	}}, redis.New(mr.Addr()))
+	if err != nil {
+		t.Fatalf("new cluster sync: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func waitSubscribed(t *testing.T, cs ...*ClusterSync) {
+	t.Helper()
+	for _, c := range cs {
+		for i := 0; !c.subscribed.Load(); i++ {
+			if i > 100 {
+				t.Fatal("cluster announcements not subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// 等待领导实例获得锁后再让其他实例刷新
+func waitClusterLock(t *testing.T, mr *miniredis.Miniredis, ds *clusterDataset) {
+	t.Helper()
+	lockKey := ds.sync.key(clusterLockKey + ds.id)
+	for i := 0; !mr.Exists(lockKey); i++ {
+		if i > 100 {
+			t.Fatal("refresh lock not acquired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 等待领导实例写入带快照的通知
+func waitTestAnnouncement(t *testing.T, ds *clusterDataset) clusterAnnouncement {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		ann, err := ds.readAnnouncement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ann.Hash != "" {
+			return ann
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no announcement")
+	return clusterAnnouncement{}
+}
+
+// 当前提供给同伴的快照哈希，没有时为空
+func servedSnapshotHash(id string) string {
+	for _, s := range ServedSnapshots("") {
+		if s.Id == id {
+			return s.Hash
+		}
+	}
+	return ""
+}
+
+func TestClusterSyncLeaderAndFollower(t *testing.T) {
+	mr := miniredis.RunT(t)
+	peer := newTestPeerServer()
+	defer peer.Close()
+	vendor := &testVendor{version: "v1"}
+	vendorServer := httptest.NewServer(vendor)
+	defer vendorServer.Close()
+
+	leaderDb, leader := newTestClusterDataset(t, newTestClusterSync(t, mr, peer.URL), vendorServer.URL+"/db.bin")
+	followerDb, follower := newTestClusterDataset(t, newTestClusterSync(t, mr, ""), vendorServer.URL+"/db.bin")
+
+	leaderErr := make(chan error, 1)
+	go func() { leaderErr <- leader.refreshInCluster() }()
+	waitClusterLock(t, mr, leader)
+
+	// 切换前新快照只按哈希提供，不作为当前快照
+	ann := waitTestAnnouncement(t, follower)
+	if got := servedSnapshotHash(leader.id); got != "" {
+		t.Errorf("served hash before switch = %s, want none", got)
+	}
+	pending := 0
+	for _, s := range ServedSnapshots(ann.Hash) {
+		if s.Id == leader.id {
+			pending++
+		}
+	}
+	if pending != 1 {
+		t.Errorf("pending snapshots of %s = %d, want 1", leader.id, pending)
+	}
+
+	if err := follower.refreshInCluster(); err != nil {
+		t.Fatalf("follower refresh: %v", err)
+	}
+	if err := <-leaderErr; err != nil {
+		t.Fatalf("leader refresh: %v", err)
+	}
+	if got := servedSnapshotHash(leader.id); got != ann.Hash {
+		t.Errorf("served hash after switch = %s, want %s", got, ann.Hash)
+	}
+
+	// 只有领导实例下载
+	if got := vendor.hits.Load(); got != 1 {
+		t.Errorf("vendor hits = %d, want 1", got)
+	}
+	leaderVersion, leaderSwitched := leaderDb.get()
+	followerVersion, followerSwitched := followerDb.get()
+	if leaderVersion != "v1" || followerVersion != "v1" {
+		t.Errorf("versions = %q/%q, want v1", leaderVersion, followerVersion)
+	}
+	if followerSwitched.Before(ann.SwitchAt) || leaderSwitched.Before(ann.SwitchAt) {
+		t.Errorf("switched at %s/%s, before announced %s", leaderSwitched, followerSwitched, ann.SwitchAt)
+	}
+	if follower.currentHash(follower.db.cache()) != leader.currentHash(leader.db.cache()) {
+		t.Errorf("follower loaded a different snapshot")
+	}
+}
+
+func TestClusterSyncFollowBySubscription(t *testing.T) {
+	mr := miniredis.RunT(t)
+	peer := newTestPeerServer()
+	defer peer.Close()
+	vendor := &testVendor{version: "v1"}
+	vendorServer := httptest.NewServer(vendor)
+	defer vendorServer.Close()
+
+	leaderSync, followerSync := newTestClusterSync(t, mr, peer.URL), newTestClusterSync(t, mr, "")
+	leaderDb, leader := newTestClusterDataset(t, leaderSync, vendorServer.URL+"/db.bin")
+	followerDb, _ := newTestClusterDataset(t, followerSync, vendorServer.URL+"/db.bin")
+	waitSubscribed(t, leaderSync, followerSync)
+
+	// 跟随实例的定时任务未运行，收到通知后自行获取快照，收到切换消息后切换
+	if err := leader.refreshInCluster(); err != nil {
+		t.Fatalf("leader refresh: %v", err)
+	}
+	_, leaderSwitched := leaderDb.get()
+	for i := 0; ; i++ {
+		if version, _ := followerDb.get(); version == "v1" {
+			break
+		}
+		if i > 300 {
+			t.Fatal("follower did not switch on announcement")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, followerSwitched := followerDb.get(); followerSwitched.Before(leaderSwitched) {
+		t.Errorf("follower switched at %s, before leader %s", followerSwitched, leaderSwitched)
+	}
+	if got := vendor.hits.Load(); got != 1 {
+		t.Errorf("vendor hits = %d, want 1", got)
+	}
+	// 通知键保留切换后的通知，供订阅中断的实例补读
+	if ann, err := leader.readAnnouncement(); err != nil || !ann.Switched {
+		t.Errorf("announcement = %+v, err = %v, want switched", ann, err)
+	}
+}
+
+func TestClusterSyncWaitSwitch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestClusterSync(t, mr, "")
+	_, ds := newTestClusterDataset(t, c, "http://example.com/db.bin")
+	waitSubscribed(t, c)
+
+	// 本实例时钟偏快，约定时间已过，仍等待领导实例的切换消息
+	ann := clusterAnnouncement{Id: ds.id, Round: "r1", SwitchAt: time.Now().Add(-c.cfg.SwitchDelay / 2)}
+	r, _ := ds.claim(ann)
+	done := make(chan struct{})
+	go func() {
+		ds.waitSwitch(ann, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("switched before leader")
+	case <-time.After(100 * time.Millisecond):
+	}
+	r.markSwitched()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not switched after switch message")
+	}
+
+	// 收不到切换消息时最多等到约定时间后再过SwitchDelay
+	ann.Round = "r2"
+	r, _ = ds.claim(ann)
+	start := time.Now()
+	ds.waitSwitch(ann, r)
+	if waited := time.Since(start); waited > c.cfg.SwitchDelay {
+		t.Errorf("waited %s without switch message, want at most %s", waited, c.cfg.SwitchDelay)
+	}
+}
+
+func TestClusterSyncLeaderFailed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	// 领导实例下载失败，之后的下载成功
+	vendor := &testVendor{version: "v1", failures: 1}
+	vendorServer := httptest.NewServer(vendor)
+	defer vendorServer.Close()
+
+	leaderDb, leader := newTestClusterDataset(t, newTestClusterSync(t, mr, ""), vendorServer.URL+"/db.bin")
+	followerDb, follower := newTestClusterDataset(t, newTestClusterSync(t, mr, ""), vendorServer.URL+"/db.bin")
+
+	leaderErr := make(chan error, 1)
+	go func() { leaderErr <- leader.refreshInCluster() }()
+	waitClusterLock(t, mr, leader)
+	if err := follower.refreshInCluster(); err != nil {
+		t.Fatalf("follower refresh: %v", err)
+	}
+	if err := <-leaderErr; err == nil {
+		t.Errorf("want leader refresh error")
+	}
+	// 领导实例失败后其他实例独立下载
+	if got := vendor.hits.Load(); got != 2 {
+		t.Errorf("vendor hits = %d, want 2", got)
+	}
+	leaderVersion, _ := leaderDb.get()
+	followerVersion, _ := followerDb.get()
+	if leaderVersion != "" || followerVersion != "v1" {
+		t.Errorf("versions = %q/%q, want empty/v1", leaderVersion, followerVersion)
+	}
+}
+
+func TestClusterSyncWaitWhileLockHeld(t *testing.T) {
+	mr := miniredis.RunT(t)
+	vendor := &testVendor{version: "v1"}
+	vendorServer := httptest.NewServer(vendor)
+	defer vendorServer.Close()
+	db, ds := newTestClusterDataset(t, newTestClusterSync(t, mr, ""), vendorServer.URL+"/db.bin")
+	// 其他实例持有锁但还没有通知，例如仍在下载
+	lockKey := ds.sync.key(clusterLockKey + ds.id)
+	mr.Set(lockKey, "other-round")
+	mr.SetTTL(lockKey, time.Minute)
+
+	done := make(chan error, 1)
+	go func() { done <- ds.refreshInCluster() }()
+	select {
+	case err := <-done:
+		t.Fatalf("refresh returned while lock held: %v", err)
+	case <-time.After(3 * clusterWaitInterval):
+	}
+	if got := vendor.hits.Load(); got != 0 {
+		t.Fatalf("vendor hits = %d while lock held, want 0", got)
+	}
+
+	// 锁过期后不再等待，独立刷新
+	mr.Del(lockKey)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+	case <-time.After(5 * clusterWaitInterval):
+		t.Fatal("refresh still waiting after lock expired")
+	}
+	if version, _ := db.get(); vendor.hits.Load() != 1 || version != "v1" {
+		t.Errorf("vendor hits = %d, version = %q, want 1/v1", vendor.hits.Load(), version)
+	}
+}
+
+func TestClusterSyncRegisterValidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tests := []struct {
+		name        string
+		lockTtl     time.Duration
+		waitTimeout time.Duration
+		wantErr     bool
+	}{
+		{"defaults", 2 * time.Second, 0, false},
+		{"lock ttl not less than interval", time.Hour, 0, true},
+		{"wait timeout less than retry budget", 2 * time.Second, time.Second, true},
+		{"wait timeout covers retry budget", 2 * time.Second, 10 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClusterSync(t, mr, "")
+			c.cfg.LockTtl, c.cfg.WaitTimeout = tt.lockTtl, tt.waitTimeout
+			cfgPtr := &atomic.Pointer[config.Config]{}
+			cfgPtr.Store(&config.Config{DataSyncConfig: &config.DataSyncConfig{
+				ForTest:        true,
+				RereshInterval: "1h",
+				Retry:          config.RetryPolicy{MaxAttempts: 2, AttemptTimeout: 3 * time.Second, MaxBackoff: time.Second},
+				CacheDir:       t.TempDir(),
+			}})
+			_, err := c.register(&dbDataset{
+				provider: "test",
+				cfgPtr:   cfgPtr,
+				reqs: func(*config.Config) []dbFileRequest {
+					return []dbFileRequest{{Url: "http://example.com/db.bin"}}
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
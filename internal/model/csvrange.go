@@ -0,0 +1,396 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"ip_geo/internal/utils"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+var (
+	_ IpGeoHelper = (*CsvRangeHelper)(nil)
+)
+
+// CSV列可映射的字段为geoFields中的字段，另有start_ip、end_ip表示区间
+const (
+	csvColumnStartIp = "start_ip"
+	csvColumnEndIp   = "end_ip"
+)
+
+// 基于CSV区间文件的查询助手，每行为起始IP、结束IP及若干属性列，如DB-IP Lite、IP2Location LITE
+// 下载地址复用DataSyncConfig.DownloadUrl，列映射见config.CsvConfig
+type CsvRangeHelper struct {
+	dataset  *dbDataset
+	curDbPtr atomic.Pointer[csvRangeDb]
+	cfgPtr   *atomic.Pointer[config.Config]
+	version  atomic.Pointer[dbVersion]
+}
+
+func NewCsvRangeHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (*CsvRangeHelper, error) {
+	cfg := cfgPtr.Load()
+	if cfg.CsvConfig == nil {
+		return nil, errors.New("csv config missing")
+	}
+	if _, ok := cfg.CsvConfig.Columns[csvColumnStartIp]; !ok {
+		return nil, fmt.Errorf("csv column %s not mapped", csvColumnStartIp)
+	}
+	if _, ok := cfg.CsvConfig.Columns[csvColumnEndIp]; !ok {
+		return nil, fmt.Errorf("csv column %s not mapped", csvColumnEndIp)
+	}
+	for field := range cfg.CsvConfig.Columns {
+		if _, ok := geoFields[field]; !ok && field != csvColumnStartIp && field != csvColumnEndIp {
+			return nil, fmt.Errorf("unknown csv field: %s", field)
+		}
+	}
+
+	helper := &CsvRangeHelper{cfgPtr: cfgPtr}
+	dataset, err := newDbDataset(cfgPtr, ProviderCsv, "csv db", helper.dbFileRequests, helper.stageDbFiles, cluster)
+	if err != nil {
+		return nil, err
+	}
+	helper.dataset = dataset
+
+	return helper, nil
+}
+
+func (helper *CsvRangeHelper) QueryGeo(ipAddr string) (resp *GeoInfo, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			resp, err = nil, fmt.Errorf("panic: %v", panicErr)
+		}
+	}()
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip")
+	}
+	db := helper.curDbPtr.Load()
+	if db == nil {
+		return nil, errors.New("csv db not loaded")
+	}
+
+	info, err := db.getRecord(ip)
+	if err != nil {
+		return nil, err
+	}
+	resp = new(GeoInfo)
+	*resp = *info
+	helper.version.Load().fill(resp)
+
+	return resp, nil
+}
+
+// 初始化db
+func (helper *CsvRangeHelper) Init() error {
+	return helper.dataset.init()
+}
+
+// 清理
+func (helper *CsvRangeHelper) Clean() error {
+	helper.dataset.clean()
+	return nil
+}
+
+func (helper *CsvRangeHelper) dbFileRequests(cfg *config.Config) []dbFileRequest {
+	return []dbFileRequest{
+		{Url: cfg.DataSyncConfig.DownloadUrl, Mirrors: cfg.DataSyncConfig.Mirrors, EntrySuffix: cfg.CsvConfig.EntrySuffix},
+	}
+}
+
+// 加载并检查csv文件，通过后返回版本及切换函数
+func (helper *CsvRangeHelper) stageDbFiles(files []dbFile) (version string, commit func(), err error) {
+	cfg := helper.cfgPtr.Load()
+	rc, err := files[0].open()
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+	db, err := loadCsvRangeFile(rc, cfg.CsvConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(db.v4.endArr)+len(db.v6.endArr) == 0 {
+		return "", nil, errors.New("no record in csv db")
+	}
+	logx.Infof("finish load csv db file, ipv4 ranges: %d, ipv6 ranges: %d", len(db.v4.endArr), len(db.v6.endArr))
+
+	// csv没有文件头，版本取自下载信息或内容哈希
+	version = datasetVersion(time.Time{}, files[0].Meta, files[0].Meta.FileHash)
+	var current *datasetProbe
+	if oldDb := helper.curDbPtr.Load(); oldDb != nil {
+		probe := oldDb.probe()
+		current = &probe
+	}
+	if err = checkDatasetQuality(&cfg.DataSyncConfig.Quality, ProviderCsv, version, db.probe(), current); err != nil {
+		return "", nil, err
+	}
+	commit = func() {
+		helper.version.Store(&dbVersion{version: version, loadTime: time.Now()})
+		helper.curDbPtr.Store(db)
+
+		logx.Infof("done refresh csv db, version: %v, source: %s", version, files[0].Meta.Source)
+	}
+	return version, commit, nil
+}
+
+func loadCsvRangeFile(src io.Reader, csvCfg *config.CsvConfig) (*csvRangeDb, error) {
+	r := csv.NewReader(src)
+	r.ReuseRecord = true
+	r.FieldsPerRecord = -1
+	if csvCfg.Delimiter != "" {
+		r.Comma = []rune(csvCfg.Delimiter)[0]
+	}
+
+	var header []string
+	if csvCfg.HasHeader {
+		row, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("read csv header failed: %v", err)
+		}
+		header = append(header, row...)
+	}
+
+	// 解析列映射，列可以是下标或表头名
+	columns := make(map[string]int, len(csvCfg.Columns))
+	for field, col := range csvCfg.Columns {
+		idx, err := csvColumnIndex(col, header)
+		if err != nil {
+			return nil, fmt.Errorf("map csv field %s failed: %v", field, err)
+		}
+		columns[field] = idx
+	}
+	startCol, endCol := columns[csvColumnStartIp], columns[csvColumnEndIp]
+	delete(columns, csvColumnStartIp)
+	delete(columns, csvColumnEndIp)
+
+	db := &csvRangeDb{}
+	for line := 1; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if startCol >= len(row) || endCol >= len(row) {
+			return nil, fmt.Errorf("line %d: missing start or end ip column", line)
+		}
+		start, end, err := parseCsvRange(row[startCol], row[endCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		info := &GeoInfo{}
+		for field, idx := range columns {
+			if idx < len(row) {
+				geoFields[field].set(info, strings.TrimSpace(row[idx]))
+			}
+		}
+		// 大洲可能为中文名或ISO代码，统一为本服务的代码
+		info.Continent = utils.GetContinentCodeByIsoCode(utils.GetContinentCodeByName(info.Continent))
+		if start.isV4 {
+			db.v4.add(uint32(start.lo), uint32(end.lo), info)
+		} else {
+			db.v6.add(start.uint128, end.uint128, info)
+		}
+	}
+	db.v4.build()
+	db.v6.build()
+
+	return db, nil
+}
+
+func csvColumnIndex(col string, header []string) (int, error) {
+	if idx, err := strconv.Atoi(col); err == nil {
+		if idx < 0 {
+			return 0, fmt.Errorf("negative column index: %d", idx)
+		}
+		return idx, nil
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), col) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("column %s not found in header", col)
+}
+
+// CSV中的IP，IPv4以低32位表示
+type csvIp struct {
+	uint128
+	isV4 bool
+}
+
+// 解析一行的起止IP，支持点分/冒号格式及十进制整数格式
+// 地址族按整行判断：整数不超过32位且另一端也是IPv4时视为IPv4，否则按IPv6的数值处理，
+// 如IP2Location IPv6库的首行"0","281470681743359"；IPv4映射的IPv6区间视为IPv4
+func parseCsvRange(startStr, endStr string) (start, end csvIp, err error) {
+	startVal, startSmall, err := parseCsvIpValue(startStr)
+	if err != nil {
+		return start, end, err
+	}
+	endVal, endSmall, err := parseCsvIpValue(endStr)
+	if err != nil {
+		return start, end, err
+	}
+	if startSmall && (endSmall || isV4MappedUint128(endVal)) {
+		startVal = v4MappedUint128(startVal.lo)
+	}
+	if endSmall && (startSmall || isV4MappedUint128(startVal)) {
+		endVal = v4MappedUint128(endVal.lo)
+	}
+	start, end = newCsvIp(startVal), newCsvIp(endVal)
+	if start.isV4 != end.isV4 || start.cmp(end.uint128) > 0 {
+		return start, end, fmt.Errorf("invalid range %s - %s", startStr, endStr)
+	}
+	return start, end, nil
+}
+
+// 返回IPv6形式的数值，IPv4地址为映射地址；small表示不超过32位的整数，地址族由另一端决定
+func parseCsvIpValue(s string) (v uint128, small bool, err error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return newUint128(ip.To16()), false, nil
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return v, false, fmt.Errorf("invalid ip: %s", s)
+	}
+	return newUint128(n.FillBytes(make([]byte, 16))), n.BitLen() <= 32, nil
+}
+
+func newCsvIp(v uint128) csvIp {
+	if isV4MappedUint128(v) {
+		return csvIp{uint128: uint128{lo: v.lo & 0xffffffff}, isV4: true}
+	}
+	return csvIp{uint128: v}
+}
+
+// ::ffff:0:0/96
+func isV4MappedUint128(v uint128) bool {
+	return v.hi == 0 && v.lo>>32 == 0xffff
+}
+
+func v4MappedUint128(v4 uint64) uint128 {
+	return uint128{lo: 0xffff<<32 | v4&0xffffffff}
+}
+
+type csvRangeDb struct {
+	v4 csvRangeTableV4
+	v6 csvRangeTableV6
+}
+
+// 参与质量检查的记录数为IPv4和IPv6区间数之和
+func (p *csvRangeDb) probe() datasetProbe {
+	return datasetProbe{query: p.getRecord, records: int64(len(p.v4.endArr) + len(p.v6.endArr))}
+}
+
+func (p *csvRangeDb) getRecord(ip net.IP) (*GeoInfo, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return p.v4.getRecord(binary.BigEndian.Uint32(ip4))
+	}
+	return p.v6.getRecord(newUint128(ip.To16()))
+}
+
+// 与ipDataCloudDb相同，按首字节建立前缀索引，再在结束IP数组中二分查找
+type csvRangeTableV4 struct {
+	prefStart [256]uint32
+	prefEnd   [256]uint32
+	startArr  []uint32
+	endArr    []uint32
+	infoArr   []*GeoInfo
+}
+
+func (t *csvRangeTableV4) add(start, end uint32, info *GeoInfo) {
+	t.startArr = append(t.startArr, start)
+	t.endArr = append(t.endArr, end)
+	t.infoArr = append(t.infoArr, info)
+}
+
+func (t *csvRangeTableV4) Len() int           { return len(t.endArr) }
+func (t *csvRangeTableV4) Less(i, j int) bool { return t.endArr[i] < t.endArr[j] }
+func (t *csvRangeTableV4) Swap(i, j int) {
+	t.startArr[i], t.startArr[j] = t.startArr[j], t.startArr[i]
+	t.endArr[i], t.endArr[j] = t.endArr[j], t.endArr[i]
+	t.infoArr[i], t.infoArr[j] = t.infoArr[j], t.infoArr[i]
+}
+
+// 按结束IP排序并建立前缀索引，prefStart > prefEnd表示该前缀下没有记录
+func (t *csvRangeTableV4) build() {
+	if !sort.IsSorted(t) {
+		sort.Stable(t)
+	}
+	n := len(t.endArr)
+	for k := 0; k < 256; k++ {
+		low := sort.Search(n, func(i int) bool { return t.endArr[i] >= uint32(k)<<24 })
+		high := sort.Search(n, func(i int) bool { return t.endArr[i] >= uint32(k)<<24|0xFFFFFF })
+		if high == n {
+			high = n - 1
+		}
+		if low == n {
+			low, high = 1, 0
+		}
+		t.prefStart[k], t.prefEnd[k] = uint32(low), uint32(high)
+	}
+}
+
+func (t *csvRangeTableV4) getRecord(ip uint32) (*GeoInfo, error) {
+	low, high := t.prefStart[ip>>24], t.prefEnd[ip>>24]
+	for low < high {
+		mid := (low + high) / 2
+		if t.endArr[mid] >= ip {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	if low > high || t.endArr[low] < ip || t.startArr[low] > ip {
+		return nil, errors.New("not found")
+	}
+	return t.infoArr[low], nil
+}
+
+type csvRangeTableV6 struct {
+	startArr []uint128
+	endArr   []uint128
+	infoArr  []*GeoInfo
+}
+
+func (t *csvRangeTableV6) add(start, end uint128, info *GeoInfo) {
+	t.startArr = append(t.startArr, start)
+	t.endArr = append(t.endArr, end)
+	t.infoArr = append(t.infoArr, info)
+}
+
+func (t *csvRangeTableV6) Len() int           { return len(t.endArr) }
+func (t *csvRangeTableV6) Less(i, j int) bool { return t.endArr[i].cmp(t.endArr[j]) < 0 }
+func (t *csvRangeTableV6) Swap(i, j int) {
+	t.startArr[i], t.startArr[j] = t.startArr[j], t.startArr[i]
+	t.endArr[i], t.endArr[j] = t.endArr[j], t.endArr[i]
+	t.infoArr[i], t.infoArr[j] = t.infoArr[j], t.infoArr[i]
+}
+
+func (t *csvRangeTableV6) build() {
+	if !sort.IsSorted(t) {
+		sort.Stable(t)
+	}
+}
+
+func (t *csvRangeTableV6) getRecord(ip uint128) (*GeoInfo, error) {
+	i := sort.Search(len(t.endArr), func(i int) bool { return t.endArr[i].cmp(ip) >= 0 })
+	if i == len(t.endArr) || t.startArr[i].cmp(ip) > 0 {
+		return nil, errors.New("not found")
+	}
+	return t.infoArr[i], nil
+}
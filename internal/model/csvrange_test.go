@@ -0,0 +1,95 @@
+package model
+
+import (
+	"ip_geo/internal/config"
+	"net"
+	"strings"
+	"testing"
+)
+
+// IP2Location LITE IPv6库的格式，整数表示，IPv4以映射地址的区间出现
+const ip2LocationV6Csv = `"0","281470681743359","-","-","-","-"
+"281470681743360","281470715297791","US","United States of America","California","Los Angeles"
+"281470715297792","281474976710655","CN","China","Beijing","Beijing"
+"281474976710656","42540528726795050063891204319802818559","-","-","-","-"
+"42540528726795050063891204319802818560","42540528806023212578155541913346768895","JP","Japan","Tokyo","Tokyo"
+`
+
+var ip2LocationCsvCfg = &config.CsvConfig{
+	Columns: map[string]string{
+		"start_ip":     "0",
+		"end_ip":       "1",
+		"country_code": "2",
+		"country":      "3",
+		"region":       "4",
+		"city":         "5",
+	},
+}
+
+func TestLoadCsvRangeFileIp2LocationV6(t *testing.T) {
+	db, err := loadCsvRangeFile(strings.NewReader(ip2LocationV6Csv), ip2LocationCsvCfg)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := len(db.v4.endArr); got != 2 {
+		t.Errorf("v4 ranges = %d, want 2", got)
+	}
+	if got := len(db.v6.endArr); got != 3 {
+		t.Errorf("v6 ranges = %d, want 3", got)
+	}
+
+	tests := []struct {
+		ip          string
+		countryCode string
+	}{
+		{"1.0.0.1", "US"},
+		{"::ffff:1.0.0.1", "US"},
+		{"8.8.8.8", "CN"},
+		{"::1", "-"},
+		{"2001:200::1", "JP"},
+		{"2001:0:4136::1", "-"},
+	}
+	for _, tt := range tests {
+		info, err := db.getRecord(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Errorf("%s: %v", tt.ip, err)
+			continue
+		}
+		if info.CountryCode != tt.countryCode {
+			t.Errorf("%s: country code = %q, want %q", tt.ip, info.CountryCode, tt.countryCode)
+		}
+	}
+	if _, err := db.getRecord(net.ParseIP("2400::1")); err == nil {
+		t.Errorf("2400::1: want not found")
+	}
+}
+
+func TestParseCsvRange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		isV4       bool
+		wantErr    bool
+	}{
+		{"0", "16777215", true, false},
+		{"1.0.0.0", "1.0.0.255", true, false},
+		{"16777216", "1.0.0.255", true, false},
+		{"0", "281470681743359", false, false},
+		{"281470681743360", "281474976710655", true, false},
+		{"::", "::ffff:ffff", false, false},
+		{"2001:200::", "2001:200::ffff", false, false},
+		{"0", "::ffff:0.0.0.1", true, false},
+		{"1.0.0.0", "2001:200::", false, true},
+		{"16777216", "0", true, true},
+		{"abc", "1", false, true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseCsvRange(tt.start, tt.end)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s - %s: err = %v, wantErr %v", tt.start, tt.end, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (start.isV4 != tt.isV4 || end.isV4 != tt.isV4) {
+			t.Errorf("%s - %s: isV4 = %v/%v, want %v", tt.start, tt.end, start.isV4, end.isV4, tt.isV4)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/robfig/cron/v3"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 各离线库共用的同步流程：定时调度、下载、解压
+// 下载文件按配置存放在内存或工作目录，解压和解析都边读边处理，不落地解压后的文件
+
+// 数据源类型
+const (
+	DbSourceHttp = "http"
+	DbSourceFile = "file"
+	DbSourceS3   = "s3"
+)
+
+// 按DataSyncConfig创建定时刷新任务，file数据源同时监听目录，s3数据源先检查凭证
+// reqs中的下载地址及镜像须与数据源类型相符，同伴地址未开启InsecurePeers时须为https，启动时即报错，而不是等到刷新时才失败
+func newSyncScheduler(dsCfg *config.DataSyncConfig, reqs []dbFileRequest, task func()) (gocron.Scheduler, error) {
+	if dsCfg.SourceType == DbSourceFile && dsCfg.WatchDir == "" {
+		return nil, errors.New("watch dir missing for file source")
+	}
+	for _, req := range reqs {
+		for _, loc := range append([]string{req.Url}, req.Mirrors...) {
+			if err := validateDbFileLocation(dsCfg, loc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, peer := range dsCfg.Peers {
+		if err := checkPeerUrl(dsCfg, peer); err != nil {
+			return nil, err
+		}
+	}
+	if dsCfg.SourceType == DbSourceS3 {
+		if _, err := loadS3Credentials(&dsCfg.S3); err != nil {
+			return nil, err
+		}
+	}
+	syncer, err := gocron.NewScheduler(gocron.WithLocation(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	var j gocron.Job
+	if dsCfg.ForTest {
+		duration, err := time.ParseDuration(dsCfg.RereshInterval)
+		if err != nil {
+			return nil, err
+		}
+		if duration < 5*time.Second {
+			return nil, fmt.Errorf("refresh interval less than 5 seconds: %s", dsCfg.RereshInterval)
+		}
+		j, err = syncer.NewJob(gocron.DurationJob(duration), gocron.NewTask(task))
+		if err != nil {
+			return nil, err
+		}
+		logx.Infof("refresh db job id for test: %s", j.ID())
+	} else {
+		j, err = syncer.NewJob(gocron.CronJob(dsCfg.SyncCron, false),
+			gocron.NewTask(task))
+		if err != nil {
+			return nil, err
+		}
+		logx.Infof("refresh db job id: %s", j.ID())
+	}
+	if dsCfg.SourceType == DbSourceFile {
+		return watchDbDir(syncer, dsCfg, j)
+	}
+	return syncer, nil
+}
+
+// 定时刷新的最短间隔，按cron表达式取之后若干次执行的最小间隔
+func syncInterval(dsCfg *config.DataSyncConfig) (time.Duration, error) {
+	if dsCfg.ForTest {
+		return time.ParseDuration(dsCfg.RereshInterval)
+	}
+	// 与gocron解析方式一致
+	schedule, err := cron.ParseStandard(dsCfg.SyncCron)
+	if err != nil {
+		return 0, err
+	}
+	t := schedule.Next(time.Now().UTC())
+	interval := time.Duration(math.MaxInt64)
+	for i := 0; i < 100; i++ {
+		next := schedule.Next(t)
+		interval = min(interval, next.Sub(t))
+		t = next
+	}
+	return interval, nil
+}
+
+// 下载地址及镜像按数据源类型解释：http为http(s)地址，file为WatchDir中文件名的通配符（可带file://前缀或为绝对路径），
+// s3为对象键或s3://bucket/key；Verify.Sha256的键和本地缓存的标识都使用配置的原值
+func validateDbFileLocation(dsCfg *config.DataSyncConfig, loc string) error {
+	if loc == "" {
+		return fmt.Errorf("empty db file location for %s source", dsCfg.SourceType)
+	}
+	scheme, _, hasScheme := strings.Cut(loc, "://")
+	switch dsCfg.SourceType {
+	case DbSourceFile:
+		if hasScheme && scheme != "file" {
+			return fmt.Errorf("file source expects a file name pattern, but got %q", loc)
+		}
+		if _, err := filepath.Match(strings.TrimPrefix(loc, "file://"), ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %v", loc, err)
+		}
+	case DbSourceS3:
+		if hasScheme && scheme != "s3" {
+			return fmt.Errorf("s3 source expects an object key or s3://bucket/key, but got %q", loc)
+		}
+		if _, err := s3ObjectUrl(&dsCfg.S3, loc); err != nil {
+			return err
+		}
+	default:
+		u, err := url.Parse(loc)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http source expects an http(s) url, but got %q", loc)
+		}
+	}
+	return nil
+}
+
+// 离线库文件与已加载的相同，无需刷新
+var errDbNotModified = errors.New("db file not modified")
+
+// 离线库文件的来源信息，用于推导数据集版本和条件下载
+type dbFileMeta struct {
+	LastModified time.Time // HTTP Last-Modified
+	ETag         string
+	EntryModTime time.Time // 压缩包内文件的修改时间，未压缩时为零值
+	DownloadHash string    // 下载文件的sha256
+	FileHash     string    // 解压后文件的sha256
+	Source       string    // 实际下载的地址，可能为镜像
+	Verified     string    // 通过的校验方式，多个以逗号分隔
+	DownloadSize int64     // 下载文件的大小
+	FileSize     int64     // 解压后文件的大小
+}
+
+// 离线库文件的下载请求
+type dbFileRequest struct {
+	Url         string
+	Mirrors     []string // 备用下载地址，Url失败后按顺序尝试
+	EntrySuffix string   // 用于在压缩包中选择文件，为空时取第一个文件
+}
+
+// 下载并检查后的离线库文件，通过open边解压边读取
+type dbFile struct {
+	dbFileRequest
+	Meta    dbFileMeta
+	blob    *dbBlob
+	entry   dbEntry
+	archive *config.ArchiveConfig
+}
+
+// 打开解压后的内容，用完后需关闭
+func (f *dbFile) open() (io.ReadCloser, error) {
+	return openDbEntry(f.blob, f.entry, f.archive)
+}
+
+// 解压后的内容整体读入内存，按文件大小一次分配
+func (f *dbFile) readAll() ([]byte, error) {
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, f.Meta.FileSize+bytes.MinRead))
+	if _, err = buf.ReadFrom(rc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 解压到dir下的新文件，用于需要按文件随机读取的库，文件由调用方删除
+func (f *dbFile) extract(dir string) (string, error) {
+	rc, err := f.open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	newFile, err := os.CreateTemp(dir, "ipgeo-*")
+	if err != nil {
+		return "", err
+	}
+	defer newFile.Close()
+
+	if _, err = io.Copy(newFile, rc); err != nil {
+		os.Remove(newFile.Name())
+		return "", err
+	}
+	return newFile.Name(), nil
+}
+
+func (f *dbFile) remove() {
+	if f.blob != nil {
+		f.blob.remove()
+		f.blob = nil
+	}
+}
+
+// 下载组成同一快照的一组离线库文件，返回的文件与reqs一一对应，由调用方删除。
+// loaded为当前快照各文件的来源信息，全部文件未变化时返回errDbNotModified；
+// 只要有文件变化，未变化的文件也重新完整下载，保证新快照由同一批文件构成
+func fetchDbFiles(ctx context.Context, dsCfg *config.DataSyncConfig, reqs []dbFileRequest,
+	loaded map[string]dbFileMeta) (files []dbFile, err error) {
+	files = make([]dbFile, len(reqs))
+	defer func() {
+		if err != nil {
+			removeDbFiles(files)
+			files = nil
+		}
+	}()
+
+	// 文件组成变化时不做条件下载
+	conditional := len(loaded) == len(reqs)
+	for _, req := range reqs {
+		if _, ok := loaded[req.Url]; !ok {
+			conditional = false
+		}
+	}
+
+	// 按上次的文件大小预估所需资源，首次下载时大小未知，在得到Content-Length后检查
+	var downloadSize, fileSize int64
+	for _, meta := range loaded {
+		downloadSize += meta.DownloadSize
+		fileSize += meta.FileSize
+	}
+	if err = checkDbResources(dsCfg, downloadSize, fileSize); err != nil {
+		return files, err
+	}
+
+	unchanged := 0
+	for i, req := range reqs {
+		var prev dbFileMeta
+		if conditional {
+			prev = loaded[req.Url]
+		}
+		files[i], err = fetchDbFile(ctx, dsCfg, req, prev)
+		if errors.Is(err, errDbNotModified) {
+			logx.Infof("db file not modified, url: %s", req.Url)
+			unchanged++
+			continue
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+	if unchanged == len(reqs) {
+		return files, errDbNotModified
+	}
+
+	for i, req := range reqs {
+		if files[i].blob != nil {
+			continue
+		}
+		files[i], err = fetchDbFile(ctx, dsCfg, req, dbFileMeta{})
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+func removeDbFiles(files []dbFile) {
+	for i := range files {
+		files[i].remove()
+	}
+}
+
+// 各提供方共用的加载流程，提供方只负责加载并检查文件：
+// 启动时依次尝试本地缓存、同伴快照和下载，之后定时刷新，切换后保存快照；配置了协调刷新时由cluster协调
+type dbDataset struct {
+	name       string // 日志中的库名，如mmdb
+	provider   string
+	cfgPtr     *atomic.Pointer[config.Config]
+	reqs       func(cfg *config.Config) []dbFileRequest
+	stageFiles func(files []dbFile) (version string, commit func(), err error) // 加载并检查，commit切换，切换前不影响当前库
+	syncer     gocron.Scheduler
+	ctx        context.Context // clean时取消，停止进行中的下载
+	cancel     context.CancelFunc
+	cluster    *clusterDataset // 协调刷新，为nil时独立刷新
+	refreshMu  sync.Mutex
+	fileMetas  map[string]dbFileMeta // 当前库的文件来源信息，由refreshMu保护
+}
+
+func newDbDataset(cfgPtr *atomic.Pointer[config.Config], provider string, name string,
+	reqs func(cfg *config.Config) []dbFileRequest,
+	stageFiles func(files []dbFile) (string, func(), error), cluster *ClusterSync) (*dbDataset, error) {
+	ds := &dbDataset{name: name, provider: provider, cfgPtr: cfgPtr, reqs: reqs, stageFiles: stageFiles}
+	ds.ctx, ds.cancel = context.WithCancel(context.Background())
+	var err error
+	if cluster != nil {
+		if ds.cluster, err = cluster.register(ds); err != nil {
+			return nil, err
+		}
+	}
+	cfg := cfgPtr.Load()
+	if ds.syncer, err = newSyncScheduler(cfg.DataSyncConfig, reqs(cfg), ds.refresh); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (ds *dbDataset) cache() *snapshotCache {
+	cfg := ds.cfgPtr.Load()
+	return newSnapshotCache(cfg.DataSyncConfig, ds.provider, ds.reqs(cfg))
+}
+
+// 有可用的本地缓存或同伴快照时先加载，再在后台刷新，否则先同步下载一次，之后启动定时刷新
+func (ds *dbDataset) init() error {
+	if ds.loadCache() || ds.loadPeers() {
+		go ds.refresh()
+	} else if err := ds.doRefresh(); err != nil {
+		return err
+	}
+
+	ds.syncer.Start()
+	return nil
+}
+
+func (ds *dbDataset) clean() {
+	ds.cancel()
+	if err := ds.syncer.Shutdown(); err != nil {
+		logx.Errorf("shutdown refresh job failed: %v", err)
+	}
+}
+
+// 定时刷新的任务
+func (ds *dbDataset) refresh() {
+	var err error
+	if ds.cluster != nil {
+		err = ds.cluster.refreshInCluster()
+	} else {
+		err = ds.doRefresh()
+	}
+	if err != nil {
+		logx.Errorf("error refreshing %s: %v", ds.name, err)
+	}
+}
+
+// 独立刷新：下载、加载检查后切换，并保存快照
+func (ds *dbDataset) doRefresh() (err error) {
+	ds.refreshMu.Lock()
+	defer ds.refreshMu.Unlock()
+	logx.Infof("begin refreshing %s", ds.name)
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("%v", panicErr)
+		}
+	}()
+
+	cfg := ds.cfgPtr.Load()
+	files, err := fetchDbFiles(ds.ctx, cfg.DataSyncConfig, ds.reqs(cfg), ds.fileMetas)
+	if errors.Is(err, errDbNotModified) {
+		logx.Infof("%s not modified, skip refreshing", ds.name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer removeDbFiles(files)
+
+	version, err := ds.apply(files)
+	if err != nil {
+		return err
+	}
+	ds.cache().save(files, version)
+	return nil
+}
+
+func (ds *dbDataset) loadCache() bool {
+	return loadSnapshotCache(&ds.refreshMu, ds.cache(), func(files []dbFile) error {
+		_, err := ds.apply(files)
+		return err
+	})
+}
+
+// 没有本地缓存时从同伴获取快照，加载后同样保存到本地缓存
+func (ds *dbDataset) loadPeers() bool {
+	cache := ds.cache()
+	return loadPeerSnapshot(&ds.refreshMu, ds.cfgPtr.Load(), cache, func(files []dbFile) error {
+		version, err := ds.apply(files)
+		if err != nil {
+			return err
+		}
+		cache.save(files, version)
+		return nil
+	})
+}
+
+// 加载并检查，通过后返回版本及切换函数，切换时同时记录文件来源信息，在refreshMu内调用
+func (ds *dbDataset) stage(files []dbFile) (version string, commit func(), err error) {
+	version, commitFiles, err := ds.stageFiles(files)
+	if err != nil {
+		return "", nil, err
+	}
+	metas := dbFileMetas(files)
+	commit = func() {
+		commitFiles()
+		ds.fileMetas = metas
+	}
+	return version, commit, nil
+}
+
+// 加载、检查并立即切换
+func (ds *dbDataset) apply(files []dbFile) (version string, err error) {
+	version, commit, err := ds.stage(files)
+	if err != nil {
+		return "", err
+	}
+	commit()
+	return version, nil
+}
+
+// 按下载地址记录文件来源信息，刷新成功后保存，作为下次条件下载的依据
+func dbFileMetas(files []dbFile) map[string]dbFileMeta {
+	metas := make(map[string]dbFileMeta, len(files))
+	for _, f := range files {
+		metas[f.Url] = f.Meta
+	}
+	return metas
+}
+
+// 下载并检查离线库文件，失败时删除下载文件
+// prev为已加载文件的来源信息，用于条件下载，文件未变化时返回errDbNotModified
+func fetchDbFile(ctx context.Context, dsCfg *config.DataSyncConfig, req dbFileRequest, prev dbFileMeta) (file dbFile, err error) {
+	file = dbFile{dbFileRequest: req, archive: &dsCfg.Archive}
+	var part partialDownload
+
+	// 依次尝试主地址和各镜像，file数据源中为文件名通配符，s3数据源中为对象键
+	for _, fileUri := range append([]string{req.Url}, req.Mirrors...) {
+		switch dsCfg.SourceType {
+		case DbSourceFile:
+			part, err = readLocalDbFile(dsCfg, fileUri, prev)
+		case DbSourceS3:
+			var objectUrl string
+			if objectUrl, err = s3ObjectUrl(&dsCfg.S3, fileUri); err == nil {
+				part, err = downloadWithRetry(ctx, dsCfg, objectUrl, prev)
+			}
+		default:
+			part, err = downloadWithRetry(ctx, dsCfg, fileUri, prev)
+		}
+		if err == nil || errors.Is(err, errDbNotModified) {
+			break
+		}
+		logx.Errorf("download db file from %s failed, err: %v", fileUri, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return dbFile{}, err
+	}
+	file.blob, file.Meta = part.blob, part.meta
+	file.Meta.DownloadSize = part.size
+	defer func() {
+		if err != nil {
+			file.remove()
+			file = dbFile{}
+		}
+	}()
+	logx.Infof("finish downloading db file, source: %s, in memory: %v, bytes: %d",
+		file.Meta.Source, file.blob.inMemory(), part.size)
+
+	// 服务端不支持条件请求时，比较下载文件的哈希
+	file.Meta.DownloadHash, err = file.blob.hash()
+	if err != nil {
+		return file, err
+	}
+	if prev.DownloadHash != "" && prev.DownloadHash == file.Meta.DownloadHash {
+		return file, errDbNotModified
+	}
+
+	// 校验失败时不解压，也就不会切换离线库
+	file.Meta.Verified, err = verifyDbFile(&dsCfg.Verify, sourceHttpClient(dsCfg), req, file.Meta, file.blob)
+	setDownloadVerified(file.Meta.Source, file.Meta.Verified, err)
+	if err != nil {
+		return file, err
+	}
+
+	file.entry, file.Meta.FileHash, file.Meta.FileSize, err = inspectDbFile(file.blob, req.EntrySuffix, &dsCfg.Archive)
+	if err != nil {
+		return file, err
+	}
+	file.Meta.EntryModTime = file.entry.modTime
+	logx.Infof("finish inspecting db file, entry: %q, bytes: %d", file.entry.name, file.Meta.FileSize)
+
+	// 重新打包但内容相同的文件也无需刷新
+	if prev.FileHash != "" && prev.FileHash == file.Meta.FileHash {
+		return file, errDbNotModified
+	}
+	return file, nil
+}
+
+// 数据集版本及加载时间
+type dbVersion struct {
+	version  string
+	loadTime time.Time
+}
+
+// 填充查询结果中的版本信息，尚未加载时不填充
+func (v *dbVersion) fill(info *GeoInfo) {
+	if v == nil {
+		return
+	}
+	info.DBVersion = v.version
+	info.DBLoadTime = v.loadTime.Format(time.RFC3339)
+}
+
+// 数据集版本中时间的格式
+const dbVersionTimeLayout = "2006-01-02T15:04:05Z"
+
+// 由数据集本身推导版本，依次取：文件头中的构建时间、压缩包内文件修改时间、
+// HTTP Last-Modified、ETag，都没有时取内容哈希
+func datasetVersion(headerTime time.Time, meta dbFileMeta, fileHash string) string {
+	for _, t := range []time.Time{headerTime, meta.EntryModTime, meta.LastModified} {
+		if !t.IsZero() && t.Unix() > 0 {
+			return t.UTC().Format(dbVersionTimeLayout)
+		}
+	}
+	if etag := strings.Trim(strings.TrimPrefix(meta.ETag, "W/"), `"`); etag != "" {
+		return "etag-" + etag
+	}
+	return "sha256-" + fileHash[:min(12, len(fileHash))]
+}
+
+func removeFile(filepath string) {
+	err := os.Remove(filepath)
+	if err != nil {
+		logx.Errorf("remove file failed, path: %s", filepath)
+	}
+}
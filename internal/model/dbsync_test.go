@@ -0,0 +1,260 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateDbFileLocation(t *testing.T) {
+	tests := []struct {
+		sourceType string
+		loc        string
+		wantErr    bool
+	}{
+		{DbSourceHttp, "https://example.com/db.zip", false},
+		{DbSourceHttp, "ipv4.zip", true},
+		{DbSourceHttp, "s3://bucket/db.zip", true},
+		{DbSourceFile, "ipv4-*.zip", false},
+		{DbSourceFile, "file:///data/ipv4-*.zip", false},
+		{DbSourceFile, "https://example.com/db.zip", true},
+		{DbSourceFile, "ipv4-[.zip", true},
+		{DbSourceS3, "geo/ipv4.zip", false},
+		{DbSourceS3, "s3://other/geo/ipv4.zip", false},
+		{DbSourceS3, "https://example.com/db.zip", true},
+		{DbSourceS3, "s3://bucket-only", true},
+		{DbSourceS3, "", true},
+	}
+	for _, tt := range tests {
+		dsCfg := &config.DataSyncConfig{SourceType: tt.sourceType, S3: config.S3Config{Region: "us-east-1", Bucket: "geo", PathStyle: true}}
+		if err := validateDbFileLocation(dsCfg, tt.loc); (err != nil) != tt.wantErr {
+			t.Errorf("%s %q: err = %v, wantErr %v", tt.sourceType, tt.loc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDatasetVersion(t *testing.T) {
+	header := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	lastModified := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	const hash = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name   string
+		header time.Time
+		meta   dbFileMeta
+		hash   string
+		want   string
+	}{
+		{"header first", header, dbFileMeta{EntryModTime: entry, LastModified: lastModified, ETag: `"v1"`}, hash, "2024-01-02T03:04:05Z"},
+		{"entry mod time", time.Time{}, dbFileMeta{EntryModTime: entry, LastModified: lastModified, ETag: `"v1"`}, hash, "2024-02-03T04:05:06Z"},
+		{"last modified", time.Time{}, dbFileMeta{LastModified: lastModified, ETag: `"v1"`}, hash, "2024-03-04T05:06:07Z"},
+		// 文件头中未填写的时间为0
+		{"epoch header skipped", time.Unix(0, 0), dbFileMeta{LastModified: lastModified}, hash, "2024-03-04T05:06:07Z"},
+		{"converted to utc", header.In(time.FixedZone("CST", 8*3600)), dbFileMeta{}, hash, "2024-01-02T03:04:05Z"},
+		{"etag", time.Time{}, dbFileMeta{ETag: `"v1"`}, hash, "etag-v1"},
+		{"weak etag", time.Time{}, dbFileMeta{ETag: `W/"v1"`}, hash, "etag-v1"},
+		{"empty etag", time.Time{}, dbFileMeta{ETag: `""`}, hash, "sha256-0123456789ab"},
+		{"content hash", time.Time{}, dbFileMeta{}, hash, "sha256-0123456789ab"},
+		{"short hash", time.Time{}, dbFileMeta{}, "abc", "sha256-abc"},
+	}
+	for _, tt := range tests {
+		if got := datasetVersion(tt.header, tt.meta, tt.hash); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDbVersionFill(t *testing.T) {
+	// 尚未加载时不填充
+	info := &GeoInfo{DBVersion: "unchanged"}
+	var v *dbVersion
+	v.fill(info)
+	if info.DBVersion != "unchanged" || info.DBLoadTime != "" {
+		t.Errorf("nil version filled: %+v", info)
+	}
+
+	loadTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	v = &dbVersion{version: "2024-01-01T00:00:00Z", loadTime: loadTime}
+	v.fill(info)
+	if info.DBVersion != "2024-01-01T00:00:00Z" || info.DBLoadTime != "2024-01-02T03:04:05Z" {
+		t.Errorf("info = %+v", info)
+	}
+}
+
+// 内存中未压缩的离线库文件
+func testRawDbFile(data []byte) dbFile {
+	blob := &dbBlob{mem: data}
+	hash, _ := blob.hash()
+	return dbFile{
+		Meta:    dbFileMeta{FileHash: hash, FileSize: int64(len(data))},
+		blob:    blob,
+		entry:   dbEntry{format: archiveFormatRaw},
+		archive: &config.ArchiveConfig{},
+	}
+}
+
+// 内容不变时按If-None-Match返回304
+func etagResponse(content, etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(content))
+	}
+}
+
+func TestFetchDbFilesNotModified(t *testing.T) {
+	tests := []struct {
+		name         string
+		etagB        string // 服务端当前b文件的ETag
+		loaded       []string
+		wantErr      error
+		wantRequests [2][]string // 各文件每次请求的If-None-Match
+	}{
+		{
+			name:         "all unchanged",
+			etagB:        `"b1"`,
+			loaded:       []string{"a", "b"},
+			wantErr:      errDbNotModified,
+			wantRequests: [2][]string{{`"a1"`}, {`"b1"`}},
+		},
+		{
+			// 未变化的文件重新完整下载
+			name:         "one changed",
+			etagB:        `"b2"`,
+			loaded:       []string{"a", "b"},
+			wantRequests: [2][]string{{`"a1"`, ""}, {`"b1"`}},
+		},
+		{
+			// 文件组成变化时不做条件下载
+			name:         "file added",
+			etagB:        `"b1"`,
+			loaded:       []string{"a"},
+			wantRequests: [2][]string{{""}, {""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := []*testDownloadServer{
+				{handlers: []http.HandlerFunc{etagResponse("content a", `"a1"`)}},
+				{handlers: []http.HandlerFunc{etagResponse("content b", tt.etagB)}},
+			}
+			var reqs []dbFileRequest
+			urls := make(map[string]string)
+			for i, ts := range servers {
+				server := httptest.NewServer(ts)
+				defer server.Close()
+				name := string(rune('a' + i))
+				urls[name] = server.URL + "/" + name + ".db"
+				reqs = append(reqs, dbFileRequest{Url: urls[name]})
+			}
+			loaded := make(map[string]dbFileMeta)
+			for _, name := range tt.loaded {
+				loaded[urls[name]] = dbFileMeta{ETag: `"` + name + `1"`}
+			}
+
+			files, err := fetchDbFiles(context.Background(), newDownloadTestConfig(), reqs, loaded)
+			defer removeDbFiles(files)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			for i, ts := range servers {
+				var got []string
+				for _, h := range ts.requests {
+					got = append(got, h.Get("If-None-Match"))
+				}
+				if !reflect.DeepEqual(got, tt.wantRequests[i]) {
+					t.Errorf("file %d: If-None-Match = %q, want %q", i, got, tt.wantRequests[i])
+				}
+			}
+			if tt.wantErr != nil {
+				if files != nil {
+					t.Errorf("files = %v, want nil", files)
+				}
+				return
+			}
+			for i, want := range []string{"content a", "content b"} {
+				if got, _ := files[i].blob.bytes(); string(got) != want || files[i].Meta.Source != reqs[i].Url {
+					t.Errorf("file %d: content %q, source %s", i, got, files[i].Meta.Source)
+				}
+			}
+		})
+	}
+}
+
+// 主地址按重试策略重试后依次尝试各镜像，成功后不再尝试之后的镜像
+func TestFetchDbFileMirrorOrder(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string
+	newServer := func(name string, status int) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits = append(hits, name)
+			mu.Unlock()
+			w.WriteHeader(status)
+			w.Write([]byte("content " + name))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL + "/" + name + ".db"
+	}
+
+	dsCfg := newDownloadTestConfig()
+	dsCfg.Retry.InitialBackoff = 10 * time.Millisecond
+	req := dbFileRequest{
+		Url: newServer("primary", http.StatusServiceUnavailable),
+		Mirrors: []string{
+			newServer("mirror1", http.StatusNotFound),
+			newServer("mirror2", http.StatusOK),
+			newServer("mirror3", http.StatusOK),
+		},
+	}
+	file, err := fetchDbFile(context.Background(), dsCfg, req, dbFileMeta{})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer file.remove()
+	want := []string{"primary", "primary", "mirror1", "mirror1", "mirror2"}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+	if got, _ := file.blob.bytes(); string(got) != "content mirror2" || file.Meta.Source != req.Mirrors[1] {
+		t.Errorf("content %q, source %s, want from %s", got, file.Meta.Source, req.Mirrors[1])
+	}
+
+	// 全部失败时返回最后一个地址的错误
+	hits = nil
+	req.Mirrors = req.Mirrors[:1]
+	if _, err = fetchDbFile(context.Background(), dsCfg, req, dbFileMeta{}); err == nil || !strings.Contains(err.Error(), "but got 404") {
+		t.Errorf("err = %v, want 404 from last mirror", err)
+	}
+	if want = want[:4]; !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+
+	// 取消后不再尝试镜像，也不记录其下载进度
+	hits = nil
+	req.Mirrors = []string{newServer("unused", http.StatusOK)}
+	ctx, cancel := context.WithCancel(context.Background())
+	dsCfg.Retry.InitialBackoff = time.Hour
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err = fetchDbFile(ctx, dsCfg, req, dbFileMeta{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want canceled", err)
+	}
+	if want = want[:1]; !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+	for _, status := range DownloadStatuses() {
+		if status.Url == req.Mirrors[0] {
+			t.Errorf("mirror tried after cancel: %+v", status)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"golang.org/x/time/rate"
+)
+
+// 离线库文件的下载：断点续传、限速和进度
+
+// 下载状态
+const (
+	DownloadStateDownloading = "downloading"
+	DownloadStateDone        = "done"
+	DownloadStateFailed      = "failed"
+	DownloadStateRejected    = "rejected" // 下载完成但校验失败
+)
+
+// 下载进度的日志间隔
+const downloadLogInterval = 10 * time.Second
+
+// 下载进度，供日志和状态接口使用
+type DownloadStatus struct {
+	Url        string
+	State      string
+	Bytes      int64  // 已下载字节数，含续传前已下载的部分
+	Total      int64  // 文件总大小，未知时为-1
+	Rate       int64  // 最近的下载速度，字节每秒
+	Eta        int64  // 预计剩余秒数，未知时为-1
+	Resumed    int    // 断点续传次数
+	Verified   string // 通过的校验方式
+	StartTime  time.Time
+	UpdateTime time.Time
+	Error      string
+}
+
+// 各下载地址最近一次下载的进度
+var downloadStatuses = struct {
+	sync.Mutex
+	m map[string]*downloadProgress
+}{m: make(map[string]*downloadProgress)}
+
+// 返回各下载地址最近一次下载的进度，按地址排序
+func DownloadStatuses() []DownloadStatus {
+	downloadStatuses.Lock()
+	progresses := make([]*downloadProgress, 0, len(downloadStatuses.m))
+	for _, p := range downloadStatuses.m {
+		progresses = append(progresses, p)
+	}
+	downloadStatuses.Unlock()
+
+	statuses := make([]DownloadStatus, 0, len(progresses))
+	for _, p := range progresses {
+		statuses = append(statuses, p.snapshot())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Url < statuses[j].Url })
+	return statuses
+}
+
+type downloadProgress struct {
+	mu          sync.Mutex
+	status      DownloadStatus
+	windowStart time.Time // 速度统计窗口
+	windowBytes int64
+	lastLog     time.Time
+}
+
+func newDownloadProgress(url string) *downloadProgress {
+	now := time.Now()
+	p := &downloadProgress{
+		status: DownloadStatus{
+			Url:        url,
+			State:      DownloadStateDownloading,
+			Total:      -1,
+			Eta:        -1,
+			StartTime:  now,
+			UpdateTime: now,
+		},
+		windowStart: now,
+		lastLog:     now,
+	}
+	downloadStatuses.Lock()
+	downloadStatuses.m[url] = p
+	downloadStatuses.Unlock()
+	return p
+}
+
+func (p *downloadProgress) snapshot() DownloadStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// 开始一次请求，offset为续传的起始位置，total未知时为-1
+func (p *downloadProgress) begin(offset int64, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset > 0 {
+		p.status.Resumed++
+	}
+	p.status.Bytes = offset
+	p.status.Total = total
+	p.windowStart = time.Now()
+	p.windowBytes = 0
+}
+
+// 统计写入的字节数，用于io.TeeReader
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.status.Bytes += int64(len(b))
+	p.status.UpdateTime = now
+	p.windowBytes += int64(len(b))
+	if elapsed := now.Sub(p.windowStart); elapsed >= time.Second {
+		p.status.Rate = int64(float64(p.windowBytes) / elapsed.Seconds())
+		p.windowStart = now
+		p.windowBytes = 0
+		p.status.Eta = -1
+		if p.status.Total > 0 && p.status.Rate > 0 {
+			p.status.Eta = (p.status.Total - p.status.Bytes) / p.status.Rate
+		}
+	}
+	if now.Sub(p.lastLog) >= downloadLogInterval {
+		p.lastLog = now
+		logx.Infof("downloading db file, url: %s, bytes: %d/%d, rate: %d B/s, eta: %ds",
+			p.status.Url, p.status.Bytes, p.status.Total, p.status.Rate, p.status.Eta)
+	}
+	return len(b), nil
+}
+
+func (p *downloadProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.UpdateTime = time.Now()
+	p.status.Eta = -1
+	// 文件未变化时不算失败
+	if err != nil && !errors.Is(err, errDbNotModified) {
+		p.status.State = DownloadStateFailed
+		p.status.Error = err.Error()
+		return
+	}
+	p.status.State = DownloadStateDone
+	p.status.Error = ""
+}
+
+// 记录下载文件的校验结果
+func setDownloadVerified(url string, verified string, err error) {
+	downloadStatuses.Lock()
+	p := downloadStatuses.m[url]
+	downloadStatuses.Unlock()
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Verified = verified
+	if err != nil {
+		p.status.State = DownloadStateRejected
+		p.status.Error = err.Error()
+	}
+}
+
+// 限速读取，每次读取不超过令牌桶容量
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	burst := int(min(bytesPerSecond, 64*1024))
+	return &throttledReader{ctx: ctx, r: r, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > t.limiter.Burst() {
+		b = b[:t.limiter.Burst()]
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// 下载中的文件，失败后保留已下载的部分用于续传
+type partialDownload struct {
+	blob      *dbBlob
+	size      int64
+	validator string // 用于If-Range，确保续传的是同一个文件
+	meta      dbFileMeta
+}
+
+// 按重试策略从一个地址下载，重试时从已下载的位置续传，失败时删除已下载的部分
+// ctx取消时停止下载和重试前的等待
+func downloadWithRetry(ctx context.Context, dsCfg *config.DataSyncConfig, fileUri string,
+	prev dbFileMeta) (part partialDownload, err error) {
+	policy := dsCfg.Retry
+	progress := newDownloadProgress(fileUri)
+	attempts := max(policy.MaxAttempts, 1)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			backoff := retryBackoff(policy, i)
+			logx.Infof("retry downloading db file in %s, url: %s, attempt: %d/%d", backoff, fileUri, i+1, attempts)
+			if err = sleepContext(ctx, backoff); err != nil {
+				break
+			}
+		}
+		err = downloadAttempt(ctx, dsCfg, fileUri, prev, &part, progress)
+		if err == nil || errors.Is(err, errDbNotModified) {
+			break
+		}
+		logx.Errorf("download db file failed, url: %s, attempt: %d/%d, downloaded: %d bytes, err: %v",
+			fileUri, i+1, attempts, part.size, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	progress.finish(err)
+	if err != nil && part.blob != nil {
+		part.blob.remove()
+		part.blob = nil
+	}
+	part.meta.Source = fileUri
+	return part, err
+}
+
+func downloadAttempt(ctx context.Context, dsCfg *config.DataSyncConfig, fileUri string, prev dbFileMeta,
+	part *partialDownload, progress *downloadProgress) error {
+	ctx, cf := context.WithTimeout(ctx, attemptTimeout(dsCfg.Retry))
+	defer cf()
+	return downloadOfflineDb(ctx, dsCfg, fileUri, prev, part, progress)
+}
+
+func attemptTimeout(policy config.RetryPolicy) time.Duration {
+	if policy.AttemptTimeout <= 0 {
+		return 30 * time.Minute
+	}
+	return policy.AttemptTimeout
+}
+
+// 按重试策略从一个地址下载的最长耗时，重试前的等待按最长等待时间计
+func downloadRetryBudget(policy config.RetryPolicy) time.Duration {
+	attempts := max(policy.MaxAttempts, 1)
+	backoff := policy.MaxBackoff
+	if backoff <= 0 {
+		backoff = policy.InitialBackoff
+	}
+	return time.Duration(attempts)*attemptTimeout(policy) + time.Duration(attempts-1)*backoff
+}
+
+// 等待d，ctx取消时提前返回
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 第retry次重试前的等待时间：按倍数指数增长，不超过最长等待时间，并加入随机抖动
+func retryBackoff(policy config.RetryPolicy, retry int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(max(policy.Multiplier, 1), float64(retry-1))
+	if policy.MaxBackoff > 0 {
+		backoff = min(backoff, float64(policy.MaxBackoff))
+	}
+	if jitter := min(max(policy.Jitter, 0), 1); jitter > 0 {
+		backoff *= 1 + jitter*(rand.Float64()*2-1)
+	}
+	return time.Duration(backoff)
+}
+
+// 下载离线库文件，part中已有内容时通过Range续传
+// prev不为空时发送条件请求，服务端返回304时返回errDbNotModified
+func downloadOfflineDb(ctx context.Context, dsCfg *config.DataSyncConfig, fileUri string, prev dbFileMeta,
+	part *partialDownload, progress *downloadProgress) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUri, nil)
+	if err != nil {
+		return err
+	}
+	resuming := part.size > 0 && part.validator != ""
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", part.size))
+		req.Header.Set("If-Range", part.validator)
+	} else {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if !prev.LastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", prev.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	resp, err := sourceHttpClient(dsCfg).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var offset int64
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && !resuming:
+		return errDbNotModified
+	case resp.StatusCode == http.StatusPartialContent && resuming:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != part.size {
+			return fmt.Errorf("unexpected content range start %d, expected %d", start, part.size)
+		}
+		offset, total = start, size
+	case resp.StatusCode == http.StatusOK:
+		// 文件已变化或服务端不支持Range，从头下载
+		part.size = 0
+		part.meta = dbFileMeta{ETag: resp.Header.Get("ETag")}
+		if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			part.meta.LastModified = lm
+		}
+		// 弱ETag不能用于If-Range
+		part.validator = resp.Header.Get("Last-Modified")
+		if etag := part.meta.ETag; etag != "" && !strings.HasPrefix(etag, "W/") {
+			part.validator = etag
+		}
+		total = resp.ContentLength
+
+		// 如果返回json格式，则报错了
+		if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "application/json") {
+			b := new(bytes.Buffer)
+			io.Copy(b, resp.Body)
+			return fmt.Errorf("download file failed, fileUri: %v, resp body: %s", fileUri, b.String())
+		}
+	default:
+		return fmt.Errorf("download file failed, fileUri: %v, expected status code 200, but got %d", fileUri, resp.StatusCode)
+	}
+
+	// 已知文件大小时，开始写入前检查剩余空间
+	if total >= 0 {
+		if err = checkDbResources(dsCfg, total-offset, 0); err != nil {
+			return err
+		}
+	}
+
+	// 续传时追加到已下载的部分之后
+	if part.blob == nil {
+		if part.blob, err = newDbBlob(dsCfg); err != nil {
+			return err
+		}
+	}
+	part.blob.reserve(total)
+	w, err := part.blob.writer(offset)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	progress.begin(offset, total)
+	body := newThrottledReader(ctx, resp.Body, dsCfg.BandwidthLimit)
+	n, err := io.Copy(w, io.TeeReader(body, progress))
+	part.size = offset + n
+	if err != nil {
+		return err
+	}
+	if total >= 0 && part.size != total {
+		return fmt.Errorf("incomplete download, got %d bytes, expected %d", part.size, total)
+	}
+	return nil
+}
+
+// 解析Content-Range: bytes start-end/size，size未知时返回-1
+func parseContentRange(s string) (start int64, size int64, err error) {
+	var end int64
+	var sizeStr string
+	if _, err = fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &sizeStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q: %v", s, err)
+	}
+	if sizeStr == "*" {
+		return start, -1, nil
+	}
+	size, err = strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q: %v", s, err)
+	}
+	return start, size, nil
+}
@@ -0,0 +1,288 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newDownloadTestConfig() *config.DataSyncConfig {
+	return &config.DataSyncConfig{
+		Storage: DbStorageMemory,
+		Retry:   config.RetryPolicy{MaxAttempts: 2, AttemptTimeout: 5 * time.Second},
+	}
+}
+
+// 按请求序号返回不同响应的下载地址，记录各次请求的头部
+type testDownloadServer struct {
+	requests []http.Header
+	handlers []http.HandlerFunc
+}
+
+func (s *testDownloadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := len(s.requests)
+	s.requests = append(s.requests, r.Header.Clone())
+	s.handlers[min(i, len(s.handlers)-1)](w, r)
+}
+
+// 声明完整长度但只写出前n字节，客户端读到意外的EOF
+func truncatedResponse(content string, n int, etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content[:n]))
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	tests := []struct {
+		name        string
+		second      http.HandlerFunc
+		wantContent string
+		wantErr     string
+		wantResumed int
+	}{
+		{
+			name: "206 resumes from offset",
+			second: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 300-999/1000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content[300:]))
+			},
+			wantContent: content,
+			wantResumed: 1,
+		},
+		{
+			// If-Range不匹配时服务端返回完整的新文件
+			name: "200 restarts from scratch",
+			second: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v2"`)
+				w.Write([]byte("changed file"))
+			},
+			wantContent: "changed file",
+		},
+		{
+			name: "malformed content range",
+			second: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 300-999")
+				w.WriteHeader(http.StatusPartialContent)
+			},
+			wantErr: "invalid content range",
+		},
+		{
+			name: "unexpected range start",
+			second: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 0-999/1000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content))
+			},
+			wantErr: "unexpected content range start 0, expected 300",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &testDownloadServer{handlers: []http.HandlerFunc{truncatedResponse(content, 300, `"v1"`), tt.second}}
+			server := httptest.NewServer(ts)
+			defer server.Close()
+
+			part, err := downloadWithRetry(context.Background(), newDownloadTestConfig(), server.URL+"/db.bin", dbFileMeta{})
+			if len(ts.requests) != 2 {
+				t.Fatalf("requests = %d, want 2", len(ts.requests))
+			}
+			// 续传时带上Range和首次响应的强ETag
+			if got := ts.requests[1].Get("Range"); got != "bytes=300-" {
+				t.Errorf("Range = %q", got)
+			}
+			if got := ts.requests[1].Get("If-Range"); got != `"v1"` {
+				t.Errorf("If-Range = %q", got)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || part.blob != nil {
+					t.Fatalf("err = %v, blob = %v, want %q and partial removed", err, part.blob, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if b, _ := part.blob.bytes(); string(b) != tt.wantContent || part.size != int64(len(tt.wantContent)) {
+				t.Errorf("content = %q (%d bytes), want %q", b, part.size, tt.wantContent)
+			}
+			var status DownloadStatus
+			for _, s := range DownloadStatuses() {
+				if s.Url == server.URL+"/db.bin" {
+					status = s
+				}
+			}
+			if status.State != DownloadStateDone || status.Resumed != tt.wantResumed {
+				t.Errorf("status = %+v, want done, resumed %d", status, tt.wantResumed)
+			}
+		})
+	}
+}
+
+// 弱ETag不能用于If-Range，改用Last-Modified
+func TestDownloadResumeWeakETag(t *testing.T) {
+	content := strings.Repeat("x", 100)
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+	ts := &testDownloadServer{handlers: []http.HandlerFunc{
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Last-Modified", lastModified)
+			truncatedResponse(content, 40, `W/"weak"`)(w, r)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 40-99/100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(content[40:]))
+		},
+	}}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	part, err := downloadWithRetry(context.Background(), newDownloadTestConfig(), server.URL+"/db.bin", dbFileMeta{})
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got := ts.requests[1].Get("If-Range"); got != lastModified {
+		t.Errorf("If-Range = %q, want %q", got, lastModified)
+	}
+	if b, _ := part.blob.bytes(); string(b) != content {
+		t.Errorf("content = %q", b)
+	}
+}
+
+func TestDownloadNotModified(t *testing.T) {
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := &testDownloadServer{handlers: []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}}}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	prev := dbFileMeta{ETag: `"v1"`, LastModified: lastModified}
+	part, err := downloadWithRetry(context.Background(), newDownloadTestConfig(), server.URL+"/db.bin", prev)
+	if !errors.Is(err, errDbNotModified) || part.blob != nil {
+		t.Fatalf("err = %v, blob = %v, want not modified", err, part.blob)
+	}
+	// 未变化时不重试
+	if len(ts.requests) != 1 {
+		t.Errorf("requests = %d, want 1", len(ts.requests))
+	}
+	if got := ts.requests[0].Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("If-None-Match = %q", got)
+	}
+	if got := ts.requests[0].Get("If-Modified-Since"); got != lastModified.Format(http.TimeFormat) {
+		t.Errorf("If-Modified-Since = %q", got)
+	}
+}
+
+func TestDownloadErrorResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{"json error body", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"code":401,"msg":"invalid key"}`))
+		}, "invalid key"},
+		{"unexpected status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}, "but got 403"},
+		// 未续传时不接受206
+		{"partial content without range", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+		}, "but got 206"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			_, err := downloadWithRetry(context.Background(), newDownloadTestConfig(), server.URL+"/db.bin", dbFileMeta{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		s         string
+		wantStart int64
+		wantSize  int64
+		wantErr   bool
+	}{
+		{"bytes 100-199/200", 100, 200, false},
+		{"bytes 100-199/*", 100, -1, false},
+		{"bytes 100-199", 0, 0, true},
+		{"bytes */200", 0, 0, true},
+		{"bytes 100-199/abc", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, size, err := parseContentRange(tt.s)
+		if (err != nil) != tt.wantErr || start != tt.wantStart || size != tt.wantSize {
+			t.Errorf("%q: got %d, %d, %v, want %d, %d, wantErr %v", tt.s, start, size, err, tt.wantStart, tt.wantSize, tt.wantErr)
+		}
+	}
+}
+
+func TestDownloadThrottled(t *testing.T) {
+	content := strings.Repeat("x", 30000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	// 令牌桶初始容量为每秒字节数，其余部分按限速下载
+	dsCfg := newDownloadTestConfig()
+	dsCfg.BandwidthLimit = 20000
+	start := time.Now()
+	part, err := downloadWithRetry(context.Background(), dsCfg, server.URL+"/db.bin", dbFileMeta{})
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("downloaded %d bytes in %s, want throttled to 20000 B/s", part.size, elapsed)
+	}
+	if b, _ := part.blob.bytes(); string(b) != content {
+		t.Errorf("content length = %d, want %d", len(b), len(content))
+	}
+}
+
+func TestDownloadBackoffCancelled(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	dsCfg := newDownloadTestConfig()
+	dsCfg.Retry = config.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, AttemptTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := downloadWithRetry(ctx, dsCfg, server.URL+"/db.bin", dbFileMeta{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s, want backoff cancelled", elapsed)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+}
@@ -0,0 +1,58 @@
+package model
+
+import "sync/atomic"
+
+// 离线库的一代数据，通过引用计数保证所有读者结束后才回收
+// 当前代自身持有一个引用，被替换时释放
+type generation[T any] struct {
+	value   T
+	refs    atomic.Int64
+	reclaim func(T)
+}
+
+func newGeneration[T any](value T, reclaim func(T)) *generation[T] {
+	g := &generation[T]{value: value, reclaim: reclaim}
+	g.refs.Store(1)
+	return g
+}
+
+// 引用计数已归零的代不可再获取
+func (g *generation[T]) tryAcquire() bool {
+	for {
+		n := g.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if g.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (g *generation[T]) release() {
+	if g.refs.Add(-1) == 0 && g.reclaim != nil {
+		g.reclaim(g.value)
+	}
+}
+
+// 指向当前代的指针
+type generationPtr[T any] struct {
+	cur atomic.Pointer[generation[T]]
+}
+
+// 获取当前代的引用，用完后需调用release；尚未加载时返回nil
+func (p *generationPtr[T]) acquire() *generation[T] {
+	for {
+		g := p.cur.Load()
+		if g == nil || g.tryAcquire() {
+			return g
+		}
+	}
+}
+
+// 切换到新的一代，旧代在所有读者释放后回收
+func (p *generationPtr[T]) store(g *generation[T]) {
+	if old := p.cur.Swap(g); old != nil {
+		old.release()
+	}
+}
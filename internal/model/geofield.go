@@ -0,0 +1,55 @@
+package model
+
+import (
+	"ip_geo/internal/utils"
+	"strconv"
+)
+
+// GeoInfo中可按名称读写的地理字段，名称与json名一致
+type geoField struct {
+	get func(info *GeoInfo) string
+	set func(info *GeoInfo, v string)
+}
+
+// 按GeoInfo中的定义顺序排列
+var geoFieldNames = []string{
+	"continent_code", "country", "country_code", "region", "city", "district", "area_code",
+	"isp", "isp_domain", "zip_code", "latitude", "longitude", "timezone",
+	"line", "asn", "asn_org", "idc", "station",
+}
+
+var geoFields = map[string]geoField{
+	"continent_code": {func(info *GeoInfo) string { return info.Continent }, func(info *GeoInfo, v string) { info.Continent = v }},
+	"country":        {func(info *GeoInfo) string { return info.Country }, func(info *GeoInfo, v string) { info.Country = v }},
+	"country_code":   {func(info *GeoInfo) string { return info.CountryCode }, func(info *GeoInfo, v string) { info.CountryCode = v }},
+	"region":         {func(info *GeoInfo) string { return info.Region }, func(info *GeoInfo, v string) { info.Region = v }},
+	"city":           {func(info *GeoInfo) string { return info.City }, func(info *GeoInfo, v string) { info.City = v }},
+	"district":       {func(info *GeoInfo) string { return info.District }, func(info *GeoInfo, v string) { info.District = v }},
+	"area_code":      {func(info *GeoInfo) string { return info.AreaCode }, func(info *GeoInfo, v string) { info.AreaCode = v }},
+	"isp":            {func(info *GeoInfo) string { return info.Isp }, func(info *GeoInfo, v string) { info.Isp = v }},
+	"isp_domain":     {func(info *GeoInfo) string { return info.IspDomain }, func(info *GeoInfo, v string) { info.IspDomain = v }},
+	"zip_code":       {func(info *GeoInfo) string { return info.ZipCode }, func(info *GeoInfo, v string) { info.ZipCode = v }},
+	"latitude":       {func(info *GeoInfo) string { return info.Latitude }, func(info *GeoInfo, v string) { info.Latitude = v }},
+	"longitude":      {func(info *GeoInfo) string { return info.Longitude }, func(info *GeoInfo, v string) { info.Longitude = v }},
+	"timezone":       {func(info *GeoInfo) string { return info.Timezone }, func(info *GeoInfo, v string) { info.Timezone = v }},
+	"line":           {func(info *GeoInfo) string { return info.Line }, func(info *GeoInfo, v string) { info.Line = v }},
+	"asn": {
+		func(info *GeoInfo) string {
+			if info.Asn == 0 {
+				return ""
+			}
+			return strconv.FormatUint(uint64(info.Asn), 10)
+		},
+		// 兼容"AS4134 CHINANET"等格式，组织名仅在为空时填充
+		func(info *GeoInfo, v string) {
+			asn, org := utils.ParseAsn(v)
+			info.Asn = asn
+			if info.AsnOrg == "" {
+				info.AsnOrg = org
+			}
+		},
+	},
+	"asn_org": {func(info *GeoInfo) string { return info.AsnOrg }, func(info *GeoInfo, v string) { info.AsnOrg = v }},
+	"idc":     {func(info *GeoInfo) string { return info.Idc }, func(info *GeoInfo, v string) { info.Idc = v }},
+	"station": {func(info *GeoInfo) string { return info.Station }, func(info *GeoInfo, v string) { info.Station = v }},
+}
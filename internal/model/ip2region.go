@@ -0,0 +1,348 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ip_geo/internal/config"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+var (
+	_ IpGeoHelper = (*Ip2RegionHelper)(nil)
+)
+
+// xdb缓存策略
+const (
+	XdbCachePolicyContent     = "content"     // 整个xdb文件载入内存
+	XdbCachePolicyVectorIndex = "vectorIndex" // 仅缓存向量索引，数据按需从文件读取
+)
+
+// xdb文件格式（小端）：
+// [0:256] 头部，其中[4:8]为生成时间的unix时间戳，[8:12]、[12:16]为首尾段索引的指针；[256:256+512KiB] 向量索引，256*256项，每项8字节：起始段索引指针(4)、结束段索引指针(4)；
+// 段索引每项14字节：起始IP(4)、结束IP(4)、数据长度(2)、数据指针(4)。
+const (
+	xdbHeaderInfoLength = 256
+	xdbHeaderCreatedAt  = 4
+	xdbHeaderStartIndex = 8
+	xdbHeaderEndIndex   = 12
+	xdbVectorIndexRows  = 256
+	xdbVectorIndexCols  = 256
+	xdbVectorIndexSize  = 8
+	xdbSegmentIndexSize = 14
+	xdbVectorIndexLen   = xdbVectorIndexRows * xdbVectorIndexCols * xdbVectorIndexSize
+)
+
+// 基于ip2region xdb离线库的查询助手，仅支持IPv4
+// 下载地址复用DataSyncConfig.DownloadUrl
+type Ip2RegionHelper struct {
+	dataset  *dbDataset
+	curDbPtr atomic.Pointer[xdbDb]
+	cfgPtr   *atomic.Pointer[config.Config]
+	version  atomic.Pointer[dbVersion]
+}
+
+func NewIp2RegionHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (*Ip2RegionHelper, error) {
+	helper := &Ip2RegionHelper{cfgPtr: cfgPtr}
+	dataset, err := newDbDataset(cfgPtr, ProviderIp2Region, "xdb", helper.dbFileRequests, helper.stageDbFiles, cluster)
+	if err != nil {
+		return nil, err
+	}
+	helper.dataset = dataset
+
+	return helper, nil
+}
+
+func (helper *Ip2RegionHelper) QueryGeo(ipAddr string) (resp *GeoInfo, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			resp, err = nil, fmt.Errorf("panic: %v", panicErr)
+		}
+	}()
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip")
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("ipv6 not supported by ip2region")
+	}
+
+	var str string
+	for {
+		db := helper.curDbPtr.Load()
+		if db == nil {
+			return nil, errors.New("xdb not loaded")
+		}
+		var closed bool
+		str, closed, err = db.getRecordStr(binary.BigEndian.Uint32(ip4))
+		if !closed { // 查询期间库被替换并关闭，则使用新库重试
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = parseXdbRecord(str)
+	if err != nil {
+		return nil, err
+	}
+	helper.version.Load().fill(resp)
+
+	return resp, nil
+}
+
+// 国家|区域|省份|城市|ISP，"0"表示缺失
+func parseXdbRecord(str string) (*GeoInfo, error) {
+	infos := strings.Split(str, "|")
+	if len(infos) < 5 {
+		return nil, fmt.Errorf("wrong number of record fields: %d, at least 5, but got: %s", len(infos), str)
+	}
+	for i := range infos {
+		if infos[i] == "0" {
+			infos[i] = ""
+		}
+	}
+
+	return &GeoInfo{
+		Country: infos[0],
+		Region:  infos[2],
+		City:    infos[3],
+		Isp:     infos[4],
+	}, nil
+}
+
+// 初始化db
+func (helper *Ip2RegionHelper) Init() error {
+	return helper.dataset.init()
+}
+
+// 清理
+func (helper *Ip2RegionHelper) Clean() error {
+	helper.dataset.clean()
+	if db := helper.curDbPtr.Load(); db != nil {
+		db.close()
+	}
+	return nil
+}
+
+func (helper *Ip2RegionHelper) dbFileRequests(cfg *config.Config) []dbFileRequest {
+	dsCfg := cfg.DataSyncConfig
+	return []dbFileRequest{{Url: dsCfg.DownloadUrl, Mirrors: dsCfg.Mirrors, EntrySuffix: ".xdb"}}
+}
+
+// 加载并检查xdb文件，通过后返回版本及切换函数，切换时关闭旧库
+func (helper *Ip2RegionHelper) stageDbFiles(files []dbFile) (version string, commit func(), err error) {
+	cfg := helper.cfgPtr.Load()
+	cachePolicy := XdbCachePolicyContent
+	if cfg.Ip2RegionConfig != nil && cfg.Ip2RegionConfig.CachePolicy != "" {
+		cachePolicy = cfg.Ip2RegionConfig.CachePolicy
+	}
+
+	db, err := loadXdbFile(&files[0], cachePolicy, cfg.DataSyncConfig.WorkDir)
+	if err != nil {
+		return "", nil, err
+	}
+	logx.Infof("finish load xdb file, cache policy: %s", cachePolicy)
+
+	// 做一次查询，来简单验证数据库是否正确
+	testIp := net.ParseIP("1.0.0.1").To4()
+	str, _, err := db.getRecordStr(binary.BigEndian.Uint32(testIp))
+	if err == nil && len(strings.Split(str, "|")) < 5 {
+		err = fmt.Errorf("wrong number of record fields: %d, at least 5, but got: %s", len(strings.Split(str, "|")), str)
+	}
+	if err != nil {
+		db.close()
+		return "", nil, err
+	}
+	logx.Infof("finish testing xdb, test ip: %s", testIp)
+
+	oldDb := helper.curDbPtr.Load()
+
+	version = datasetVersion(time.Unix(int64(db.createdAt), 0), files[0].Meta, files[0].Meta.FileHash)
+	var current *datasetProbe
+	if oldDb != nil {
+		probe := oldDb.probe()
+		current = &probe
+	}
+	if err = checkDatasetQuality(&cfg.DataSyncConfig.Quality, ProviderIp2Region, version, db.probe(), current); err != nil {
+		db.close()
+		return "", nil, err
+	}
+	commit = func() {
+		oldDb := helper.curDbPtr.Swap(db)
+		helper.version.Store(&dbVersion{version: version, loadTime: time.Now()})
+		if oldDb != nil {
+			oldDb.close()
+		}
+
+		logx.Infof("done refresh xdb, version: %v, source: %s", version, files[0].Meta.Source)
+	}
+	return version, commit, nil
+}
+
+// 加载xdb文件，content模式下直接解压到内存；
+// vectorIndex模式需按文件随机读取，解压到workDir下，保留文件直至库被关闭
+func loadXdbFile(file *dbFile, cachePolicy string, workDir string) (db *xdbDb, err error) {
+	db = &xdbDb{}
+	switch cachePolicy {
+	case XdbCachePolicyContent:
+		db.content, err = file.readAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(db.content) < xdbHeaderInfoLength+xdbVectorIndexLen {
+			return nil, fmt.Errorf("xdb file too small: %d bytes", len(db.content))
+		}
+		db.vectorIndex = db.content[xdbHeaderInfoLength : xdbHeaderInfoLength+xdbVectorIndexLen]
+		db.readHeader(db.content)
+	case XdbCachePolicyVectorIndex:
+		path, err := file.extract(workDir)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			removeFile(path)
+			return nil, err
+		}
+		header := make([]byte, xdbHeaderInfoLength)
+		db.vectorIndex = make([]byte, xdbVectorIndexLen)
+		if _, err = f.ReadAt(header, 0); err == nil {
+			_, err = f.ReadAt(db.vectorIndex, xdbHeaderInfoLength)
+		}
+		if err != nil {
+			f.Close()
+			removeFile(path)
+			return nil, fmt.Errorf("read xdb vector index failed: %v", err)
+		}
+		db.readHeader(header)
+		db.file = f
+		db.filepath = path
+	default:
+		return nil, fmt.Errorf("unknown xdb cache policy: %s", cachePolicy)
+	}
+
+	return db, nil
+}
+
+type xdbDb struct {
+	createdAt   uint32 // 头部中的生成时间
+	segments    int64  // 段索引数，即记录数
+	vectorIndex []byte
+	content     []byte   // content模式下为整个文件
+	file        *os.File // vectorIndex模式下按需读取段索引和数据
+	filepath    string
+	mu          sync.RWMutex // 保护file的关闭
+	closed      bool
+}
+
+func (p *xdbDb) readHeader(header []byte) {
+	p.createdAt = binary.LittleEndian.Uint32(header[xdbHeaderCreatedAt:])
+	start := binary.LittleEndian.Uint32(header[xdbHeaderStartIndex:])
+	end := binary.LittleEndian.Uint32(header[xdbHeaderEndIndex:])
+	if end >= start {
+		p.segments = int64(end-start)/xdbSegmentIndexSize + 1
+	}
+}
+
+// 参与质量检查的数据集，仅支持IPv4
+func (p *xdbDb) probe() datasetProbe {
+	return datasetProbe{
+		query: func(ip net.IP) (*GeoInfo, error) {
+			ip4 := ip.To4()
+			if ip4 == nil {
+				return nil, errors.New("ipv6 not supported by ip2region")
+			}
+			str, closed, err := p.getRecordStr(binary.BigEndian.Uint32(ip4))
+			if closed {
+				return nil, errors.New("xdb closed")
+			}
+			if err != nil {
+				return nil, err
+			}
+			return parseXdbRecord(str)
+		},
+		records: p.segments,
+	}
+}
+
+// 返回closed为true表示库已关闭，调用方需重新获取当前库
+func (p *xdbDb) getRecordStr(ip uint32) (str string, closed bool, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return "", true, nil
+	}
+
+	il0 := (ip >> 24) & 0xFF
+	il1 := (ip >> 16) & 0xFF
+	idx := il0*xdbVectorIndexCols*xdbVectorIndexSize + il1*xdbVectorIndexSize
+	sPtr := binary.LittleEndian.Uint32(p.vectorIndex[idx:])
+	ePtr := binary.LittleEndian.Uint32(p.vectorIndex[idx+4:])
+	if ePtr < sPtr {
+		return "", false, errors.New("not found")
+	}
+
+	buf := make([]byte, xdbSegmentIndexSize)
+	var dataLen, dataPtr uint32
+	l, h := 0, int((ePtr-sPtr)/xdbSegmentIndexSize)
+	for l <= h {
+		m := (l + h) >> 1
+		if err := p.read(int64(sPtr)+int64(m)*xdbSegmentIndexSize, buf); err != nil {
+			return "", false, err
+		}
+		if ip < binary.LittleEndian.Uint32(buf) {
+			h = m - 1
+		} else if ip > binary.LittleEndian.Uint32(buf[4:]) {
+			l = m + 1
+		} else {
+			dataLen = uint32(binary.LittleEndian.Uint16(buf[8:]))
+			dataPtr = binary.LittleEndian.Uint32(buf[10:])
+			break
+		}
+	}
+	if dataLen == 0 {
+		return "", false, errors.New("not found")
+	}
+
+	data := make([]byte, dataLen)
+	if err := p.read(int64(dataPtr), data); err != nil {
+		return "", false, err
+	}
+	return string(data), false, nil
+}
+
+func (p *xdbDb) read(offset int64, buf []byte) error {
+	if p.content != nil {
+		if offset < 0 || offset+int64(len(buf)) > int64(len(p.content)) {
+			return fmt.Errorf("xdb offset out of range: %d", offset)
+		}
+		copy(buf, p.content[offset:])
+		return nil
+	}
+	_, err := p.file.ReadAt(buf, offset)
+	return err
+}
+
+// 等待进行中的查询结束后关闭文件
+func (p *xdbDb) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.file != nil {
+		p.file.Close()
+		removeFile(p.filepath)
+	}
+}
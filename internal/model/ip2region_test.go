@@ -0,0 +1,225 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"ip_geo/internal/config"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testXdbSegment struct {
+	end    string // 起始IP为上一段的结束IP加1
+	region string
+}
+
+// 构造xdb文件，segments需升序且覆盖全部IPv4地址，与ip2region生成工具一样按/16拆分段
+func buildTestXdb(createdAt time.Time, segments []testXdbSegment) []byte {
+	var data bytes.Buffer
+	data.Write(make([]byte, xdbHeaderInfoLength+xdbVectorIndexLen))
+	le := func(b []byte, off int, v uint32) { binary.LittleEndian.PutUint32(b[off:], v) }
+
+	type entry struct {
+		start, end uint32
+		ptr        uint32
+		length     uint16
+	}
+	var entries []entry
+	var start uint32
+	for _, seg := range segments {
+		ptr, length := uint32(data.Len()), uint16(len(seg.region))
+		data.WriteString(seg.region)
+		end := netip.MustParseAddr(seg.end).As4()
+		endIp := binary.BigEndian.Uint32(end[:])
+		for s := start; ; {
+			e := min(s|0xFFFF, endIp)
+			entries = append(entries, entry{s, e, ptr, length})
+			if e == endIp {
+				break
+			}
+			s = e + 1
+		}
+		start = endIp + 1
+	}
+
+	b := data.Bytes()
+	indexStart := uint32(len(b))
+	for i, e := range entries {
+		idx := make([]byte, xdbSegmentIndexSize)
+		le(idx, 0, e.start)
+		le(idx, 4, e.end)
+		binary.LittleEndian.PutUint16(idx[8:], e.length)
+		le(idx, 10, e.ptr)
+		b = append(b, idx...)
+
+		ptr := indexStart + uint32(i)*xdbSegmentIndexSize
+		cell := xdbHeaderInfoLength + int(e.start>>16)*xdbVectorIndexSize
+		if i == 0 || entries[i-1].start>>16 != e.start>>16 {
+			le(b, cell, ptr)
+		}
+		le(b, cell+4, ptr)
+	}
+	le(b, 0, 2)
+	le(b, xdbHeaderCreatedAt, uint32(createdAt.Unix()))
+	le(b, xdbHeaderStartIndex, indexStart)
+	le(b, xdbHeaderEndIndex, indexStart+uint32(len(entries)-1)*xdbSegmentIndexSize)
+	return b
+}
+
+func newTestIp2RegionHelper(t *testing.T, cachePolicy string) *Ip2RegionHelper {
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{
+		DataSyncConfig:  &config.DataSyncConfig{WorkDir: t.TempDir()},
+		Ip2RegionConfig: &config.Ip2RegionConfig{CachePolicy: cachePolicy},
+	})
+	helper := &Ip2RegionHelper{cfgPtr: cfgPtr}
+	t.Cleanup(func() {
+		if db := helper.curDbPtr.Load(); db != nil {
+			db.close()
+		}
+	})
+	return helper
+}
+
+var testXdbCreatedAt = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+func testXdb(city string) []byte {
+	return buildTestXdb(testXdbCreatedAt, []testXdbSegment{
+		{"0.255.255.255", "0|0|0|内网IP|内网IP"},
+		{"1.0.0.255", "澳大利亚|0|0|0|0"},
+		{"1.0.1.255", "中国|0|福建省|福州市|电信"},
+		{"114.113.255.255", "中国|0|0|0|0"},
+		{"114.114.114.114", "中国|0|江苏省|" + city + "|电信"},
+		{"255.255.255.255", "0|0|0|0|0"},
+	})
+}
+
+func TestIp2RegionHelperQueryGeo(t *testing.T) {
+	for _, policy := range []string{XdbCachePolicyContent, XdbCachePolicyVectorIndex} {
+		t.Run(policy, func(t *testing.T) {
+			helper := newTestIp2RegionHelper(t, policy)
+			if _, err := helper.QueryGeo("1.0.0.1"); err == nil {
+				t.Fatal("expected error before first load")
+			}
+			version, commit, err := helper.stageDbFiles([]dbFile{testRawDbFile(testXdb("南京市"))})
+			if err != nil {
+				t.Fatalf("stage: %v", err)
+			}
+			commit()
+			// 版本取头部中的生成时间
+			if version != "2024-05-06T07:08:09Z" {
+				t.Errorf("version = %s", version)
+			}
+
+			tests := []struct {
+				ip   string
+				want GeoInfo
+			}{
+				// "0"表示缺失
+				{"1.0.0.0", GeoInfo{Country: "澳大利亚"}},
+				{"1.0.0.255", GeoInfo{Country: "澳大利亚"}},
+				{"1.0.1.0", GeoInfo{Country: "中国", Region: "福建省", City: "福州市", Isp: "电信"}},
+				// 跨越多个/16的段
+				{"100.100.100.100", GeoInfo{Country: "中国"}},
+				{"114.113.255.255", GeoInfo{Country: "中国"}},
+				{"114.114.0.0", GeoInfo{Country: "中国", Region: "江苏省", City: "南京市", Isp: "电信"}},
+				{"114.114.114.114", GeoInfo{Country: "中国", Region: "江苏省", City: "南京市", Isp: "电信"}},
+				{"114.114.114.115", GeoInfo{}},
+				{"::ffff:1.0.1.1", GeoInfo{Country: "中国", Region: "福建省", City: "福州市", Isp: "电信"}},
+			}
+			for _, tt := range tests {
+				info, err := helper.QueryGeo(tt.ip)
+				if err != nil {
+					t.Errorf("%s: %v", tt.ip, err)
+					continue
+				}
+				if info.DBVersion != version || info.DBLoadTime == "" {
+					t.Errorf("%s: version = %q, load time = %q", tt.ip, info.DBVersion, info.DBLoadTime)
+				}
+				info.DBVersion, info.DBLoadTime = "", ""
+				if !reflect.DeepEqual(*info, tt.want) {
+					t.Errorf("%s: info = %+v, want %+v", tt.ip, *info, tt.want)
+				}
+			}
+			if _, err = helper.QueryGeo("2400:3200::1"); err == nil {
+				t.Error("expected error for ipv6")
+			}
+			if _, err = helper.QueryGeo("1.0.0"); err == nil {
+				t.Error("expected error for invalid ip")
+			}
+		})
+	}
+}
+
+// vectorIndex模式下文件解压到WorkDir，切换后关闭旧库并删除其文件
+func TestIp2RegionHelperVectorIndexSwitch(t *testing.T) {
+	helper := newTestIp2RegionHelper(t, XdbCachePolicyVectorIndex)
+	workDir := helper.cfgPtr.Load().DataSyncConfig.WorkDir
+
+	_, commit, err := helper.stageDbFiles([]dbFile{testRawDbFile(testXdb("南京市"))})
+	if err != nil {
+		t.Fatalf("stage v1: %v", err)
+	}
+	commit()
+	first := helper.curDbPtr.Load()
+	if _, err = os.Stat(first.filepath); err != nil || !strings.HasPrefix(first.filepath, workDir) {
+		t.Fatalf("xdb file %s not in work dir: %v", first.filepath, err)
+	}
+
+	_, commit, err = helper.stageDbFiles([]dbFile{testRawDbFile(testXdb("苏州市"))})
+	if err != nil {
+		t.Fatalf("stage v2: %v", err)
+	}
+	// 切换前仍查询旧库
+	if info, _ := helper.QueryGeo("114.114.114.114"); info == nil || info.City != "南京市" {
+		t.Errorf("before commit: %+v", info)
+	}
+	commit()
+	if info, _ := helper.QueryGeo("114.114.114.114"); info == nil || info.City != "苏州市" {
+		t.Errorf("after commit: %+v", info)
+	}
+	if _, closed, _ := first.getRecordStr(0x01000001); !closed {
+		t.Error("old db not closed")
+	}
+	if _, err = os.Stat(first.filepath); !os.IsNotExist(err) {
+		t.Errorf("old xdb file not removed: %v", err)
+	}
+	entries, _ := os.ReadDir(workDir)
+	if len(entries) != 1 {
+		t.Errorf("work dir has %d files, want 1", len(entries))
+	}
+}
+
+func TestIp2RegionHelperStageErrors(t *testing.T) {
+	badRecord := buildTestXdb(testXdbCreatedAt, []testXdbSegment{{"255.255.255.255", "中国|江苏省"}})
+	tests := []struct {
+		name    string
+		policy  string
+		data    []byte
+		wantErr string
+	}{
+		{"content too small", XdbCachePolicyContent, make([]byte, xdbHeaderInfoLength), "xdb file too small"},
+		{"vector index too small", XdbCachePolicyVectorIndex, make([]byte, xdbHeaderInfoLength), "read xdb vector index failed"},
+		{"test ip record fields", XdbCachePolicyContent, badRecord, "wrong number of record fields"},
+		{"test ip record fields vector index", XdbCachePolicyVectorIndex, badRecord, "wrong number of record fields"},
+		{"unknown cache policy", "btree", testXdb("南京市"), "unknown xdb cache policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := newTestIp2RegionHelper(t, tt.policy)
+			_, _, err := helper.stageDbFiles([]dbFile{testRawDbFile(tt.data)})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+			// 失败时不保留解压的文件
+			if entries, _ := os.ReadDir(helper.cfgPtr.Load().DataSyncConfig.WorkDir); len(entries) != 0 {
+				t.Errorf("work dir has %d files after failed stage", len(entries))
+			}
+		})
+	}
+}
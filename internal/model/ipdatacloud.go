@@ -1,26 +1,17 @@
 package model
 
 import (
-	"archive/zip"
 	"bytes"
-	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"ip_geo/internal/config"
-	"ip_geo/internal/utils"
 	"net"
-	"net/http"
-	"os"
-	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
-	"github.com/go-co-op/gocron/v2"
 	"github.com/zeromicro/go-zero/core/logx"
 )
 
@@ -28,48 +19,82 @@ var (
 	_ IpGeoHelper = (*IpCloudDataHelper)(nil)
 )
 
+// 离线库按代管理：读者持有引用期间旧代不会被回收，
+// 回收后的缓冲区放入free供下一次加载复用
 type IpCloudDataHelper struct {
-	syncer    gocron.Scheduler
-	curDbPtr  atomic.Pointer[ipDataCloudDb]
-	newDbPtr  atomic.Pointer[ipDataCloudDb]
-	cfgPtr    *atomic.Pointer[config.Config]
-	version   atomic.Value
-	refreshMu sync.Mutex
+	dataset  *dbDataset
+	cur      generationPtr[*ipDataCloudSnapshot]
+	freeDb   atomic.Pointer[ipDataCloudDb]
+	freeDbV6 atomic.Pointer[ipDataCloudDbV6]
+	cfgPtr   *atomic.Pointer[config.Config]
 }
 
-func NewIpCloudDataHelper(cfgPtr *atomic.Pointer[config.Config]) (*IpCloudDataHelper, error) {
+// 离线库快照的元信息
+type DbSnapshot struct {
+	Version       string    `json:"version"`
+	SourceUrl     string    `json:"source_url"` // 实际下载的地址，可能为镜像
+	FileHash      string    `json:"file_hash"`  // 解压后文件的sha256
+	RecordCount   int       `json:"record_count"`
+	SourceUrlV6   string    `json:"source_url_v6,omitempty"`
+	FileHashV6    string    `json:"file_hash_v6,omitempty"`
+	RecordCountV6 int       `json:"record_count_v6,omitempty"`
+	LoadTime      time.Time `json:"load_time"`
+}
+
+// 加载完成后不可变，索引与元信息通过一次原子操作整体切换
+type ipDataCloudSnapshot struct {
+	DbSnapshot
+	db   *ipDataCloudDb
+	dbV6 *ipDataCloudDbV6 // 为nil表示未配置IPv6离线库
+}
+
+// 记录直接引用离线库缓冲区，需在释放引用前复制
+func (s *ipDataCloudSnapshot) lookup(ip net.IP) (string, *ipDataCloudLayout, error) {
+	var str string
+	var layout *ipDataCloudLayout
 	var err error
-	helper := &IpCloudDataHelper{}
-	syncer, err := gocron.NewScheduler(gocron.WithLocation(time.UTC))
+	if ip4 := ip.To4(); ip4 != nil {
+		str, err = s.db.getRecordStr(ip4)
+		layout = s.db.layout
+	} else {
+		if s.dbV6 == nil {
+			return "", nil, errors.New("ipv6 db not loaded")
+		}
+		str, err = s.dbV6.getRecordStr(ip)
+		layout = s.dbV6.layout
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.Clone(str), layout, nil
+}
+
+// 查询并解析记录，不含版本信息
+func (s *ipDataCloudSnapshot) query(ip net.IP) (*GeoInfo, error) {
+	str, layout, err := s.lookup(ip)
 	if err != nil {
 		return nil, err
 	}
-	cfg := cfgPtr.Load()
-	if cfg.DataSyncConfig.ForTest {
-		duration, err := time.ParseDuration(cfg.DataSyncConfig.RereshInterval)
-		if err != nil {
-			return nil, err
-		}
-		if duration < 5*time.Second {
-			return nil, fmt.Errorf("refresh interval less than 5 seconds: %s", cfg.DataSyncConfig.RereshInterval)
-		}
-		j, err := syncer.NewJob(gocron.DurationJob(duration), gocron.NewTask(helper.refreshDb))
-		if err != nil {
-			return nil, err
-		}
-		logx.Infof("refresh db job id for test: %s", j.ID())
-	} else {
-		j, err := syncer.NewJob(gocron.CronJob(cfg.DataSyncConfig.SyncCron, false),
-			gocron.NewTask(helper.refreshDb))
-		if err != nil {
+	return layout.parse(str)
+}
+
+// 参与质量检查的记录数为IPv4和IPv6之和
+func (s *ipDataCloudSnapshot) probe() datasetProbe {
+	return datasetProbe{query: s.query, records: int64(s.RecordCount + s.RecordCountV6)}
+}
+
+func NewIpCloudDataHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (*IpCloudDataHelper, error) {
+	if c := cfgPtr.Load().IpDataCloudConfig; c != nil {
+		if err := validateIpDataCloudFields(c.Fields); err != nil {
 			return nil, err
 		}
-		logx.Infof("refresh db job id: %s", j.ID())
 	}
-	helper.cfgPtr = cfgPtr
-	helper.syncer = syncer
-	helper.curDbPtr.Store(&ipDataCloudDb{data: new(bytes.Buffer)})
-	helper.newDbPtr.Store(&ipDataCloudDb{data: new(bytes.Buffer)})
+	helper := &IpCloudDataHelper{cfgPtr: cfgPtr}
+	dataset, err := newDbDataset(cfgPtr, ProviderIpDataCloud, "ip cloud data db", helper.dbFileRequests, helper.stageDbFiles, cluster)
+	if err != nil {
+		return nil, err
+	}
+	helper.dataset = dataset
 
 	return helper, nil
 }
@@ -80,288 +105,232 @@ func (helper *IpCloudDataHelper) QueryGeo(ipAddr string) (resp *GeoInfo, err err
 			resp, err = nil, fmt.Errorf("panic: %v", panicErr)
 		}
 	}()
-	str, err := helper.curDbPtr.Load().getRecordStr(ipAddr)
-	if err != nil {
-		return nil, err
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip")
 	}
 
-	infos := strings.Split(str, "|")
-	if len(infos) < 16 {
-		return nil, fmt.Errorf("wrong number of record fields: %d, at least 16, but got: %s", len(infos), str)
-	}
-	ips := &ipDataCloudGeoInfo{
-		Continent:   infos[0],  //洲
-		Country:     infos[1],  //国家/地区
-		Province:    infos[2],  //省份
-		City:        infos[3],  //城市
-		Line:        infos[4],  //线路
-		Isp:         infos[5],  //运营商
-		AreaCode:    infos[6],  //区域代码
-		CountryCode: infos[7],  //国家/地区英文简写
-		Longitude:   infos[8],  //经度
-		Latitude:    infos[9],  //纬度
-		ZipCode:     infos[10], //邮编
-		Asn:         infos[11], //asn
-		Domain:      infos[12], //运营商域名
-		Idc:         infos[13], //idc
-		Station:     infos[14], //基站
-		TimeZone:    infos[15], //时区
-	}
-
-	resp = &GeoInfo{
-		DBVersion:   helper.version.Load().(string),
-		Continent:   utils.GetContinentCodeByName(ips.Continent),
-		Country:     ips.Country,
-		CountryCode: ips.CountryCode,
-		Region:      ips.Province,
-		City:        ips.City,
-		AreaCode:    ips.AreaCode,
-		Isp:         ips.Isp,
-		IspDomain:   ips.Domain,
-		ZipCode:     ips.ZipCode,
-		Latitude:    ips.Latitude,
-		Longitude:   ips.Longitude,
-		Timezone:    ips.TimeZone,
+	gen := helper.cur.acquire()
+	if gen == nil {
+		return nil, errors.New("db not loaded")
 	}
+	defer gen.release()
+
+	// 按地址族选择离线库，每个库有各自的记录布局
+	resp, err = gen.value.query(ip)
+	if err != nil {
+		return nil, err
+	}
+	resp.DBVersion = gen.value.Version
+	resp.DBLoadTime = gen.value.LoadTime.Format(time.RFC3339)
 
 	return resp, nil
 }
 
-// 初始化db
-func (helper *IpCloudDataHelper) Init() error {
-	err := helper.doRefreshDb() // 先同步一次
-	if err != nil {
-		return err
+// 当前快照的元信息，尚未加载时返回nil
+func (helper *IpCloudDataHelper) Snapshot() *DbSnapshot {
+	gen := helper.cur.cur.Load()
+	if gen == nil {
+		return nil
 	}
+	snap := gen.value.DbSnapshot
+	return &snap
+}
 
-	helper.syncer.Start() // 启动定时刷新
-	return nil
+// 初始化db
+func (helper *IpCloudDataHelper) Init() error {
+	return helper.dataset.init()
 }
 
 // 清理
 func (helper *IpCloudDataHelper) Clean() error {
-	err := helper.syncer.Shutdown()
-	if err != nil {
-		logx.Errorf("shutdown refresh job failed: %v", err)
-	}
+	helper.dataset.clean()
 	return nil
 }
 
-func (helper *IpCloudDataHelper) refreshDb() {
-	err := helper.doRefreshDb()
-	if err != nil {
-		logx.Errorf("error refreshing ip cloud data db: %v", err)
+// IPv6离线库为可选项
+func (helper *IpCloudDataHelper) dbFileRequests(cfg *config.Config) []dbFileRequest {
+	dsCfg := cfg.DataSyncConfig
+	reqs := []dbFileRequest{{Url: dsCfg.DownloadUrl, Mirrors: dsCfg.Mirrors}}
+	if dsCfg.DownloadUrlV6 != "" {
+		reqs = append(reqs, dbFileRequest{Url: dsCfg.DownloadUrlV6, Mirrors: dsCfg.MirrorsV6})
 	}
+	return reqs
 }
 
-func (helper *IpCloudDataHelper) doRefreshDb() (err error) {
-	helper.refreshMu.Lock()
-	defer helper.refreshMu.Unlock()
-	logx.Infof("begin refreshing ip cloud data db")
-	defer func() {
-		if panicErr := recover(); panicErr != nil {
-			err = fmt.Errorf("%v", panicErr)
-		}
-	}()
-
-	var filepath string
-
-	for i := 0; i < 2; i++ { // 下载错误，则重试一次
-		filepath, err = helper.downloadOfflineDb(helper.cfgPtr.Load().DataSyncConfig.DownloadUrl)
-		if err == nil {
-			break
-		}
+// 加载并检查一组离线库文件，通过后返回版本及切换为当前快照的函数，切换前不影响当前快照
+func (helper *IpCloudDataHelper) stageDbFiles(files []dbFile) (version string, commit func(), err error) {
+	dsCfg := helper.cfgPtr.Load().DataSyncConfig
+	var layoutFields []string
+	if c := helper.cfgPtr.Load().IpDataCloudConfig; c != nil {
+		layoutFields = c.Fields
 	}
-	if err != nil {
-		return err
-	}
-	logx.Infof("finish downloading ip data cloud db, path: %s", filepath)
 
-	uncompFilepath, err := helper.uncompressDbFile(filepath)
+	db, err := helper.loadFile(&files[0])
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	logx.Infof("finish uncompressing ip data cloud db, path: %s", uncompFilepath)
-
-	db, err := helper.loadFile(uncompFilepath)
+	// 切换前失败，新加载的缓冲区没有读者，可直接回收
+	defer func() {
+		if err != nil {
+			helper.freeDb.Store(db)
+		}
+	}()
+	db.layout, err = detectIpDataCloudLayout(db.addrArr, layoutFields)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	logx.Infof("finish load ip data cloud db file")
+	logx.Infof("finish load ip data cloud db file, layout: %s", db.layout.name)
 
 	// 做一次查询，来简单验证数据库是否正确
-	testIp := "10.0.0.1"
+	testIp := net.ParseIP("114.114.114.114").To4() // 使用公网地址，特殊地址不依赖离线库
 	str, err := db.getRecordStr(testIp)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	if n := len(strings.Split(str, "|")); n < 16 {
-		return fmt.Errorf("wrong number of record fields: %d, at least 16, but got: %s", n, str)
+	if _, err = db.layout.parse(str); err != nil {
+		return "", nil, err
 	}
 	logx.Infof("finish testing ip data cloud db, test ip: %s", testIp)
 
-	oldDbPtr := helper.curDbPtr.Load()
-
-	version := time.Now().Format(time.DateOnly)
-	helper.version.Store(version)
-	helper.curDbPtr.Store(db)
-	helper.newDbPtr.Store(oldDbPtr)
+	var dbV6 *ipDataCloudDbV6
+	if len(files) > 1 {
+		dbV6, err = helper.loadFileV6(&files[1])
+		if err != nil {
+			return "", nil, err
+		}
+		defer func() {
+			if err != nil {
+				helper.freeDbV6.Store(dbV6)
+			}
+		}()
+		dbV6.layout, err = detectIpDataCloudLayout(dbV6.addrArr, layoutFields)
+		if err != nil {
+			return "", nil, err
+		}
+		logx.Infof("finish load ip data cloud ipv6 db file, layout: %s", dbV6.layout.name)
 
-	// 删除下载文件
-	err = os.Remove(filepath)
-	if err != nil {
-		logx.Errorf("remove downloaded file failed, path: %s", filepath)
+		testIpV6 := net.ParseIP("2400:3200::1")
+		str, err = dbV6.getRecordStr(testIpV6)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err = dbV6.layout.parse(str); err != nil {
+			return "", nil, err
+		}
+		logx.Infof("finish testing ip data cloud ipv6 db, test ip: %s", testIpV6)
 	}
 
-	// 删除解压文件
-	err = os.Remove(uncompFilepath)
-	if err != nil {
-		logx.Errorf("remove uncompressed file failed, path: %s", uncompFilepath)
+	// 离线库文件头不含版本信息，版本取自IPv4库的下载信息或内容哈希
+	meta := files[0].Meta
+	snap := &ipDataCloudSnapshot{
+		DbSnapshot: DbSnapshot{
+			Version:     datasetVersion(time.Time{}, meta, meta.FileHash),
+			SourceUrl:   meta.Source,
+			FileHash:    meta.FileHash,
+			RecordCount: len(db.addrArr),
+			LoadTime:    time.Now(),
+		},
+		db:   db,
+		dbV6: dbV6,
 	}
-
-	logx.Infof("done refresh ip cloud data db, version: %v", helper.version.Load().(string))
-
-	return nil
-}
-
-func (helper *IpCloudDataHelper) downloadOfflineDb(fileUri string) (filepath string, err error) {
-	ctx, cf := context.WithTimeout(context.Background(), 30*time.Minute) // 设置最长下载时长为30min
-	defer cf()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUri, nil)
-	if err != nil {
-		return "", err
+	if dbV6 != nil {
+		snap.SourceUrlV6 = files[1].Meta.Source
+		snap.FileHashV6 = files[1].Meta.FileHash
+		snap.RecordCountV6 = len(dbV6.addrArr)
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+
+	var current *datasetProbe
+	if gen := helper.cur.acquire(); gen != nil {
+		defer gen.release()
+		probe := gen.value.probe()
+		current = &probe
 	}
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("download file failed, fileUri: %v, expected status code 200, but got %d", fileUri, resp.StatusCode)
+	if err = checkDatasetQuality(&dsCfg.Quality, ProviderIpDataCloud, snap.Version, snap.probe(), current); err != nil {
+		return "", nil, err
 	}
 
-	// 如果返回json格式，则报错了
-	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "application/json") {
-		b := new(bytes.Buffer)
-		io.Copy(b, resp.Body)
-		resp.Body.Close()
-		return "", fmt.Errorf("download file failed, fileUri: %v, resp body: %s", fileUri, b.String())
-	}
+	commit = func() {
+		helper.swapSnapshot(snap)
 
-	// 创建一个临时文件
-	f, err := os.CreateTemp("", "*")
-	if err != nil {
-		return "", err
+		logx.Infof("done refresh ip cloud data db, version: %s, records: %d, hash: %s, source: %s",
+			snap.Version, snap.RecordCount, snap.FileHash, snap.SourceUrl)
 	}
-	// 将下载文件拷贝到临时文件中
-	_, err = io.Copy(f, resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		f.Close()
-		os.Remove(f.Name())
-		return "", err
-	}
-	f.Close()
-	filepath = f.Name()
-	return filepath, nil
+	return snap.Version, commit, nil
 }
 
-// 解压zip格式的原始文件
-func (helper *IpCloudDataHelper) uncompressDbFile(compressedFilepath string) (uncompressedFilepath string, err error) {
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(compressedFilepath)
-	if err != nil {
-		return "", err
-	}
-	defer r.Close()
-
-	if len(r.File) == 0 {
-		return "", errors.New("no file in zip")
-	}
+// 切换到新快照，旧快照在最后一个读者释放后回收其缓冲区
+func (helper *IpCloudDataHelper) swapSnapshot(snap *ipDataCloudSnapshot) {
+	helper.cur.store(newGeneration(snap, func(old *ipDataCloudSnapshot) {
+		helper.freeDb.Store(old.db)
+		if old.dbV6 != nil {
+			helper.freeDbV6.Store(old.dbV6)
+		}
+	}))
+}
 
-	// 应该只有一个文件
-	f := r.File[0]
-	rc, err := f.Open()
+func (helper *IpCloudDataHelper) loadFile(file *dbFile) (*ipDataCloudDb, error) {
+	rc, err := file.open()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rc.Close()
 
-	newFile, err := os.CreateTemp("", "*")
-	if err != nil {
-		return "", err
-	}
-	defer newFile.Close()
-
-	_, err = io.Copy(newFile, rc)
-	if err != nil {
-		return "", err
-	}
-
-	return newFile.Name(), nil
+	return helper.loadDb(rc, file.Meta.FileSize)
 }
 
-// 需要保证文件的完整性，任何解析都可能出错
-func (helper *IpCloudDataHelper) loadFile(file string) (*ipDataCloudDb, error) {
-	unpackInt4byte := func(a, b, c, d byte) uint32 {
-		return (uint32(a) & 0xFF) | ((uint32(b) << 8) & 0xFF00) | ((uint32(c) << 16) & 0xFF0000) | ((uint32(d) << 24) & 0xFF000000)
+// 读入并解析，格式错误时返回*DbFormatError；优先复用已回收的缓冲区
+// size为预估的文件大小，用于一次分配缓冲区，未知时为0
+func (helper *IpCloudDataHelper) loadDb(r io.Reader, size int64) (*ipDataCloudDb, error) {
+	p := helper.freeDb.Swap(nil)
+	if p == nil {
+		p = &ipDataCloudDb{data: new(bytes.Buffer)}
 	}
 
-	var err error
-
-	p := helper.newDbPtr.Load()
-	f, err := os.Open(file)
+	p.data.Reset()
+	p.data.Grow(int(size) + bytes.MinRead)
+	_, err := io.Copy(p.data, r)
+	if err == nil {
+		err = parseIpDataCloudV4(p.data.Bytes(), p)
+	}
 	if err != nil {
+		helper.freeDb.Store(p)
 		return nil, err
 	}
-	defer f.Close()
+	return p, nil
+}
 
-	p.data.Reset()
-	_, err = io.Copy(p.data, f)
+func (helper *IpCloudDataHelper) loadFileV6(file *dbFile) (*ipDataCloudDbV6, error) {
+	rc, err := file.open()
 	if err != nil {
 		return nil, err
 	}
-	data := p.data.Bytes()
-
-	for k := 0; k < 256; k++ {
-		i := k*8 + 4
-		p.prefStart[k] = unpackInt4byte(data[i], data[i+1], data[i+2], data[i+3])
-		p.prefEnd[k] = unpackInt4byte(data[i+4], data[i+5], data[i+6], data[i+7])
-	}
+	defer rc.Close()
 
-	RecordSize := int(unpackInt4byte(data[0], data[1], data[2], data[3]))
+	return helper.loadDbV6(rc, file.Meta.FileSize)
+}
 
-	p.endArr = p.endArr[:0]
-	p.addrArr = p.addrArr[:0]
-	for i := 0; i < RecordSize; i++ {
-		j := 2052 + (i * 9)
-		endipnum := unpackInt4byte(data[j], data[1+j], data[2+j], data[3+j])
-		offset := unpackInt4byte(data[4+j], data[5+j], data[6+j], data[7+j])
-		length := uint32(data[8+j])
-		p.endArr = append(p.endArr, endipnum)
-		buf := data[offset:int(offset+length)]
-		p.addrArr = append(p.addrArr, unsafe.String(unsafe.SliceData(buf), len(buf)))
+// ipdatacloud IPv6离线库格式（小端）：
+// [0:4] 记录数，[4:8] 前缀索引数；
+// 前缀索引，每项12字节：起始记录下标(4)、结束记录下标(4)、前缀(4，即地址第一段16位)；
+// 记录，每项55字节：结束IP的十进制字符串(50，不足补0x00)、偏移(4)、长度(1)。
+func (helper *IpCloudDataHelper) loadDbV6(r io.Reader, size int64) (*ipDataCloudDbV6, error) {
+	p := helper.freeDbV6.Swap(nil)
+	if p == nil {
+		p = &ipDataCloudDbV6{data: new(bytes.Buffer)}
 	}
 
-	return p, err
-}
-
-type ipDataCloudGeoInfo struct {
-	Continent   string `json:"continent"`    //洲
-	Country     string `json:"country"`      //国家/地区
-	Province    string `json:"province"`     //省份
-	City        string `json:"city"`         //城市
-	Line        string `json:"line"`         //线路
-	Isp         string `json:"isp"`          //运营商
-	AreaCode    string `json:"area_code"`    //区域代码
-	CountryCode string `json:"country_code"` //国家/地区英文简写
-	Longitude   string `json:"longitude"`    //经度
-	Latitude    string `json:"latitude"`     //纬度
-	ZipCode     string `json:"zip_code"`     //邮编
-	Asn         string `json:"asn"`          //asn
-	Domain      string `json:"domain"`       //运营商域名
-	Idc         string `json:"idc"`          //idc
-	Station     string `json:"station"`      //基站
-	TimeZone    string `json:"time_zone"`    //时区
+	p.data.Reset()
+	p.data.Grow(int(size) + bytes.MinRead)
+	_, err := io.Copy(p.data, r)
+	if err == nil {
+		err = parseIpDataCloudV6(p.data.Bytes(), p)
+	}
+	if err != nil {
+		helper.freeDbV6.Store(p)
+		return nil, err
+	}
+	return p, nil
 }
 
 type ipDataCloudDb struct {
@@ -370,19 +339,13 @@ type ipDataCloudDb struct {
 	endArr    []uint32
 	addrArr   []string
 	data      *bytes.Buffer
+	layout    *ipDataCloudLayout
 }
 
-func (p *ipDataCloudDb) getRecordStr(ip string) (string, error) {
-	ips := strings.Split(ip, ".")
-	x, err := strconv.Atoi(ips[0])
-	if err != nil {
-		return "", err
-	}
-	prefix := uint32(x)
-	intIP, err := p.ipToInt(ip)
-	if err != nil {
-		return "", err
-	}
+// ip需为4字节形式
+func (p *ipDataCloudDb) getRecordStr(ip net.IP) (string, error) {
+	prefix := uint32(ip[0])
+	intIP := binary.BigEndian.Uint32(ip)
 
 	low := p.prefStart[prefix]
 	high := p.prefEnd[prefix]
@@ -393,7 +356,7 @@ func (p *ipDataCloudDb) getRecordStr(ip string) (string, error) {
 	} else {
 		cur = p.search(low, high, intIP)
 	}
-	if cur == 100000000 {
+	if cur == ipDataCloudNoRecord {
 		return "", errors.New("not found")
 	} else {
 		return p.addrArr[cur], nil
@@ -419,11 +382,77 @@ func (p *ipDataCloudDb) search(low uint32, high uint32, k uint32) uint32 {
 	return M
 }
 
-func (p *ipDataCloudDb) ipToInt(ipstr string) (uint32, error) {
-	ip := net.ParseIP(ipstr)
+type ipDataCloudDbV6 struct {
+	prefStart map[uint32]uint32
+	prefEnd   map[uint32]uint32
+	endArr    []uint128
+	addrArr   []string
+	data      *bytes.Buffer
+	layout    *ipDataCloudLayout
+}
+
+func (p *ipDataCloudDbV6) getRecordStr(ip net.IP) (string, error) {
+	ip = ip.To16()
 	if ip == nil {
-		return 0, errors.New("invalid ip")
+		return "", errors.New("invalid ip")
+	}
+	prefix := uint32(binary.BigEndian.Uint16(ip))
+	intIP := newUint128(ip)
+
+	low, ok := p.prefStart[prefix]
+	if !ok || low == ipDataCloudNoRecord {
+		return "", errors.New("not found")
+	}
+	high := p.prefEnd[prefix]
+
+	var cur uint32
+	if low == high {
+		cur = low
+	} else {
+		cur = p.search(low, high, intIP)
+	}
+	return p.addrArr[cur], nil
+}
+
+func (p *ipDataCloudDbV6) search(low uint32, high uint32, k uint128) uint32 {
+	var M uint32 = 0
+	for low <= high {
+		mid := (low + high) / 2
+		endipNum := p.endArr[mid]
+		if endipNum.cmp(k) >= 0 {
+			M = mid
+			if mid == 0 {
+				break
+			}
+			high = mid - 1
+		} else {
+			low = mid + 1
+		}
 	}
-	ip = ip.To4()
-	return binary.BigEndian.Uint32(ip), nil
+
+	return M
+}
+
+// 128位无符号整数，用于比较IPv6地址
+type uint128 struct {
+	hi, lo uint64
+}
+
+// b为16字节大端表示
+func newUint128(b []byte) uint128 {
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:16])}
+}
+
+func (u uint128) cmp(v uint128) int {
+	switch {
+	case u.hi < v.hi:
+		return -1
+	case u.hi > v.hi:
+		return 1
+	case u.lo < v.lo:
+		return -1
+	case u.lo > v.lo:
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"ip_geo/internal/utils"
+	"strings"
+)
+
+// ipdatacloud记录为"|"分隔的字段，不同套餐的字段布局不同，按字段名映射到geoFields
+// 与geoFields名称不同的字段，名称相同的不必列出
+var ipDataCloudFieldAliases = map[string]string{
+	"continent": "continent_code", //洲
+	"province":  "region",         //省份
+	"domain":    "isp_domain",     //运营商域名
+	"time_zone": "timezone",       //时区
+}
+
+// 取值需要转换的字段
+var ipDataCloudFieldConverters = map[string]func(v string) string{
+	"continent": utils.GetContinentCodeByName, // 洲为中文名，转为代码
+}
+
+// 字段名对应的写入函数，未知字段返回false
+func ipDataCloudFieldSetter(field string) (func(info *GeoInfo, v string), bool) {
+	name := field
+	if alias, ok := ipDataCloudFieldAliases[field]; ok {
+		name = alias
+	}
+	f, ok := geoFields[name]
+	if !ok {
+		return nil, false
+	}
+	if convert, ok := ipDataCloudFieldConverters[field]; ok {
+		return func(info *GeoInfo, v string) { f.set(info, convert(v)) }, true
+	}
+	return f.set, true
+}
+
+// 已知的记录布局，自动识别时按字段数匹配
+var ipDataCloudKnownLayouts = []*ipDataCloudLayout{
+	// 标准版
+	newIpDataCloudLayout("standard", []string{
+		"continent", "country", "province", "city", "line", "isp", "area_code", "country_code",
+		"longitude", "latitude", "zip_code", "asn", "domain", "idc", "station", "time_zone",
+	}),
+	// 区县级，在城市后增加区县
+	newIpDataCloudLayout("district", []string{
+		"continent", "country", "province", "city", "district", "line", "isp", "area_code", "country_code",
+		"longitude", "latitude", "zip_code", "asn", "domain", "idc", "station", "time_zone",
+	}),
+}
+
+// 用于识别布局的采样记录数
+const ipDataCloudLayoutSamples = 1000
+
+type ipDataCloudLayout struct {
+	name    string
+	fields  []string                        // 各位置的字段名，空串或"-"表示忽略该位置
+	setters []func(info *GeoInfo, v string) // 与fields对应，忽略的位置为nil
+}
+
+func newIpDataCloudLayout(name string, fields []string) *ipDataCloudLayout {
+	l := &ipDataCloudLayout{name: name, fields: fields, setters: make([]func(info *GeoInfo, v string), len(fields))}
+	for i, field := range fields {
+		l.setters[i], _ = ipDataCloudFieldSetter(field)
+	}
+	return l
+}
+
+// 将记录解析为GeoInfo，多出的字段忽略
+func (l *ipDataCloudLayout) parse(str string) (*GeoInfo, error) {
+	infos := strings.Split(str, "|")
+	if len(infos) < len(l.fields) {
+		return nil, fmt.Errorf("wrong number of record fields: %d, at least %d for layout %s, but got: %s",
+			len(infos), len(l.fields), l.name, str)
+	}
+	info := &GeoInfo{}
+	for i, setter := range l.setters {
+		if setter != nil {
+			setter(info, infos[i])
+		}
+	}
+	return info, nil
+}
+
+// 校验配置的字段布局
+func validateIpDataCloudFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := ipDataCloudFieldSetter(field); !ok && field != "" && field != "-" {
+			return fmt.Errorf("unknown ip data cloud field: %s", field)
+		}
+	}
+	return nil
+}
+
+// 识别记录布局：配置了fields时使用配置的布局，否则对记录均匀采样，按最常见的字段数匹配已知布局
+func detectIpDataCloudLayout(records []string, fields []string) (*ipDataCloudLayout, error) {
+	if len(records) == 0 {
+		return nil, errors.New("no record in ip data cloud db")
+	}
+
+	counts := make(map[int]int)
+	step := len(records)/ipDataCloudLayoutSamples + 1
+	for i := 0; i < len(records); i += step {
+		counts[strings.Count(records[i], "|")+1]++
+	}
+	n, maxCount := 0, 0
+	for k, v := range counts {
+		if v > maxCount || (v == maxCount && k > n) {
+			n, maxCount = k, v
+		}
+	}
+
+	if len(fields) > 0 {
+		if n < len(fields) {
+			return nil, fmt.Errorf("wrong number of record fields: %d, at least %d for configured layout", n, len(fields))
+		}
+		return newIpDataCloudLayout("configured", fields), nil
+	}
+	for _, l := range ipDataCloudKnownLayouts {
+		if len(l.fields) == n {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown ip data cloud record layout with %d fields, please configure IpDataCloudConfig.Fields", n)
+}
@@ -0,0 +1,181 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"unsafe"
+)
+
+// ipdatacloud IPv4离线库格式（小端）：
+// [0:4] 记录数；[4:2052] 按首字节的前缀索引，256项，每项8字节：起始记录下标(4)、结束记录下标(4)；
+// 记录，每项9字节：结束IP(4)、偏移(4)、长度(1)。
+const (
+	ipDataCloudV4HeaderSize     = 4 + 256*8
+	ipDataCloudV4RecordSize     = 9
+	ipDataCloudV6HeaderSize     = 8
+	ipDataCloudV6PrefixSize     = 12
+	ipDataCloudV6RecordSize     = 55
+	ipDataCloudV6EndIpSize      = 50
+	ipDataCloudNoRecord         = 100000000 // 前缀索引中表示该前缀下没有记录
+	ipDataCloudFormatErrNoIndex = -1
+)
+
+// 离线库文件格式错误
+const (
+	DbFilePartHeader      = "header"       // 文件头
+	DbFilePartPrefixIndex = "prefix_index" // 前缀索引
+	DbFilePartRecordIndex = "record_index" // 记录索引
+	DbFilePartRecord      = "record"       // 记录内容
+)
+
+// 离线库文件格式错误，指出文件中出错的部分
+type DbFormatError struct {
+	Part   string // 出错的部分，见DbFilePart*
+	Index  int    // 出错的项下标，-1表示不适用
+	Offset int    // 出错的位置在文件中的偏移
+	Reason string
+}
+
+func (e *DbFormatError) Error() string {
+	if e.Index == ipDataCloudFormatErrNoIndex {
+		return fmt.Sprintf("bad db file %s at offset %d: %s", e.Part, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("bad db file %s %d at offset %d: %s", e.Part, e.Index, e.Offset, e.Reason)
+}
+
+func newDbFormatError(part string, index int, offset int, format string, args ...any) *DbFormatError {
+	return &DbFormatError{Part: part, Index: index, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// 解析IPv4离线库，校验所有长度、下标和偏移，任何输入都不会panic
+// addrArr中的字符串直接引用data，data在db使用期间不可修改
+func parseIpDataCloudV4(data []byte, p *ipDataCloudDb) error {
+	if len(data) < ipDataCloudV4HeaderSize {
+		return newDbFormatError(DbFilePartHeader, ipDataCloudFormatErrNoIndex, 0,
+			"file size %d less than header size %d", len(data), ipDataCloudV4HeaderSize)
+	}
+
+	recordSize := int(binary.LittleEndian.Uint32(data))
+	if (len(data)-ipDataCloudV4HeaderSize)/ipDataCloudV4RecordSize < recordSize {
+		return newDbFormatError(DbFilePartHeader, ipDataCloudFormatErrNoIndex, 0,
+			"record count %d exceeds file size %d", recordSize, len(data))
+	}
+
+	for k := 0; k < 256; k++ {
+		i := 4 + k*8
+		start := binary.LittleEndian.Uint32(data[i:])
+		end := binary.LittleEndian.Uint32(data[i+4:])
+		if err := checkPrefixRange(start, end, recordSize); err != nil {
+			return newDbFormatError(DbFilePartPrefixIndex, k, i, "%s", err)
+		}
+		p.prefStart[k] = start
+		p.prefEnd[k] = end
+	}
+
+	p.endArr = p.endArr[:0]
+	p.addrArr = p.addrArr[:0]
+	for i := 0; i < recordSize; i++ {
+		j := ipDataCloudV4HeaderSize + i*ipDataCloudV4RecordSize
+		endipnum := binary.LittleEndian.Uint32(data[j:])
+		if i > 0 && endipnum < p.endArr[i-1] {
+			return newDbFormatError(DbFilePartRecordIndex, i, j, "end ip %d less than previous %d", endipnum, p.endArr[i-1])
+		}
+		offset := int(binary.LittleEndian.Uint32(data[j+4:]))
+		length := int(data[j+8])
+		buf, err := recordBytes(data, offset, length)
+		if err != nil {
+			return newDbFormatError(DbFilePartRecord, i, j, "%s", err)
+		}
+		p.endArr = append(p.endArr, endipnum)
+		p.addrArr = append(p.addrArr, buf)
+	}
+
+	return nil
+}
+
+// 解析IPv6离线库，格式见loadFileV6
+func parseIpDataCloudV6(data []byte, p *ipDataCloudDbV6) error {
+	if len(data) < ipDataCloudV6HeaderSize {
+		return newDbFormatError(DbFilePartHeader, ipDataCloudFormatErrNoIndex, 0,
+			"file size %d less than header size %d", len(data), ipDataCloudV6HeaderSize)
+	}
+
+	recordSize := int(binary.LittleEndian.Uint32(data))
+	prefixSize := int(binary.LittleEndian.Uint32(data[4:]))
+	if (len(data)-ipDataCloudV6HeaderSize)/ipDataCloudV6PrefixSize < prefixSize {
+		return newDbFormatError(DbFilePartHeader, ipDataCloudFormatErrNoIndex, 4,
+			"prefix count %d exceeds file size %d", prefixSize, len(data))
+	}
+	recordStart := ipDataCloudV6HeaderSize + prefixSize*ipDataCloudV6PrefixSize
+	if (len(data)-recordStart)/ipDataCloudV6RecordSize < recordSize {
+		return newDbFormatError(DbFilePartHeader, ipDataCloudFormatErrNoIndex, 0,
+			"record count %d exceeds file size %d", recordSize, len(data))
+	}
+
+	p.prefStart = make(map[uint32]uint32, prefixSize)
+	p.prefEnd = make(map[uint32]uint32, prefixSize)
+	for k := 0; k < prefixSize; k++ {
+		i := ipDataCloudV6HeaderSize + k*ipDataCloudV6PrefixSize
+		start := binary.LittleEndian.Uint32(data[i:])
+		end := binary.LittleEndian.Uint32(data[i+4:])
+		prefix := binary.LittleEndian.Uint32(data[i+8:])
+		if prefix > 0xFFFF {
+			return newDbFormatError(DbFilePartPrefixIndex, k, i, "prefix %d exceeds 16 bits", prefix)
+		}
+		if err := checkPrefixRange(start, end, recordSize); err != nil {
+			return newDbFormatError(DbFilePartPrefixIndex, k, i, "%s", err)
+		}
+		p.prefStart[prefix] = start
+		p.prefEnd[prefix] = end
+	}
+
+	p.endArr = p.endArr[:0]
+	p.addrArr = p.addrArr[:0]
+	n := new(big.Int)
+	endip := make([]byte, 16)
+	for i := 0; i < recordSize; i++ {
+		j := recordStart + i*ipDataCloudV6RecordSize
+		endipStr := string(bytes.TrimRight(data[j:j+ipDataCloudV6EndIpSize], "\x00"))
+		if _, ok := n.SetString(endipStr, 10); !ok || n.Sign() < 0 || n.BitLen() > 128 {
+			return newDbFormatError(DbFilePartRecordIndex, i, j, "invalid end ip %q", endipStr)
+		}
+		endipnum := newUint128(n.FillBytes(endip))
+		if i > 0 && endipnum.cmp(p.endArr[i-1]) < 0 {
+			return newDbFormatError(DbFilePartRecordIndex, i, j, "end ip %s less than previous", endipStr)
+		}
+		offset := int(binary.LittleEndian.Uint32(data[j+50:]))
+		length := int(data[j+54])
+		buf, err := recordBytes(data, offset, length)
+		if err != nil {
+			return newDbFormatError(DbFilePartRecord, i, j, "%s", err)
+		}
+		p.endArr = append(p.endArr, endipnum)
+		p.addrArr = append(p.addrArr, buf)
+	}
+
+	return nil
+}
+
+// 前缀索引的记录下标区间需在记录数之内，或者都为ipDataCloudNoRecord
+func checkPrefixRange(start, end uint32, recordSize int) error {
+	if start == ipDataCloudNoRecord || end == ipDataCloudNoRecord {
+		if start != end {
+			return fmt.Errorf("only one of start %d and end %d is empty", start, end)
+		}
+		return nil
+	}
+	if start > end || int64(end) >= int64(recordSize) {
+		return fmt.Errorf("invalid record range [%d, %d], record count %d", start, end, recordSize)
+	}
+	return nil
+}
+
+func recordBytes(data []byte, offset, length int) (string, error) {
+	if offset > len(data) || length > len(data)-offset {
+		return "", fmt.Errorf("record [%d, %d) out of file size %d", offset, offset+length, len(data))
+	}
+	buf := data[offset : offset+length]
+	return unsafe.String(unsafe.SliceData(buf), len(buf)), nil
+}
@@ -0,0 +1,360 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"ip_geo/internal/config"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 构造IPv4离线库，ends为各记录的结束IP，records为对应的记录内容
+func buildIpDataCloudV4(ends []uint32, records []string) []byte {
+	var b bytes.Buffer
+	le := func(v uint32) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(len(ends)))
+	for k := 0; k < 256; k++ {
+		start, end := uint32(ipDataCloudNoRecord), uint32(ipDataCloudNoRecord)
+		for i, e := range ends {
+			if e>>24 >= uint32(k) && start == ipDataCloudNoRecord {
+				start = uint32(i)
+			}
+			if e>>24 >= uint32(k) && end == ipDataCloudNoRecord {
+				end = uint32(i)
+			}
+			if e>>24 == uint32(k) {
+				end = uint32(i)
+			}
+		}
+		le(start)
+		le(end)
+	}
+	offset := uint32(ipDataCloudV4HeaderSize + len(ends)*ipDataCloudV4RecordSize)
+	for i, e := range ends {
+		le(e)
+		le(offset)
+		b.WriteByte(byte(len(records[i])))
+		offset += uint32(len(records[i]))
+	}
+	for _, r := range records {
+		b.WriteString(r)
+	}
+	return b.Bytes()
+}
+
+// 构造只有一个前缀的IPv6离线库
+func buildIpDataCloudV6(prefix uint32, ends []string, records []string) []byte {
+	var b bytes.Buffer
+	le := func(v uint32) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(len(ends)))
+	le(1)
+	le(0)
+	le(uint32(len(ends) - 1))
+	le(prefix)
+	offset := uint32(ipDataCloudV6HeaderSize + ipDataCloudV6PrefixSize + len(ends)*ipDataCloudV6RecordSize)
+	for i, e := range ends {
+		endip := make([]byte, ipDataCloudV6EndIpSize)
+		copy(endip, new(big.Int).SetBytes(net.ParseIP(e).To16()).String())
+		b.Write(endip)
+		le(offset)
+		b.WriteByte(byte(len(records[i])))
+		offset += uint32(len(records[i]))
+	}
+	for _, r := range records {
+		b.WriteString(r)
+	}
+	return b.Bytes()
+}
+
+// 构造IPv6离线库，ends需升序，按结束IP的前16位生成前缀索引
+func buildIpDataCloudV6Prefixes(ends []string, records []string) []byte {
+	var prefixes []uint32
+	ranges := make(map[uint32][2]uint32)
+	for i, e := range ends {
+		prefix := uint32(binary.BigEndian.Uint16(net.ParseIP(e).To16()))
+		r, ok := ranges[prefix]
+		if !ok {
+			prefixes = append(prefixes, prefix)
+			r[0] = uint32(i)
+		}
+		r[1] = uint32(i)
+		ranges[prefix] = r
+	}
+
+	var b bytes.Buffer
+	le := func(v uint32) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(len(ends)))
+	le(uint32(len(prefixes)))
+	for _, prefix := range prefixes {
+		le(ranges[prefix][0])
+		le(ranges[prefix][1])
+		le(prefix)
+	}
+	offset := uint32(ipDataCloudV6HeaderSize + len(prefixes)*ipDataCloudV6PrefixSize + len(ends)*ipDataCloudV6RecordSize)
+	for i, e := range ends {
+		endip := make([]byte, ipDataCloudV6EndIpSize)
+		copy(endip, new(big.Int).SetBytes(net.ParseIP(e).To16()).String())
+		b.Write(endip)
+		le(offset)
+		b.WriteByte(byte(len(records[i])))
+		offset += uint32(len(records[i]))
+	}
+	for _, r := range records {
+		b.WriteString(r)
+	}
+	return b.Bytes()
+}
+
+// 标准布局的记录
+func ipDataCloudTestRecord(country, countryCode, city, isp string) string {
+	fields := make([]string, len(ipDataCloudKnownLayouts[0].fields))
+	fields[0] = "亚洲"
+	fields[1] = country
+	fields[3] = city
+	fields[5] = isp
+	fields[7] = countryCode
+	return strings.Join(fields, "|")
+}
+
+func TestParseIpDataCloudV4(t *testing.T) {
+	data := buildIpDataCloudV4([]uint32{0x01FFFFFF, 0x0AFFFFFF, 0xFFFFFFFF}, []string{"a|b", "c|d", "e|f"})
+	p := &ipDataCloudDb{}
+	if err := parseIpDataCloudV4(data, p); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"1.2.3.4": "a|b", "10.0.0.1": "c|d", "114.114.114.114": "e|f"} {
+		got, err := p.getRecordStr(net.ParseIP(ip).To4())
+		if err != nil || got != want {
+			t.Errorf("getRecordStr(%s) = %q, %v, want %q", ip, got, err, want)
+		}
+	}
+}
+
+func TestParseIpDataCloudV4Errors(t *testing.T) {
+	valid := buildIpDataCloudV4([]uint32{0xFFFFFFFF}, []string{"a|b"})
+	cases := map[string]struct {
+		data []byte
+		part string
+	}{
+		"truncated header":       {valid[:100], DbFilePartHeader},
+		"truncated record index": {valid[:ipDataCloudV4HeaderSize+4], DbFilePartHeader},
+		"truncated record":       {valid[:len(valid)-1], DbFilePartRecord},
+		"bad prefix": {func() []byte {
+			b := bytes.Clone(valid)
+			binary.LittleEndian.PutUint32(b[8:], 5)
+			return b
+		}(), DbFilePartPrefixIndex},
+	}
+	for name, c := range cases {
+		err := parseIpDataCloudV4(c.data, &ipDataCloudDb{})
+		var fe *DbFormatError
+		if !errors.As(err, &fe) || fe.Part != c.part {
+			t.Errorf("%s: got error %v, want part %s", name, err, c.part)
+		}
+	}
+}
+
+func TestParseIpDataCloudV6(t *testing.T) {
+	data := buildIpDataCloudV6(0x2400, []string{"2400:ff::ffff", "2400:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}, []string{"a|b", "c|d"})
+	p := &ipDataCloudDbV6{}
+	if err := parseIpDataCloudV6(data, p); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"2400:ff::1": "a|b", "2400:3200::1": "c|d"} {
+		got, err := p.getRecordStr(net.ParseIP(ip))
+		if err != nil || got != want {
+			t.Errorf("getRecordStr(%s) = %q, %v, want %q", ip, got, err, want)
+		}
+	}
+	if _, err := p.getRecordStr(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("expected not found for unknown prefix")
+	}
+
+	bad := bytes.Clone(data)
+	copy(bad[ipDataCloudV6HeaderSize+ipDataCloudV6PrefixSize:], "x")
+	var fe *DbFormatError
+	if err := parseIpDataCloudV6(bad, &ipDataCloudDbV6{}); !errors.As(err, &fe) || fe.Part != DbFilePartRecordIndex {
+		t.Errorf("got error %v, want part %s", err, DbFilePartRecordIndex)
+	}
+}
+
+func TestParseIpDataCloudV6Lookup(t *testing.T) {
+	data := buildIpDataCloudV6Prefixes(
+		[]string{"2400::ffff", "2400:ff::", "2400:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "240e::ffff:ffff", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		[]string{"a", "b", "c", "d", "e"})
+	p := &ipDataCloudDbV6{}
+	if err := parseIpDataCloudV6(data, p); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want string // 为空表示查不到
+	}{
+		{"2400::", "a"},
+		{"2400::ffff", "a"},
+		// 结束IP的下一个地址属于下一条记录
+		{"2400::1:0", "b"},
+		{"2400:ff::", "b"},
+		{"2400:ff::1", "c"},
+		{"2400:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "c"},
+		// 前缀中只有一条记录时直接返回
+		{"240e::", "d"},
+		{"240e::ffff:ffff", "d"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "e"},
+		{"2401::1", ""},
+		{"2001:db8::1", ""},
+		{"::ffff:114.114.114.114", ""},
+	}
+	for _, tt := range tests {
+		got, err := p.getRecordStr(net.ParseIP(tt.ip))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("getRecordStr(%s) = %q, want not found", tt.ip, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("getRecordStr(%s) = %q, %v, want %q", tt.ip, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseIpDataCloudV6Errors(t *testing.T) {
+	valid := buildIpDataCloudV6Prefixes([]string{"2400::ffff", "2400:ffff::"}, []string{"a|b", "c|d"})
+	recordStart := ipDataCloudV6HeaderSize + ipDataCloudV6PrefixSize
+	modify := func(f func(b []byte)) []byte {
+		b := bytes.Clone(valid)
+		f(b)
+		return b
+	}
+	setEndIp := func(b []byte, i int, endip string) {
+		j := recordStart + i*ipDataCloudV6RecordSize
+		copy(b[j:j+ipDataCloudV6EndIpSize], make([]byte, ipDataCloudV6EndIpSize))
+		copy(b[j:], endip)
+	}
+	tests := []struct {
+		name      string
+		data      []byte
+		wantPart  string
+		wantIndex int
+	}{
+		{"truncated header", valid[:4], DbFilePartHeader, ipDataCloudFormatErrNoIndex},
+		{"prefix count exceeds file", modify(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], 1000) }),
+			DbFilePartHeader, ipDataCloudFormatErrNoIndex},
+		{"record count exceeds file", modify(func(b []byte) { binary.LittleEndian.PutUint32(b, 1000) }),
+			DbFilePartHeader, ipDataCloudFormatErrNoIndex},
+		{"prefix exceeds 16 bits", modify(func(b []byte) { binary.LittleEndian.PutUint32(b[ipDataCloudV6HeaderSize+8:], 0x10000) }),
+			DbFilePartPrefixIndex, 0},
+		{"prefix range reversed", modify(func(b []byte) {
+			binary.LittleEndian.PutUint32(b[ipDataCloudV6HeaderSize:], 1)
+			binary.LittleEndian.PutUint32(b[ipDataCloudV6HeaderSize+4:], 0)
+		}),
+			DbFilePartPrefixIndex, 0},
+		{"prefix range exceeds records", modify(func(b []byte) { binary.LittleEndian.PutUint32(b[ipDataCloudV6HeaderSize+4:], 2) }),
+			DbFilePartPrefixIndex, 0},
+		{"prefix range half empty", modify(func(b []byte) { binary.LittleEndian.PutUint32(b[ipDataCloudV6HeaderSize:], ipDataCloudNoRecord) }),
+			DbFilePartPrefixIndex, 0},
+		{"end ip not a number", modify(func(b []byte) { setEndIp(b, 0, "2400::") }), DbFilePartRecordIndex, 0},
+		{"end ip exceeds 128 bits", modify(func(b []byte) { setEndIp(b, 1, "340282366920938463463374607431768211456") }),
+			DbFilePartRecordIndex, 1},
+		{"end ip decreasing", modify(func(b []byte) { setEndIp(b, 1, "1") }), DbFilePartRecordIndex, 1},
+		{"record out of file", valid[:len(valid)-1], DbFilePartRecord, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseIpDataCloudV6(tt.data, &ipDataCloudDbV6{})
+			var fe *DbFormatError
+			if !errors.As(err, &fe) || fe.Part != tt.wantPart || fe.Index != tt.wantIndex {
+				t.Errorf("got error %v, want part %s index %d", err, tt.wantPart, tt.wantIndex)
+			}
+		})
+	}
+}
+
+// 同时配置IPv4和IPv6离线库时，按地址族查询各自的库，IPv4映射地址查IPv4库
+func TestIpCloudDataHelperStageV6(t *testing.T) {
+	v4 := buildIpDataCloudV4([]uint32{0x71ffffff, 0x72ffffff, 0xffffffff}, []string{
+		ipDataCloudTestRecord("美国", "US", "洛杉矶", "Level3"),
+		ipDataCloudTestRecord("中国", "CN", "南京", "电信"),
+		ipDataCloudTestRecord("美国", "US", "纽约", "AT&T"),
+	})
+	v6 := buildIpDataCloudV6Prefixes([]string{"2400:31ff:ffff:ffff:ffff:ffff:ffff:ffff", "2400:3200:ffff:ffff:ffff:ffff:ffff:ffff", "2400:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}, []string{
+		ipDataCloudTestRecord("日本", "JP", "东京", "NTT"),
+		ipDataCloudTestRecord("中国", "CN", "杭州", "阿里云"),
+		ipDataCloudTestRecord("日本", "JP", "大阪", "KDDI"),
+	})
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{DataSyncConfig: &config.DataSyncConfig{}})
+	helper := &IpCloudDataHelper{cfgPtr: cfgPtr}
+	version, commit, err := helper.stageDbFiles([]dbFile{testRawDbFile(v4), testRawDbFile(v6)})
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	commit()
+
+	snap := helper.Snapshot()
+	if snap.Version != version || snap.RecordCount != 3 || snap.RecordCountV6 != 3 || snap.FileHashV6 == "" {
+		t.Errorf("snapshot = %+v", snap)
+	}
+	tests := []struct {
+		ip          string
+		wantCity    string
+		wantCountry string
+	}{
+		{"114.114.114.114", "南京", "CN"},
+		{"::ffff:114.114.114.114", "南京", "CN"},
+		{"2400:3200::1", "杭州", "CN"},
+		{"2400:31ff:ffff:ffff:ffff:ffff:ffff:ffff", "东京", "JP"},
+		{"2400:3201::", "大阪", "JP"},
+	}
+	for _, tt := range tests {
+		info, err := helper.QueryGeo(tt.ip)
+		if err != nil || info.City != tt.wantCity || info.CountryCode != tt.wantCountry || info.DBVersion != version {
+			t.Errorf("QueryGeo(%s) = %+v, %v, want %s %s", tt.ip, info, err, tt.wantCity, tt.wantCountry)
+		}
+	}
+	if _, err = helper.QueryGeo("2001:db8::1"); err == nil {
+		t.Error("expected not found for unknown ipv6 prefix")
+	}
+
+	// IPv6库中查不到测试地址时不切换
+	bad := buildIpDataCloudV6Prefixes([]string{"2401:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}, []string{ipDataCloudTestRecord("日本", "JP", "东京", "NTT")})
+	if _, _, err = helper.stageDbFiles([]dbFile{testRawDbFile(v4), testRawDbFile(bad)}); err == nil {
+		t.Error("expected error when ipv6 test ip not found")
+	}
+}
+
+// 任意输入都不能panic，解析成功后的查询也不能panic
+func FuzzParseIpDataCloudV4(f *testing.F) {
+	f.Add(buildIpDataCloudV4([]uint32{0x01FFFFFF, 0xFFFFFFFF}, []string{"a|b", "c|d"}))
+	f.Add(make([]byte, ipDataCloudV4HeaderSize))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &ipDataCloudDb{}
+		if err := parseIpDataCloudV4(data, p); err != nil {
+			return
+		}
+		for _, ip := range []string{"0.0.0.0", "1.2.3.4", "114.114.114.114", "255.255.255.255"} {
+			p.getRecordStr(net.ParseIP(ip).To4())
+		}
+	})
+}
+
+func FuzzParseIpDataCloudV6(f *testing.F) {
+	f.Add(buildIpDataCloudV6(0x2400, []string{"2400:ff::ffff", "2400:ffff::"}, []string{"a|b", "c|d"}))
+	f.Add(make([]byte, ipDataCloudV6HeaderSize))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &ipDataCloudDbV6{}
+		if err := parseIpDataCloudV6(data, p); err != nil {
+			return
+		}
+		for _, ip := range []string{"::", "2400::1", "2400:3200::1", "ffff::1"} {
+			p.getRecordStr(net.ParseIP(ip))
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 构造第n代测试数据，不同代的记录长度不同，以便复用缓冲区时内容错位可被发现
+func buildIpDataCloudGeneration(n int) []byte {
+	pad := strings.Repeat("x", n%7)
+	record := func(i int) string {
+		fields := make([]string, len(ipDataCloudKnownLayouts[0].fields))
+		fields[0] = "亚洲"
+		fields[1] = fmt.Sprintf("C%06d", n)
+		fields[2] = "P" + pad
+		fields[3] = fmt.Sprintf("T%06d", n)
+		fields[5] = fmt.Sprintf("ISP%d", i)
+		return strings.Join(fields, "|")
+	}
+	return buildIpDataCloudV4(
+		[]uint32{0x00ffffff, 0x72ffffff, 0xffffffff},
+		[]string{record(0), record(1), record(2)},
+	)
+}
+
+func newTestIpCloudDataHelper(t *testing.T, n int) *IpCloudDataHelper {
+	helper := &IpCloudDataHelper{}
+	loadTestGeneration(t, helper, n)
+	return helper
+}
+
+func loadTestGeneration(t *testing.T, helper *IpCloudDataHelper, n int) *ipDataCloudDb {
+	db, err := helper.loadDb(bytes.NewReader(buildIpDataCloudGeneration(n)), 0)
+	if err != nil {
+		t.Fatalf("load generation %d: %v", n, err)
+	}
+	db.layout = ipDataCloudKnownLayouts[0]
+	helper.swapSnapshot(&ipDataCloudSnapshot{
+		DbSnapshot: DbSnapshot{Version: fmt.Sprintf("C%06d", n), RecordCount: len(db.addrArr)},
+		db:         db,
+	})
+	return db
+}
+
+func TestIpCloudDataHelperReclaim(t *testing.T) {
+	helper := newTestIpCloudDataHelper(t, 1)
+	first := helper.cur.cur.Load().value.db
+
+	// 读者持有引用时，旧代不能被回收
+	gen := helper.cur.acquire()
+	loadTestGeneration(t, helper, 2)
+	if helper.freeDb.Load() != nil {
+		t.Fatal("generation reclaimed while still referenced")
+	}
+	if !strings.Contains(gen.value.db.addrArr[0], "C000001") {
+		t.Fatalf("old generation changed: %q", gen.value.db.addrArr[0])
+	}
+
+	// 最后一个读者释放后回收，并在下一次加载时复用
+	gen.release()
+	if helper.freeDb.Load() != first {
+		t.Fatal("generation not reclaimed after last release")
+	}
+	if third := loadTestGeneration(t, helper, 3); third != first {
+		t.Fatal("reclaimed buffer not reused")
+	}
+}
+
+func TestIpCloudDataHelperNotLoaded(t *testing.T) {
+	helper := &IpCloudDataHelper{}
+	if _, err := helper.QueryGeo("114.114.114.114"); err == nil {
+		t.Fatal("expected error before first load")
+	}
+	if helper.Snapshot() != nil {
+		t.Fatal("expected nil snapshot before first load")
+	}
+
+	loadTestGeneration(t, helper, 1)
+	if snap := helper.Snapshot(); snap == nil || snap.Version != "C000001" || snap.RecordCount != 3 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if _, err := helper.QueryGeo("2400:3200::1"); err == nil {
+		t.Fatal("expected error for missing ipv6 db")
+	}
+}
+
+// 并发查询的同时反复切换离线库，配合-race运行
+func TestIpCloudDataHelperSwapRace(t *testing.T) {
+	const (
+		readers     = 8
+		generations = 200
+	)
+	helper := newTestIpCloudDataHelper(t, 0)
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errCh := make(chan error, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				resp, err := helper.QueryGeo("114.114.114.114")
+				if err != nil {
+					errCh <- err
+					return
+				}
+				// 记录的各字段与版本号来自同一代
+				if len(resp.Country) != 7 || resp.Country[1:] != resp.City[1:] || resp.Isp != "ISP1" ||
+					resp.DBVersion != resp.Country {
+					errCh <- fmt.Errorf("inconsistent record: %+v", resp)
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 1; n <= generations; n++ {
+		loadTestGeneration(t, helper, n)
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	resp, err := helper.QueryGeo("114.114.114.114")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("C%06d", generations); resp.Country != want {
+		t.Fatalf("country = %q, want %q", resp.Country, want)
+	}
+}
@@ -0,0 +1,214 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-co-op/gocron/v2"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// file数据源：由其他进程放入共享目录的离线库文件，监听目录变化后刷新
+
+// 写入中的文件常用的后缀，这类文件和隐藏文件都不读取
+var partialFileSuffixes = []string{".tmp", ".part", ".partial", ".download", ".crdownload", ".swp", ".lock"}
+
+// 目录中没有写入完成的文件
+var errNoSettledFile = errors.New("no settled file")
+
+func isPartialDbFile(name string) bool {
+	name = filepath.Base(name)
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, suffix := range partialFileSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按通配符在WatchDir中查找最新的文件，最后修改时间距今不足SettleTime的文件视为仍在写入，不予考虑
+// 返回绝对路径，WatchDir为相对路径时校验文件同样按本地路径读取
+func resolveLocalDbFile(dsCfg *config.DataSyncConfig, pattern string) (string, os.FileInfo, error) {
+	pattern = strings.TrimPrefix(pattern, "file://")
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dsCfg.WatchDir, pattern)
+	}
+	pattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+	}
+
+	var newest string
+	var newestInfo os.FileInfo
+	unsettled := 0
+	for _, m := range matches {
+		if isPartialDbFile(m) || isSidecarFile(m) {
+			continue
+		}
+		fi, err := os.Stat(m)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if time.Since(fi.ModTime()) < dsCfg.SettleTime {
+			unsettled++
+			continue
+		}
+		if newestInfo == nil || fi.ModTime().After(newestInfo.ModTime()) ||
+			fi.ModTime().Equal(newestInfo.ModTime()) && m > newest {
+			newest, newestInfo = m, fi
+		}
+	}
+	if newestInfo == nil {
+		return "", nil, fmt.Errorf("%w matches %s, files still being written: %d", errNoSettledFile, pattern, unsettled)
+	}
+	return newest, newestInfo, nil
+}
+
+func isSidecarFile(name string) bool {
+	for _, suffix := range []string{sha256SidecarSuffix, ed25519SidecarSuffix, minisignSidecarSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 复制目录中最新的文件，之后与下载文件同样处理；文件与prev相同时返回errDbNotModified
+// 复制过程中文件被修改时返回错误，等待下次刷新
+func readLocalDbFile(dsCfg *config.DataSyncConfig, pattern string, prev dbFileMeta) (part partialDownload, err error) {
+	path, fi, err := resolveLocalDbFile(dsCfg, pattern)
+	if err != nil {
+		return part, err
+	}
+	part.meta = dbFileMeta{LastModified: fi.ModTime(), Source: path}
+	if prev.Source == path && prev.LastModified.Equal(fi.ModTime()) && prev.DownloadSize == fi.Size() {
+		return part, errDbNotModified
+	}
+
+	progress := newDownloadProgress(path)
+	defer func() {
+		progress.finish(err)
+		if err != nil && part.blob != nil {
+			part.blob.remove()
+			part.blob = nil
+		}
+	}()
+
+	if err = checkDbResources(dsCfg, fi.Size(), 0); err != nil {
+		return part, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return part, err
+	}
+	defer f.Close()
+
+	if part.blob, err = newDbBlob(dsCfg); err != nil {
+		return part, err
+	}
+	part.blob.reserve(fi.Size())
+	w, err := part.blob.writer(0)
+	if err != nil {
+		return part, err
+	}
+	defer w.Close()
+
+	progress.begin(0, fi.Size())
+	part.size, err = io.Copy(w, io.TeeReader(f, progress))
+	if err != nil {
+		return part, err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return part, err
+	}
+	if part.size != fi.Size() || after.Size() != fi.Size() || !after.ModTime().Equal(fi.ModTime()) {
+		return part, fmt.Errorf("file %s changed while reading", path)
+	}
+	return part, nil
+}
+
+// 带目录监听的定时任务，关闭时同时停止监听
+type watchedScheduler struct {
+	gocron.Scheduler
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func (s *watchedScheduler) Shutdown() error {
+	err := s.watcher.Close()
+	<-s.done
+	if shutdownErr := s.Scheduler.Shutdown(); shutdownErr != nil {
+		return shutdownErr
+	}
+	return err
+}
+
+// 监听WatchDir，目录中的文件有变化且保持SettleTime不变后立即执行一次job
+// 定时任务启动前的变化会被忽略，由首次同步处理
+func watchDbDir(syncer gocron.Scheduler, dsCfg *config.DataSyncConfig, job gocron.Job) (gocron.Scheduler, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(dsCfg.WatchDir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watch dir %s failed: %v", dsCfg.WatchDir, err)
+	}
+
+	s := &watchedScheduler{Scheduler: syncer, watcher: watcher, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		// 多留一秒，避开文件系统时间戳的精度误差
+		delay := dsCfg.SettleTime + time.Second
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isPartialDbFile(ev.Name) || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(delay, func() {
+						logx.Infof("db dir changed, refresh now, dir: %s", dsCfg.WatchDir)
+						if err := job.RunNow(); err != nil {
+							logx.Errorf("trigger refresh failed, dir: %s, err: %v", dsCfg.WatchDir, err)
+						}
+					})
+				} else {
+					timer.Reset(delay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logx.Errorf("watch dir %s failed: %v", dsCfg.WatchDir, err)
+			}
+		}
+	}()
+	logx.Infof("watching db dir: %s", dsCfg.WatchDir)
+	return s, nil
+}
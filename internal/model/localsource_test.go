@@ -0,0 +1,50 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"ip_geo/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFetchLocalDbFileRelativeWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("local db")
+	sum := sha256.Sum256(content)
+	os.WriteFile(filepath.Join(dir, "ipv4-1.bin"), content, 0o644)
+	os.WriteFile(filepath.Join(dir, "ipv4-1.bin"+sha256SidecarSuffix), []byte(hex.EncodeToString(sum[:])+"  ipv4-1.bin\n"), 0o644)
+
+	wd, _ := os.Getwd()
+	relDir, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Skipf("temp dir not relative to working dir: %v", err)
+	}
+	dsCfg := &config.DataSyncConfig{
+		SourceType: DbSourceFile,
+		WatchDir:   relDir,
+		Storage:    DbStorageMemory,
+		Retry:      config.RetryPolicy{MaxAttempts: 1, AttemptTimeout: 5 * time.Second},
+		Archive:    config.ArchiveConfig{MaxSize: 1 << 20},
+		Verify:     config.VerifyConfig{Sha256Sidecar: true},
+	}
+	reqs := []dbFileRequest{{Url: "ipv4-*.bin"}}
+
+	// 相对目录中的文件及其校验文件都按本地路径读取
+	files, err := fetchDbFiles(context.Background(), dsCfg, reqs, nil)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer removeDbFiles(files)
+	meta := files[0].Meta
+	if !filepath.IsAbs(meta.Source) || meta.Verified != "sha256-sidecar" {
+		t.Errorf("source = %s, verified = %q, want absolute path verified by sidecar", meta.Source, meta.Verified)
+	}
+	if _, err = fetchDbFiles(context.Background(), dsCfg, reqs, dbFileMetas(files)); !errors.Is(err, errDbNotModified) {
+		t.Errorf("refetch err = %v, want not modified", err)
+	}
+}
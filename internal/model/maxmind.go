@@ -0,0 +1,243 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"ip_geo/internal/config"
+	"ip_geo/internal/utils"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+var (
+	_ IpGeoHelper = (*MaxMindHelper)(nil)
+)
+
+// 基于MaxMind GeoLite2/GeoIP2 MMDB离线库的查询助手
+// City库下载地址复用DataSyncConfig.DownloadUrl，ASN库可选
+type MaxMindHelper struct {
+	dataset   *dbDataset
+	cityDbPtr atomic.Pointer[maxminddb.Reader]
+	asnDbPtr  atomic.Pointer[maxminddb.Reader] // 为nil表示未配置ASN库
+	cfgPtr    *atomic.Pointer[config.Config]
+	version   atomic.Pointer[dbVersion]
+}
+
+func NewMaxMindHelper(cfgPtr *atomic.Pointer[config.Config], cluster *ClusterSync) (*MaxMindHelper, error) {
+	helper := &MaxMindHelper{cfgPtr: cfgPtr}
+	dataset, err := newDbDataset(cfgPtr, ProviderMaxMind, "mmdb", helper.dbFileRequests, helper.stageDbFiles, cluster)
+	if err != nil {
+		return nil, err
+	}
+	helper.dataset = dataset
+
+	return helper, nil
+}
+
+func (helper *MaxMindHelper) QueryGeo(ipAddr string) (resp *GeoInfo, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			resp, err = nil, fmt.Errorf("panic: %v", panicErr)
+		}
+	}()
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip")
+	}
+	cityDb := helper.cityDbPtr.Load()
+	if cityDb == nil {
+		return nil, errors.New("mmdb not loaded")
+	}
+
+	resp, err = queryMmdb(cityDb, helper.asnDbPtr.Load(), ip, helper.language())
+	if err != nil {
+		return nil, err
+	}
+	helper.version.Load().fill(resp)
+
+	return resp, nil
+}
+
+// 查询City库，配置了ASN库时补充ASN信息
+func queryMmdb(cityDb *maxminddb.Reader, asnDb *maxminddb.Reader, ip net.IP, lang string) (*GeoInfo, error) {
+	var city maxMindCityRecord
+	_, ok, err := cityDb.LookupNetwork(ip, &city)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	resp := &GeoInfo{
+		Continent:   utils.GetContinentCodeByIsoCode(city.Continent.Code),
+		Country:     maxMindName(city.Country.Names, lang),
+		CountryCode: city.Country.IsoCode,
+		City:        maxMindName(city.City.Names, lang),
+		ZipCode:     city.Postal.Code,
+		Timezone:    city.Location.TimeZone,
+	}
+	if len(city.Subdivisions) > 0 {
+		resp.Region = maxMindName(city.Subdivisions[0].Names, lang)
+	}
+	if city.Location.Latitude != nil && city.Location.Longitude != nil {
+		resp.Latitude = strconv.FormatFloat(*city.Location.Latitude, 'f', -1, 64)
+		resp.Longitude = strconv.FormatFloat(*city.Location.Longitude, 'f', -1, 64)
+	}
+
+	if asnDb != nil {
+		var asn maxMindAsnRecord
+		if err := asnDb.Lookup(ip, &asn); err != nil {
+			return nil, err
+		}
+		resp.Asn = asn.AutonomousSystemNumber
+		resp.AsnOrg = asn.AutonomousSystemOrganization
+	}
+	return resp, nil
+}
+
+// 参与质量检查的数据集，记录数取City库的节点数
+func (helper *MaxMindHelper) probe(cityDb *maxminddb.Reader, asnDb *maxminddb.Reader) datasetProbe {
+	lang := helper.language()
+	return datasetProbe{
+		query: func(ip net.IP) (*GeoInfo, error) {
+			return queryMmdb(cityDb, asnDb, ip, lang)
+		},
+		records: int64(cityDb.Metadata.NodeCount),
+	}
+}
+
+// 初始化db
+func (helper *MaxMindHelper) Init() error {
+	return helper.dataset.init()
+}
+
+// 清理
+func (helper *MaxMindHelper) Clean() error {
+	helper.dataset.clean()
+	return nil
+}
+
+// ASN库为可选项
+func (helper *MaxMindHelper) dbFileRequests(cfg *config.Config) []dbFileRequest {
+	reqs := []dbFileRequest{{Url: cfg.DataSyncConfig.DownloadUrl, Mirrors: cfg.DataSyncConfig.Mirrors, EntrySuffix: ".mmdb"}}
+	if cfg.MaxMindConfig != nil && cfg.MaxMindConfig.AsnDownloadUrl != "" {
+		reqs = append(reqs, dbFileRequest{
+			Url:         cfg.MaxMindConfig.AsnDownloadUrl,
+			Mirrors:     cfg.MaxMindConfig.AsnMirrors,
+			EntrySuffix: ".mmdb",
+		})
+	}
+	return reqs
+}
+
+// 加载并检查City库和ASN库，通过后返回版本及切换函数
+func (helper *MaxMindHelper) stageDbFiles(files []dbFile) (version string, commit func(), err error) {
+	cfg := helper.cfgPtr.Load()
+	cityDb, version, err := loadMmdb(files[0], "City")
+	if err != nil {
+		return "", nil, err
+	}
+	var asnDb *maxminddb.Reader
+	if len(files) > 1 {
+		asnDb, _, err = loadMmdb(files[1], "ASN")
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var current *datasetProbe
+	if oldCityDb := helper.cityDbPtr.Load(); oldCityDb != nil {
+		probe := helper.probe(oldCityDb, helper.asnDbPtr.Load())
+		current = &probe
+	}
+	err = checkDatasetQuality(&cfg.DataSyncConfig.Quality, ProviderMaxMind, version, helper.probe(cityDb, asnDb), current)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 版本取City库的版本
+	commit = func() {
+		helper.version.Store(&dbVersion{version: version, loadTime: time.Now()})
+		helper.cityDbPtr.Store(cityDb)
+		helper.asnDbPtr.Store(asnDb)
+
+		logx.Infof("done refresh mmdb, version: %v, source: %s", version, files[0].Meta.Source)
+	}
+	return version, commit, nil
+}
+
+// 加载mmdb文件，dbType用于校验库的类型，如City、ASN
+// 数据整体读入内存，旧库不再被引用后由GC回收，无需Close
+// 版本优先取库的构建时间
+func loadMmdb(file dbFile, dbType string) (*maxminddb.Reader, string, error) {
+	data, err := file.readAll()
+	if err != nil {
+		return nil, "", err
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, dbType) {
+		return nil, "", fmt.Errorf("unexpected mmdb type, expected %s, but got: %s", dbType, db.Metadata.DatabaseType)
+	}
+	if err := db.Verify(); err != nil {
+		return nil, "", err
+	}
+	logx.Infof("finish load mmdb file, type: %s, node count: %d", db.Metadata.DatabaseType, db.Metadata.NodeCount)
+
+	buildTime := time.Unix(int64(db.Metadata.BuildEpoch), 0)
+	return db, datasetVersion(buildTime, file.Meta, file.Meta.FileHash), nil
+}
+
+func (helper *MaxMindHelper) language() string {
+	if c := helper.cfgPtr.Load().MaxMindConfig; c != nil && c.Language != "" {
+		return c.Language
+	}
+	return "en"
+}
+
+// 取指定语言的名称，缺失时回退到英文
+func maxMindName(names map[string]string, lang string) string {
+	if v, ok := names[lang]; ok {
+		return v
+	}
+	return names["en"]
+}
+
+type maxMindCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+		TimeZone  string   `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+type maxMindAsnRecord struct {
+	AutonomousSystemNumber       uint32 `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
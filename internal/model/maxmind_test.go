@@ -0,0 +1,229 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"ip_geo/internal/config"
+	"math"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 按MaxMind DB格式编码数据，仅支持测试用到的类型，长度不超过284
+func encodeTestMmdbValue(b *bytes.Buffer, v any) {
+	ctrl := func(typ int, size int) {
+		sizeBits, ext := size, []byte(nil)
+		if size >= 29 {
+			sizeBits, ext = 29, []byte{byte(size - 29)}
+		}
+		if typ <= 7 {
+			b.WriteByte(byte(typ<<5 | sizeBits))
+		} else {
+			b.WriteByte(byte(sizeBits))
+			b.WriteByte(byte(typ - 7))
+		}
+		b.Write(ext)
+	}
+	switch v := v.(type) {
+	case string:
+		ctrl(2, len(v))
+		b.WriteString(v)
+	case float64:
+		ctrl(3, 8)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		ctrl(5, 2)
+		binary.Write(b, binary.BigEndian, v)
+	case uint32:
+		ctrl(6, 4)
+		binary.Write(b, binary.BigEndian, v)
+	case uint64:
+		ctrl(9, 8)
+		binary.Write(b, binary.BigEndian, v)
+	case []any:
+		ctrl(11, len(v))
+		for _, e := range v {
+			encodeTestMmdbValue(b, e)
+		}
+	case map[string]any:
+		ctrl(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeTestMmdbValue(b, k)
+			encodeTestMmdbValue(b, v[k])
+		}
+	default:
+		panic("unsupported mmdb value")
+	}
+}
+
+type testMmdbNetwork struct {
+	prefix string // IPv4网段
+	record map[string]any
+}
+
+// 构造IPv4的mmdb文件，记录长度32位，每个网段对应一条数据
+func buildTestMmdb(dbType string, buildEpoch uint64, networks []testMmdbNetwork) []byte {
+	const empty, dataFlag = -1, 1 << 30
+	nodes := [][2]int{{empty, empty}}
+	var data bytes.Buffer
+	for _, n := range networks {
+		prefix := netip.MustParsePrefix(n.prefix)
+		ip := prefix.Addr().As4()
+		node := 0
+		for depth := 0; depth < prefix.Bits(); depth++ {
+			bit := ip[depth/8] >> (7 - depth%8) & 1
+			if depth == prefix.Bits()-1 {
+				nodes[node][bit] = dataFlag | data.Len()
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		encodeTestMmdbValue(&data, n.record)
+	}
+
+	var b bytes.Buffer
+	for _, node := range nodes {
+		for _, v := range node {
+			switch {
+			case v == empty:
+				v = len(nodes)
+			case v&dataFlag != 0:
+				v = len(nodes) + 16 + v&^dataFlag
+			}
+			binary.Write(&b, binary.BigEndian, uint32(v))
+		}
+	}
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encodeTestMmdbValue(&b, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 buildEpoch,
+		"database_type":               dbType,
+		"description":                 map[string]any{"en": "test db"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en", "zh-CN"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(32),
+	})
+	return b.Bytes()
+}
+
+func testMmdbCity(continent, countryCode, country, region, city string, lat, lon float64) map[string]any {
+	return map[string]any{
+		"continent":    map[string]any{"code": continent},
+		"country":      map[string]any{"iso_code": countryCode, "names": map[string]any{"en": country, "zh-CN": country + "-zh"}},
+		"subdivisions": []any{map[string]any{"names": map[string]any{"en": region}}},
+		"city":         map[string]any{"names": map[string]any{"en": city}},
+		"location":     map[string]any{"latitude": lat, "longitude": lon, "time_zone": "Asia/Shanghai"},
+		"postal":       map[string]any{"code": "210000"},
+	}
+}
+
+var testMmdbBuildTime = time.Date(2024, 3, 5, 6, 7, 8, 0, time.UTC)
+
+func newTestMaxMindHelper(lang string) *MaxMindHelper {
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{DataSyncConfig: &config.DataSyncConfig{}, MaxMindConfig: &config.MaxMindConfig{Language: lang}})
+	return &MaxMindHelper{cfgPtr: cfgPtr}
+}
+
+func TestMaxMindHelperQueryGeo(t *testing.T) {
+	city := buildTestMmdb("GeoLite2-City", uint64(testMmdbBuildTime.Unix()), []testMmdbNetwork{
+		{"1.0.0.0/24", testMmdbCity("OC", "AU", "Australia", "Queensland", "Brisbane", -27.4679, 153.0281)},
+		{"114.114.0.0/16", testMmdbCity("AS", "CN", "China", "Jiangsu", "Nanjing", 32.0617, 118.7778)},
+	})
+	asn := buildTestMmdb("GeoLite2-ASN", uint64(testMmdbBuildTime.Unix()), []testMmdbNetwork{
+		{"114.114.0.0/16", map[string]any{"autonomous_system_number": uint32(21859), "autonomous_system_organization": "Zenlayer"}},
+	})
+
+	helper := newTestMaxMindHelper("zh-CN")
+	if _, err := helper.QueryGeo("114.114.114.114"); err == nil {
+		t.Fatal("expected error before first load")
+	}
+	version, commit, err := helper.stageDbFiles([]dbFile{testRawDbFile(city), testRawDbFile(asn)})
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	commit()
+	// 版本取City库的构建时间
+	if version != "2024-03-05T06:07:08Z" {
+		t.Errorf("version = %s", version)
+	}
+
+	info, err := helper.QueryGeo("114.114.114.114")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 指定语言缺失的名称回退到英文，洲代码转换为与其他离线库一致的代码
+	want := GeoInfo{Continent: "AP", Country: "China-zh", CountryCode: "CN", Region: "Jiangsu", City: "Nanjing",
+		ZipCode: "210000", Latitude: "32.0617", Longitude: "118.7778", Timezone: "Asia/Shanghai",
+		Asn: 21859, AsnOrg: "Zenlayer", DBVersion: version}
+	info.DBLoadTime = ""
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("info = %+v\nwant %+v", *info, want)
+	}
+
+	// ASN库中没有的地址只返回地理信息
+	if info, err = helper.QueryGeo("1.0.0.1"); err != nil || info.City != "Brisbane" || info.Continent != "OA" || info.Asn != 0 {
+		t.Errorf("1.0.0.1: %+v, %v", info, err)
+	}
+	if _, err = helper.QueryGeo("8.8.8.8"); err == nil {
+		t.Error("expected not found")
+	}
+	if _, err = helper.QueryGeo("1.0.0"); err == nil {
+		t.Error("expected error for invalid ip")
+	}
+}
+
+func TestMaxMindHelperStageErrors(t *testing.T) {
+	city := buildTestMmdb("GeoLite2-City", 1, []testMmdbNetwork{
+		{"1.0.0.0/24", testMmdbCity("OC", "AU", "Australia", "Queensland", "Brisbane", -27.4679, 153.0281)},
+	})
+	asn := buildTestMmdb("GeoLite2-ASN", 1, []testMmdbNetwork{
+		{"1.0.0.0/24", map[string]any{"autonomous_system_number": uint32(13335), "autonomous_system_organization": "Cloudflare"}},
+	})
+	// 数据区中有搜索树未引用的数据
+	unreferenced := bytes.Replace(city, []byte("\xAB\xCD\xEFMaxMind.com"), []byte("\x41x\xAB\xCD\xEFMaxMind.com"), 1)
+	tests := []struct {
+		name    string
+		files   [][]byte
+		wantErr string
+	}{
+		{"asn as city", [][]byte{asn}, "unexpected mmdb type, expected City"},
+		{"city as asn", [][]byte{city, city}, "unexpected mmdb type, expected ASN"},
+		{"not mmdb", [][]byte{[]byte("not a mmdb")}, "invalid MaxMind DB"},
+		{"verify failed", [][]byte{unreferenced}, "search tree does not point to"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []dbFile
+			for _, data := range tt.files {
+				files = append(files, testRawDbFile(data))
+			}
+			helper := newTestMaxMindHelper("en")
+			_, _, err := helper.stageDbFiles(files)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+			if helper.cityDbPtr.Load() != nil {
+				t.Error("db switched after failed stage")
+			}
+		})
+	}
+}
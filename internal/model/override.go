@@ -0,0 +1,494 @@
+package model
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/zeromicro/go-zero/core/logx"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	_ IpGeoHelper = (*OverrideHelper)(nil)
+)
+
+// 覆盖规则的来源标识，记录在GeoInfo.Sources中
+const overrideSource = "override"
+
+// 一条覆盖规则，将CIDR内的地址的部分字段替换为指定值，字段名同geoFields
+type OverrideRule struct {
+	Cidr    string            `yaml:"cidr" json:"cidr"`
+	Fields  map[string]string `yaml:"fields" json:"fields"`
+	Comment string            `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// 规则变更的操作人，AccessKey为共享凭证，Operator只是调用方自报的名称，未经校验，需结合来源地址判断
+type OverrideActor struct {
+	Operator     string `json:"operator"`
+	RemoteAddr   string `json:"remote_addr"`
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+}
+
+// 规则变更的审计记录
+type OverrideAudit struct {
+	Time time.Time `json:"time"`
+	OverrideActor
+	Action string        `json:"action"` // add、remove
+	Cidr   string        `json:"cidr"`
+	Before *OverrideRule `json:"before,omitempty"`
+	After  *OverrideRule `json:"after,omitempty"`
+}
+
+// 覆盖层，在查询助手之前按最长前缀匹配覆盖规则，用于修正公司办公网、VPN出口等已知错误的数据
+// 规则文件支持yaml和csv格式，文件变更后自动重新加载
+type OverrideHelper struct {
+	inner     IpGeoHelper
+	cfgPtr    *atomic.Pointer[config.Config]
+	syncer    gocron.Scheduler
+	tablePtr  atomic.Pointer[overrideTable]
+	modTime   time.Time  // 规则文件上次加载时的修改时间
+	mu        sync.Mutex // 保护规则的加载和修改
+	auditFile string
+}
+
+func NewOverrideHelper(cfgPtr *atomic.Pointer[config.Config], inner IpGeoHelper) (*OverrideHelper, error) {
+	ovCfg := cfgPtr.Load().OverrideConfig
+	if ovCfg == nil || ovCfg.File == "" {
+		return nil, errors.New("override file missing")
+	}
+	if ext := strings.ToLower(filepath.Ext(ovCfg.File)); ext != ".yaml" && ext != ".yml" && ext != ".csv" {
+		return nil, fmt.Errorf("unsupported override file type: %s", ext)
+	}
+	interval, err := time.ParseDuration(ovCfg.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	helper := &OverrideHelper{
+		inner:     inner,
+		cfgPtr:    cfgPtr,
+		auditFile: ovCfg.AuditFile,
+	}
+	syncer, err := gocron.NewScheduler(gocron.WithLocation(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	j, err := syncer.NewJob(gocron.DurationJob(interval), gocron.NewTask(helper.reloadRules))
+	if err != nil {
+		return nil, err
+	}
+	logx.Infof("reload override rules job id: %s", j.ID())
+	helper.syncer = syncer
+	helper.tablePtr.Store(newOverrideTable(nil))
+
+	return helper, nil
+}
+
+func (helper *OverrideHelper) QueryGeo(ipAddr string) (*GeoInfo, error) {
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return nil, errors.New("invalid ip")
+	}
+	rule := helper.tablePtr.Load().match(addr.Unmap())
+	resp, err := helper.inner.QueryGeo(ipAddr)
+	if rule == nil {
+		return resp, err
+	}
+
+	// 底层查不到时只返回规则中的字段
+	if err != nil {
+		resp = &GeoInfo{DBVersion: overrideSource}
+	}
+	if resp.Sources == nil {
+		resp.Sources = make(map[string]string)
+	}
+	for field, v := range rule.Fields {
+		geoFields[field].set(resp, v)
+		resp.Sources[field] = overrideSource
+	}
+	return resp, nil
+}
+
+// 初始化db
+func (helper *OverrideHelper) Init() error {
+	if err := helper.loadRules(); err != nil {
+		return err
+	}
+	if err := helper.inner.Init(); err != nil {
+		return err
+	}
+
+	helper.syncer.Start() // 启动定时检查规则文件
+	return nil
+}
+
+// 清理
+func (helper *OverrideHelper) Clean() error {
+	err := helper.syncer.Shutdown()
+	if err != nil {
+		logx.Errorf("shutdown reload override rules job failed: %v", err)
+	}
+	return helper.inner.Clean()
+}
+
+// 返回当前所有规则，按CIDR排序
+func (helper *OverrideHelper) ListRules() []OverrideRule {
+	return helper.tablePtr.Load().list()
+}
+
+// 新增或替换规则，并写回规则文件
+func (helper *OverrideHelper) AddRule(rule OverrideRule, actor OverrideActor) error {
+	prefix, err := validateOverrideRule(&rule)
+	if err != nil {
+		return err
+	}
+
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+
+	table := helper.tablePtr.Load()
+	rules := table.list()
+	var before *OverrideRule
+	if old, ok := table.rules[prefix]; ok {
+		before = old
+		for i := range rules {
+			if rules[i].Cidr == old.Cidr {
+				rules = append(rules[:i], rules[i+1:]...)
+				break
+			}
+		}
+	}
+	rules = append(rules, rule)
+	if err := helper.saveRules(rules); err != nil {
+		return err
+	}
+
+	helper.audit(OverrideAudit{OverrideActor: actor, Action: "add", Cidr: rule.Cidr, Before: before, After: &rule})
+	return nil
+}
+
+// 删除规则，并写回规则文件
+func (helper *OverrideHelper) RemoveRule(cidr string, actor OverrideActor) error {
+	prefix, err := parseOverridePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+
+	table := helper.tablePtr.Load()
+	old, ok := table.rules[prefix]
+	if !ok {
+		return fmt.Errorf("override rule not found: %s", cidr)
+	}
+	rules := table.list()
+	for i := range rules {
+		if rules[i].Cidr == old.Cidr {
+			rules = append(rules[:i], rules[i+1:]...)
+			break
+		}
+	}
+	if err := helper.saveRules(rules); err != nil {
+		return err
+	}
+
+	helper.audit(OverrideAudit{OverrideActor: actor, Action: "remove", Cidr: old.Cidr, Before: old})
+	return nil
+}
+
+func (helper *OverrideHelper) reloadRules() {
+	err := helper.loadRules()
+	if err != nil {
+		logx.Errorf("error reloading override rules: %v", err)
+	}
+}
+
+// 规则文件有变化时重新加载，文件不存在视为没有规则
+func (helper *OverrideHelper) loadRules() error {
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+
+	file := helper.cfgPtr.Load().OverrideConfig.File
+	fi, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(helper.modTime) {
+		return nil
+	}
+
+	rules, err := readOverrideRules(file)
+	if err != nil {
+		return err
+	}
+	table, err := buildOverrideTable(rules)
+	if err != nil {
+		return err
+	}
+	helper.tablePtr.Store(table)
+	helper.modTime = fi.ModTime()
+	logx.Infof("finish loading override rules, count: %d", len(rules))
+	return nil
+}
+
+// 写入规则文件（先写临时文件再重命名），成功后切换规则表，调用方需持有mu
+func (helper *OverrideHelper) saveRules(rules []OverrideRule) error {
+	table, err := buildOverrideTable(rules)
+	if err != nil {
+		return err
+	}
+	rules = table.list()
+
+	file := helper.cfgPtr.Load().OverrideConfig.File
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".override-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = writeOverrideRules(tmp, file, rules); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+
+	helper.tablePtr.Store(table)
+	if fi, err := os.Stat(file); err == nil {
+		helper.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// 审计记录写入日志，配置了AuditFile时同时追加到文件
+func (helper *OverrideHelper) audit(record OverrideAudit) {
+	record.Time = time.Now()
+	b, _ := json.Marshal(record)
+	logx.Infof("override rule audit: %s", b)
+	if helper.auditFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(helper.auditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		logx.Errorf("open override audit file failed: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logx.Errorf("write override audit file failed: %v", err)
+	}
+}
+
+func validateOverrideRule(rule *OverrideRule) (netip.Prefix, error) {
+	prefix, err := parseOverridePrefix(rule.Cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if len(rule.Fields) == 0 {
+		return netip.Prefix{}, fmt.Errorf("no field in override rule: %s", rule.Cidr)
+	}
+	for field := range rule.Fields {
+		if _, ok := geoFields[field]; !ok {
+			return netip.Prefix{}, fmt.Errorf("unknown field %s in override rule: %s", field, rule.Cidr)
+		}
+	}
+	rule.Cidr = prefix.String()
+	return prefix, nil
+}
+
+// 规范化的前缀，查询时IPv4映射的IPv6地址按IPv4匹配，规则也统一为IPv4前缀
+func parseOverridePrefix(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// yaml格式为规则列表；csv格式首行为表头，第一列为cidr，其余列为字段名，可选comment列，空值表示不覆盖
+func readOverrideRules(file string) ([]OverrideRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []OverrideRule
+	if strings.ToLower(filepath.Ext(file)) != ".csv" {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(b, &rules); err != nil {
+			return nil, err
+		}
+		return rules, nil
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rule := OverrideRule{Cidr: row[0], Fields: make(map[string]string)}
+		for i := 1; i < len(row) && i < len(header); i++ {
+			v := strings.TrimSpace(row[i])
+			switch {
+			case v == "":
+			case header[i] == "comment":
+				rule.Comment = v
+			default:
+				rule.Fields[strings.TrimSpace(header[i])] = v
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func writeOverrideRules(w io.Writer, file string, rules []OverrideRule) error {
+	if strings.ToLower(filepath.Ext(file)) != ".csv" {
+		b, err := yaml.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	// 只输出用到的字段列
+	used := make(map[string]bool)
+	for _, rule := range rules {
+		for field := range rule.Fields {
+			used[field] = true
+		}
+	}
+	header := []string{"cidr"}
+	for _, field := range geoFieldNames {
+		if used[field] {
+			header = append(header, field)
+		}
+	}
+	header = append(header, "comment")
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		row := []string{rule.Cidr}
+		for _, field := range header[1 : len(header)-1] {
+			row = append(row, rule.Fields[field])
+		}
+		row = append(row, rule.Comment)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// 覆盖规则表，以规范化的前缀为键，查询时从最长的前缀长度开始匹配
+type overrideTable struct {
+	rules   map[netip.Prefix]*OverrideRule
+	bitsV4  []int // 规则中出现的IPv4前缀长度，降序
+	bitsV6  []int // 规则中出现的IPv6前缀长度，降序
+	ordered []OverrideRule
+}
+
+func buildOverrideTable(rules []OverrideRule) (*overrideTable, error) {
+	valid := make([]OverrideRule, 0, len(rules))
+	for _, rule := range rules {
+		if _, err := validateOverrideRule(&rule); err != nil {
+			return nil, err
+		}
+		valid = append(valid, rule)
+	}
+	return newOverrideTable(valid), nil
+}
+
+// rules需已校验，重复的CIDR以后出现的为准
+func newOverrideTable(rules []OverrideRule) *overrideTable {
+	t := &overrideTable{rules: make(map[netip.Prefix]*OverrideRule, len(rules))}
+	for i := range rules {
+		t.rules[netip.MustParsePrefix(rules[i].Cidr)] = &rules[i]
+	}
+
+	seenV4, seenV6 := make(map[int]bool), make(map[int]bool)
+	for prefix, rule := range t.rules {
+		if prefix.Addr().Is4() {
+			if !seenV4[prefix.Bits()] {
+				seenV4[prefix.Bits()] = true
+				t.bitsV4 = append(t.bitsV4, prefix.Bits())
+			}
+		} else if !seenV6[prefix.Bits()] {
+			seenV6[prefix.Bits()] = true
+			t.bitsV6 = append(t.bitsV6, prefix.Bits())
+		}
+		t.ordered = append(t.ordered, *rule)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.bitsV4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(t.bitsV6)))
+	sort.Slice(t.ordered, func(i, j int) bool { return t.ordered[i].Cidr < t.ordered[j].Cidr })
+	return t
+}
+
+// 最长前缀匹配
+func (t *overrideTable) match(addr netip.Addr) *OverrideRule {
+	bits := t.bitsV6
+	if addr.Is4() {
+		bits = t.bitsV4
+	}
+	for _, b := range bits {
+		prefix, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if rule, ok := t.rules[prefix]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (t *overrideTable) list() []OverrideRule {
+	return append([]OverrideRule(nil), t.ordered...)
+}
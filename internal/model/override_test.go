@@ -0,0 +1,194 @@
+package model
+
+import (
+	"encoding/json"
+	"ip_geo/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestOverrideHelper(t *testing.T, file string, content string) *OverrideHelper {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{OverrideConfig: &config.OverrideConfig{
+		File:           file,
+		ReloadInterval: "1h",
+		AuditFile:      filepath.Join(filepath.Dir(file), "audit.log"),
+	}})
+	helper, err := NewOverrideHelper(cfgPtr, &fakeGeoHelper{info: &GeoInfo{DBVersion: "inner", CountryCode: "US", City: "Ashburn"}})
+	if err != nil {
+		t.Fatalf("new override helper: %v", err)
+	}
+	if err = helper.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() { helper.Clean() })
+	return helper
+}
+
+// 改写规则文件并设置修改时间
+func rewriteOverrideFile(t *testing.T, file string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const overrideYaml = `
+- cidr: 10.0.0.0/8
+  fields: {city: Corp}
+- cidr: 10.1.0.0/16
+  fields: {city: Office}
+- cidr: 10.1.2.0/24
+  fields: {city: Floor}
+- cidr: 10.1.2.3/32
+  fields: {city: Desk, isp: VPN}
+- cidr: ::ffff:192.168.0.0/112
+  fields: {city: Lab}
+- cidr: 2001:db8::/32
+  fields: {city: V6Corp}
+- cidr: 2001:db8:1::/48
+  fields: {city: V6Office}
+`
+
+func TestOverrideLongestPrefixMatch(t *testing.T) {
+	helper := newTestOverrideHelper(t, filepath.Join(t.TempDir(), "override.yaml"), overrideYaml)
+
+	tests := []struct {
+		ip   string
+		city string
+		isp  string
+	}{
+		{"10.9.9.9", "Corp", ""},
+		{"10.1.9.9", "Office", ""},
+		{"10.1.2.4", "Floor", ""},
+		{"10.1.2.3", "Desk", "VPN"},
+		{"::ffff:10.1.2.3", "Desk", "VPN"},
+		{"::ffff:10.1.9.9", "Office", ""},
+		{"192.168.1.1", "Lab", ""},
+		{"::ffff:192.168.1.1", "Lab", ""},
+		{"2001:db8:2::1", "V6Corp", ""},
+		{"2001:db8:1::1", "V6Office", ""},
+		{"11.0.0.1", "Ashburn", ""},
+		{"2001:db9::1", "Ashburn", ""},
+	}
+	for _, tt := range tests {
+		info, err := helper.QueryGeo(tt.ip)
+		if err != nil {
+			t.Errorf("%s: %v", tt.ip, err)
+			continue
+		}
+		if info.City != tt.city || info.Isp != tt.isp {
+			t.Errorf("%s: city/isp = %q/%q, want %q/%q", tt.ip, info.City, info.Isp, tt.city, tt.isp)
+		}
+		// 未覆盖的字段保留底层结果
+		if info.CountryCode != "US" {
+			t.Errorf("%s: country code = %q, want US", tt.ip, info.CountryCode)
+		}
+		if overridden := info.Sources["city"] == overrideSource; overridden != (tt.city != "Ashburn") {
+			t.Errorf("%s: sources = %v", tt.ip, info.Sources)
+		}
+	}
+}
+
+func TestOverrideReloadOnModTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		initial string
+		changed string
+	}{
+		{
+			name:    "yaml",
+			file:    "override.yaml",
+			initial: "- cidr: 10.0.0.0/8\n  fields: {city: Before}\n",
+			changed: "- cidr: 10.0.0.0/8\n  fields: {city: After}\n",
+		},
+		{
+			name:    "csv",
+			file:    "override.csv",
+			initial: "cidr,city,comment\n10.0.0.0/8,Before,\n",
+			changed: "cidr,city,comment\n10.0.0.0/8,After,reloaded\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			helper := newTestOverrideHelper(t, file, tt.initial)
+			city := func() string {
+				info, err := helper.QueryGeo("10.0.0.1")
+				if err != nil {
+					t.Fatalf("query: %v", err)
+				}
+				return info.City
+			}
+			if got := city(); got != "Before" {
+				t.Fatalf("city = %q, want Before", got)
+			}
+
+			// 修改时间未变化时不重新加载
+			fi, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewriteOverrideFile(t, file, tt.changed, fi.ModTime())
+			helper.reloadRules()
+			if got := city(); got != "Before" {
+				t.Errorf("city = %q after rewrite with same mod time, want Before", got)
+			}
+
+			rewriteOverrideFile(t, file, tt.changed, fi.ModTime().Add(time.Second))
+			helper.reloadRules()
+			if got := city(); got != "After" {
+				t.Errorf("city = %q after reload, want After", got)
+			}
+
+			// 内容有误时保留原规则
+			rewriteOverrideFile(t, file, strings.Replace(tt.changed, "10.0.0.0/8", "10.0.0.0/33", 1), fi.ModTime().Add(2*time.Second))
+			helper.reloadRules()
+			if got := city(); got != "After" {
+				t.Errorf("city = %q after invalid rewrite, want After", got)
+			}
+		})
+	}
+}
+
+func TestOverrideAuditActor(t *testing.T) {
+	dir := t.TempDir()
+	helper := newTestOverrideHelper(t, filepath.Join(dir, "override.yaml"), "")
+	actor := OverrideActor{Operator: "alice", RemoteAddr: "10.2.3.4:5678"}
+	if err := helper.AddRule(OverrideRule{Cidr: "::ffff:10.0.0.0/104", Fields: map[string]string{"city": "Corp"}}, actor); err != nil {
+		t.Fatalf("add rule: %v", err)
+	}
+	if err := helper.RemoveRule("10.0.0.0/8", actor); err != nil {
+		t.Fatalf("remove rule: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit lines = %d, want 2", len(lines))
+	}
+	for i, action := range []string{"add", "remove"} {
+		var record OverrideAudit
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Action != action || record.Cidr != "10.0.0.0/8" || record.OverrideActor != actor {
+			t.Errorf("audit record %d = %+v", i, record)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	xhttp "github.com/zeromicro/x/http"
+)
+
+// 同伴实例间分发快照：每个实例通过内部接口提供当前已切换的快照缓存，
+// 新实例没有本地缓存时先从同伴获取，都失败后再从下载地址下载
+
+// 内部接口的路径，与路由一致
+const (
+	peerSnapshotsPath    = "/internal/snapshots"
+	peerSnapshotFilePath = "/internal/snapshots/file"
+)
+
+// 同伴接口沿用管理接口的鉴权
+const (
+	peerAccessKeyHeader    = "X-Access-Key"
+	peerAccessSecretHeader = "X-Access-Secret"
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+var errInsecurePeer = errors.New("plain http peer not allowed, use https or enable InsecurePeers")
+
+// 同伴请求不跟随重定向，避免凭证被转发到其他地址
+var peerClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// 提供给同伴的快照，Id由提供方和下载地址确定，配置相同的实例间一致
+type ServedSnapshot struct {
+	Id       string               `json:"id"`
+	Provider string               `json:"provider"`
+	Version  string               `json:"version"`
+	Hash     string               `json:"hash"` // 各文件哈希的sha256
+	SavedAt  time.Time            `json:"saved_at"`
+	Files    []ServedSnapshotFile `json:"files"`
+}
+
+type ServedSnapshotFile struct {
+	Url          string    `json:"url"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"` // 文件的sha256
+	Source       string    `json:"source"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+	EntryModTime time.Time `json:"entry_mod_time"`
+	DownloadHash string    `json:"download_hash"`
+	DownloadSize int64     `json:"download_size"`
+	Verified     string    `json:"verified"`
+}
+
+// 还原为来源信息，本实例之后的条件下载沿用同伴的ETag等信息，文件未变化时不必重复下载
+func (f ServedSnapshotFile) meta() dbFileMeta {
+	return dbFileMeta{
+		LastModified: f.LastModified,
+		ETag:         f.ETag,
+		EntryModTime: f.EntryModTime,
+		DownloadHash: f.DownloadHash,
+		FileHash:     f.Hash,
+		Source:       f.Source,
+		Verified:     f.Verified,
+		DownloadSize: f.DownloadSize,
+		FileSize:     f.Size,
+	}
+}
+
+type servedSnapshot struct {
+	dir  string
+	snap ServedSnapshot
+}
+
+// 各提供方当前提供的快照，按Id索引；pending为协调刷新中已保存、尚未切换的快照，
+// 只提供给按哈希获取的实例，不作为当前快照列出
+var servedSnapshots = struct {
+	sync.RWMutex
+	snaps   map[string]servedSnapshot
+	pending map[string]servedSnapshot
+}{snaps: make(map[string]servedSnapshot), pending: make(map[string]servedSnapshot)}
+
+// 切换成功且快照已缓存后，将缓存目录中的快照提供给同伴，同时撤下该Id待切换的快照
+func publishSnapshot(id string, dir string, snap cachedSnapshot) {
+	served := newServedSnapshot(id, dir, snap)
+	servedSnapshots.Lock()
+	defer servedSnapshots.Unlock()
+	servedSnapshots.snaps[id] = served
+	delete(servedSnapshots.pending, id)
+}
+
+// 已保存但尚未切换的快照，供跟随同一通知的实例按哈希获取
+func pendSnapshot(id string, dir string, snap cachedSnapshot) {
+	served := newServedSnapshot(id, dir, snap)
+	servedSnapshots.Lock()
+	defer servedSnapshots.Unlock()
+	servedSnapshots.pending[id] = served
+}
+
+func newServedSnapshot(id string, dir string, snap cachedSnapshot) servedSnapshot {
+	served := ServedSnapshot{Id: id, Provider: snap.Provider, Version: snap.Version, SavedAt: snap.SavedAt}
+	fileHashes := make([]string, 0, len(snap.Files))
+	for _, cf := range snap.Files {
+		fileHashes = append(fileHashes, cf.Meta.FileHash)
+		served.Files = append(served.Files, ServedSnapshotFile{
+			Url:          cf.Url,
+			Name:         cf.Name,
+			Size:         cf.Meta.FileSize,
+			Hash:         cf.Meta.FileHash,
+			Source:       cf.Meta.Source,
+			ETag:         cf.Meta.ETag,
+			LastModified: cf.Meta.LastModified,
+			EntryModTime: cf.Meta.EntryModTime,
+			DownloadHash: cf.Meta.DownloadHash,
+			DownloadSize: cf.Meta.DownloadSize,
+			Verified:     cf.Meta.Verified,
+		})
+	}
+	served.Hash = snapshotHash(fileHashes)
+	return servedSnapshot{dir: dir, snap: served}
+}
+
+// 快照哈希为按顺序排列的各文件哈希的sha256
+func snapshotHash(fileHashes []string) string {
+	h := sha256.New()
+	for _, fileHash := range fileHashes {
+		h.Write([]byte(fileHash + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func unpublishSnapshot(id string) {
+	servedSnapshots.Lock()
+	defer servedSnapshots.Unlock()
+	delete(servedSnapshots.snaps, id)
+}
+
+func unpendSnapshot(id string) {
+	servedSnapshots.Lock()
+	defer servedSnapshots.Unlock()
+	delete(servedSnapshots.pending, id)
+}
+
+// 当前提供给同伴的快照，未配置CacheDir的提供方没有可提供的快照
+// hash不为空时只返回哈希相同的快照，包括已保存但尚未切换的快照
+func ServedSnapshots(hash string) []ServedSnapshot {
+	servedSnapshots.RLock()
+	defer servedSnapshots.RUnlock()
+	snaps := make([]ServedSnapshot, 0, len(servedSnapshots.snaps))
+	seen := make(map[string]bool)
+	for _, m := range []map[string]servedSnapshot{servedSnapshots.snaps, servedSnapshots.pending} {
+		for id := range m {
+			if s, ok := findServedSnapshot(id, hash); ok && !seen[id] {
+				seen[id] = true
+				snaps = append(snaps, s.snap)
+			}
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Id < snaps[j].Id })
+	return snaps
+}
+
+// 按哈希查找快照，当前快照优先，在servedSnapshots的锁内调用
+func findServedSnapshot(id string, hash string) (servedSnapshot, bool) {
+	if s, ok := servedSnapshots.snaps[id]; ok && (hash == "" || s.snap.Hash == hash) {
+		return s, true
+	}
+	if s, ok := servedSnapshots.pending[id]; ok && hash != "" && s.snap.Hash == hash {
+		return s, true
+	}
+	return servedSnapshot{}, false
+}
+
+// 打开快照中的文件，只能访问快照中列出的文件；hash不为空时可访问尚未切换的快照
+// 快照被清理时已打开的文件仍可读完
+func OpenServedSnapshotFile(id string, name string, hash string) (*os.File, *ServedSnapshotFile, error) {
+	servedSnapshots.RLock()
+	s, ok := findServedSnapshot(id, hash)
+	servedSnapshots.RUnlock()
+	if !ok {
+		return nil, nil, ErrSnapshotNotFound
+	}
+	for i := range s.snap.Files {
+		file := &s.snap.Files[i]
+		if file.Name != name {
+			continue
+		}
+		f, err := os.Open(filepath.Join(s.dir, filepath.Base(file.Name)))
+		if os.IsNotExist(err) {
+			return nil, nil, ErrSnapshotNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, file, nil
+	}
+	return nil, nil, ErrSnapshotNotFound
+}
+
+// 启动时在刷新锁内从同伴获取快照，依次尝试各同伴，成功一个即返回true
+// apply负责加载并保存快照
+func loadPeerSnapshot(refreshMu *sync.Mutex, cfg *config.Config, cache *snapshotCache, apply func(files []dbFile) error) (ok bool) {
+	dsCfg := cfg.DataSyncConfig
+	if len(dsCfg.Peers) == 0 {
+		return false
+	}
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			logx.Errorf("load peer snapshot panic: %v", panicErr)
+			ok = false
+		}
+	}()
+
+	for _, peer := range dsCfg.Peers {
+		files, err := fetchPeerSnapshot(cfg, peer, cache, "")
+		if err == nil {
+			err = apply(files)
+			removeDbFiles(files)
+		}
+		if err != nil {
+			logx.Errorf("load snapshot from peer failed, peer: %s, id: %s, err: %v", peer, cache.id, err)
+			continue
+		}
+		logx.Infof("snapshot loaded from peer, peer: %s, id: %s", peer, cache.id)
+		return true
+	}
+	logx.Infof("no peer snapshot loaded, download instead, id: %s", cache.id)
+	return false
+}
+
+// 从同伴获取与本实例配置相同的快照，文件按同伴给出的哈希校验
+// hash不为空时只接受该快照
+func fetchPeerSnapshot(cfg *config.Config, peer string, cache *snapshotCache, hash string) (files []dbFile, err error) {
+	dsCfg := cfg.DataSyncConfig
+	ctx, cf := context.WithTimeout(context.Background(), dsCfg.PeerTimeout)
+	defer cf()
+
+	var list xhttp.BaseResponse[struct {
+		Snapshots []ServedSnapshot `json:"snapshots"`
+	}]
+	// 指定哈希时同伴也提供已保存但尚未切换的快照
+	listUrl := peer + peerSnapshotsPath
+	if hash != "" {
+		listUrl += "?" + url.Values{"hash": {hash}}.Encode()
+	}
+	if err = peerGetJson(ctx, cfg, listUrl, &list); err != nil {
+		return nil, err
+	}
+	if list.Code != xhttp.BusinessCodeOK {
+		return nil, fmt.Errorf("list peer snapshots failed, code: %d, msg: %s", list.Code, list.Msg)
+	}
+	var served *ServedSnapshot
+	for i := range list.Data.Snapshots {
+		if list.Data.Snapshots[i].Id == cache.id {
+			served = &list.Data.Snapshots[i]
+		}
+	}
+	if served == nil {
+		return nil, ErrSnapshotNotFound
+	}
+	if hash != "" && served.Hash != hash {
+		return nil, fmt.Errorf("peer snapshot hash mismatch, expected %s, but got %s", hash, served.Hash)
+	}
+	snap := cachedSnapshot{Provider: served.Provider, Version: served.Version}
+	for _, f := range served.Files {
+		snap.Files = append(snap.Files, cachedDbFile{Url: f.Url, Name: f.Name, Meta: f.meta()})
+	}
+	if err = cache.checkSnapshot(snap); err != nil {
+		return nil, err
+	}
+	logx.Infof("fetching snapshot from peer, peer: %s, id: %s, version: %s, hash: %s",
+		peer, served.Id, served.Version, served.Hash)
+
+	var total int64
+	for _, f := range served.Files {
+		total += f.Size
+	}
+	if err = checkDbResources(dsCfg, total, 0); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			removeDbFiles(files)
+			files = nil
+		}
+	}()
+	for i, cf := range snap.Files {
+		fileQuery := url.Values{"id": {served.Id}, "name": {cf.Name}}
+		if hash != "" {
+			fileQuery.Set("hash", hash)
+		}
+		fileUrl := peer + peerSnapshotFilePath + "?" + fileQuery.Encode()
+		blob, err := fetchPeerFile(ctx, cfg, fileUrl, cf.Meta.FileSize)
+		if err != nil {
+			return files, err
+		}
+		file, err := cache.snapshotFile(i, cf, blob)
+		if err != nil {
+			blob.remove()
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// 同伴请求携带AccessKey和AccessSecret，只允许https，http需显式开启InsecurePeers
+func checkPeerUrl(dsCfg *config.DataSyncConfig, rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if dsCfg.InsecurePeers {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", errInsecurePeer, u.Host)
+	default:
+		return fmt.Errorf("unsupported peer url: %s", rawUrl)
+	}
+}
+
+func newPeerRequest(ctx context.Context, cfg *config.Config, rawUrl string) (*http.Request, error) {
+	if err := checkPeerUrl(cfg.DataSyncConfig, rawUrl); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerAccessKeyHeader, cfg.AccessKey)
+	req.Header.Set(peerAccessSecretHeader, cfg.AccessSecret)
+	return req, nil
+}
+
+func peerGetJson(ctx context.Context, cfg *config.Config, rawUrl string, v any) error {
+	req, err := newPeerRequest(ctx, cfg, rawUrl)
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected status code 200, but got %d, url: %s", resp.StatusCode, rawUrl)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// 下载快照中的一个文件，出错时接口返回json格式的错误
+func fetchPeerFile(ctx context.Context, cfg *config.Config, fileUrl string, size int64) (blob *dbBlob, err error) {
+	progress := newDownloadProgress(fileUrl)
+	defer func() {
+		progress.finish(err)
+		if err != nil && blob != nil {
+			blob.remove()
+			blob = nil
+		}
+	}()
+
+	req, err := newPeerRequest(ctx, cfg, fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status code 200, but got %d, url: %s", resp.StatusCode, fileUrl)
+	}
+	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "application/json") {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, sidecarMaxSize))
+		return nil, fmt.Errorf("fetch peer file failed, url: %s, resp body: %s", fileUrl, b)
+	}
+
+	dsCfg := cfg.DataSyncConfig
+	if blob, err = newDbBlob(dsCfg); err != nil {
+		return nil, err
+	}
+	blob.reserve(size)
+	w, err := blob.writer(0)
+	if err != nil {
+		return blob, err
+	}
+	defer w.Close()
+
+	progress.begin(0, size)
+	body := newThrottledReader(ctx, resp.Body, dsCfg.BandwidthLimit)
+	n, err := io.Copy(w, io.TeeReader(body, progress))
+	if err != nil {
+		return blob, err
+	}
+	if n != size {
+		return blob, fmt.Errorf("incomplete peer file, got %d bytes, expected %d", n, size)
+	}
+	return blob, nil
+}
@@ -0,0 +1,222 @@
+package model
+
+import (
+	"errors"
+	"io"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xhttp "github.com/zeromicro/x/http"
+)
+
+// 记录各同伴被访问的顺序及请求头
+type testPeerVisits struct {
+	mu      sync.Mutex
+	names   []string
+	headers []http.Header
+}
+
+func (v *testPeerVisits) record(name string, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.names = append(v.names, name)
+	v.headers = append(v.headers, r.Header.Clone())
+}
+
+// 依次访问过的同伴，同一同伴的连续请求只记一次
+func (v *testPeerVisits) order() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var order []string
+	for _, name := range v.names {
+		if len(order) == 0 || order[len(order)-1] != name {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// 列出snaps并对所有文件返回content的同伴，snaps为nil时列表接口返回503
+func newTestSnapshotPeer(t *testing.T, visits *testPeerVisits, name string, snaps []ServedSnapshot, content string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visits.record(name, r)
+		switch r.URL.Path {
+		case peerSnapshotsPath:
+			if snaps == nil {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			xhttp.JsonBaseResponse(w, map[string]any{"snapshots": snaps})
+		case peerSnapshotFilePath:
+			io.WriteString(w, content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// 与cache配置相同、文件内容为content的快照
+func testServedSnapshot(cache *snapshotCache, content string) ServedSnapshot {
+	hash, size, _ := hashReader(strings.NewReader(content))
+	return ServedSnapshot{
+		Id:       cache.id,
+		Provider: cache.provider,
+		Version:  content,
+		Hash:     snapshotHash([]string{hash}),
+		Files:    []ServedSnapshotFile{{Url: cache.reqs[0].Url, Name: "0.db", Size: size, Hash: hash}},
+	}
+}
+
+func newTestPeerConfig(insecure bool, peers ...string) *config.Config {
+	return &config.Config{AccessKey: "key", AccessSecret: "secret", DataSyncConfig: &config.DataSyncConfig{
+		Storage:       DbStorageMemory,
+		Peers:         peers,
+		PeerTimeout:   5 * time.Second,
+		InsecurePeers: insecure,
+	}}
+}
+
+func TestCheckPeerUrl(t *testing.T) {
+	tests := []struct {
+		url      string
+		insecure bool
+		wantErr  bool
+	}{
+		{"https://ip-geo-0.ip-geo:8888", false, false},
+		{"http://ip-geo-0.ip-geo:8888", false, true},
+		{"http://ip-geo-0.ip-geo:8888", true, false},
+		{"ftp://ip-geo-0.ip-geo", true, true},
+		{"ip-geo-0.ip-geo:8888", true, true},
+		{"http://[::1", true, true},
+	}
+	for _, tt := range tests {
+		err := checkPeerUrl(&config.DataSyncConfig{InsecurePeers: tt.insecure}, tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, insecure %v: err = %v, want err %v", tt.url, tt.insecure, err, tt.wantErr)
+		}
+	}
+}
+
+// 未开启InsecurePeers时不向http同伴发送任何请求，凭证不会明文传输
+func TestFetchPeerSnapshotInsecure(t *testing.T) {
+	cache := newTestSnapshotCache(t, 2)
+	visits := &testPeerVisits{}
+	peer := newTestSnapshotPeer(t, visits, "peer", []ServedSnapshot{testServedSnapshot(cache, "v1")}, "v1")
+
+	_, err := fetchPeerSnapshot(newTestPeerConfig(false), peer, cache, "")
+	if !errors.Is(err, errInsecurePeer) {
+		t.Fatalf("err = %v, want insecure peer", err)
+	}
+	if order := visits.order(); len(order) != 0 {
+		t.Fatalf("visited %v, want no request", order)
+	}
+
+	files, err := fetchPeerSnapshot(newTestPeerConfig(true), peer, cache, "")
+	if err != nil {
+		t.Fatalf("fetch with insecure peers: %v", err)
+	}
+	removeDbFiles(files)
+	if h := visits.headers[0]; h.Get(peerAccessKeyHeader) != "key" || h.Get(peerAccessSecretHeader) != "secret" {
+		t.Errorf("headers = %v, want access key and secret", h)
+	}
+}
+
+// 同伴的重定向不跟随，凭证不会转发到其他地址
+func TestFetchPeerSnapshotRedirect(t *testing.T) {
+	cache := newTestSnapshotCache(t, 2)
+	visits := &testPeerVisits{}
+	target := newTestSnapshotPeer(t, visits, "target", []ServedSnapshot{testServedSnapshot(cache, "v1")}, "v1")
+	peer := httptest.NewServer(http.RedirectHandler(target+peerSnapshotsPath, http.StatusFound))
+	defer peer.Close()
+
+	_, err := fetchPeerSnapshot(newTestPeerConfig(true), peer.URL, cache, "")
+	if err == nil || !strings.Contains(err.Error(), "but got 302") {
+		t.Errorf("err = %v, want redirect rejected", err)
+	}
+	if order := visits.order(); len(order) != 0 {
+		t.Errorf("visited %v, want redirect not followed", order)
+	}
+}
+
+func TestFetchPeerSnapshotMismatch(t *testing.T) {
+	cache := newTestSnapshotCache(t, 2)
+	snap := testServedSnapshot(cache, "v1")
+	otherId, otherProvider := snap, snap
+	otherId.Id = "other"
+	otherProvider.Provider = "other"
+	tests := []struct {
+		name    string
+		snap    ServedSnapshot
+		content string
+		hash    string
+		wantErr string
+	}{
+		{name: "file hash mismatch", snap: snap, content: "v2", wantErr: "sha256 mismatch"},
+		{name: "incomplete file", snap: snap, content: "v", wantErr: "incomplete peer file"},
+		{name: "announced hash mismatch", snap: snap, content: "v1", hash: "other", wantErr: "peer snapshot hash mismatch"},
+		{name: "other id", snap: otherId, content: "v1", wantErr: ErrSnapshotNotFound.Error()},
+		{name: "other provider", snap: otherProvider, content: "v1", wantErr: "snapshot does not match provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := newTestSnapshotPeer(t, &testPeerVisits{}, "peer", []ServedSnapshot{tt.snap}, tt.content)
+			files, err := fetchPeerSnapshot(newTestPeerConfig(true), peer, cache, tt.hash)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || files != nil {
+				t.Errorf("err = %v, files = %d, want %q", err, len(files), tt.wantErr)
+			}
+		})
+	}
+}
+
+// 按配置顺序尝试同伴，获取或加载失败时换下一个，成功后不再访问其余同伴
+func TestLoadPeerSnapshotFallback(t *testing.T) {
+	cache := newTestSnapshotCache(t, 2)
+	visits := &testPeerVisits{}
+	peers := []string{
+		newTestSnapshotPeer(t, visits, "down", nil, ""),
+		newTestSnapshotPeer(t, visits, "mismatch", []ServedSnapshot{testServedSnapshot(cache, "v1")}, "v2"),
+		newTestSnapshotPeer(t, visits, "missing", []ServedSnapshot{}, ""),
+		newTestSnapshotPeer(t, visits, "rejected", []ServedSnapshot{testServedSnapshot(cache, "bad")}, "bad"),
+		newTestSnapshotPeer(t, visits, "good", []ServedSnapshot{testServedSnapshot(cache, "v1")}, "v1"),
+		newTestSnapshotPeer(t, visits, "unused", []ServedSnapshot{testServedSnapshot(cache, "v3")}, "v3"),
+	}
+
+	var loaded []string
+	ok := loadPeerSnapshot(&sync.Mutex{}, newTestPeerConfig(true, peers...), cache, func(files []dbFile) error {
+		b, err := files[0].readAll()
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, string(b))
+		if string(b) == "bad" {
+			return errors.New("load failed")
+		}
+		return nil
+	})
+	if !ok || strings.Join(loaded, ",") != "bad,v1" {
+		t.Errorf("ok = %v, loaded %v, want bad then v1", ok, loaded)
+	}
+	want := "down,mismatch,missing,rejected,good"
+	if got := strings.Join(visits.order(), ","); got != want {
+		t.Errorf("visited %s, want %s", got, want)
+	}
+
+	// 所有同伴都失败时改为下载
+	visits = &testPeerVisits{}
+	peers = []string{newTestSnapshotPeer(t, visits, "down", nil, "")}
+	ok = loadPeerSnapshot(&sync.Mutex{}, newTestPeerConfig(true, peers...), cache, func(files []dbFile) error {
+		t.Error("apply called without peer snapshot")
+		return nil
+	})
+	if ok {
+		t.Error("ok = true, want false when all peers failed")
+	}
+}
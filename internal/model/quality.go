@@ -0,0 +1,164 @@
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ip_geo/internal/config"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 切换离线库前的质量检查：黄金集、记录数变化、与当前库抽样对比
+
+// 抽样对比时报告中列出的变化示例数
+const qualitySampleExamples = 10
+
+// 参与质量检查的数据集
+type datasetProbe struct {
+	query   func(ip net.IP) (*GeoInfo, error)
+	records int64 // 记录数，用于比较规模，未知时为0
+}
+
+// 质量检查不通过，Failures为每项不通过的详细原因
+type QualityGateError struct {
+	Provider string
+	Version  string
+	Failures []string
+}
+
+func (e *QualityGateError) Error() string {
+	return fmt.Sprintf("quality gate failed, provider: %s, version: %s, failures: [%s]",
+		e.Provider, e.Version, strings.Join(e.Failures, "; "))
+}
+
+// 检查新数据集，不通过时返回*QualityGateError
+// current为当前库，首次加载时为nil，只检查黄金集
+func checkDatasetQuality(gateCfg *config.QualityGateConfig, provider string, version string,
+	candidate datasetProbe, current *datasetProbe) error {
+	failures := checkGoldenSet(gateCfg.GoldenSet, candidate)
+	if current != nil {
+		if failure := checkRecordDelta(gateCfg.MaxRecordDelta, candidate, *current); failure != "" {
+			failures = append(failures, failure)
+		}
+		if failure := checkSampledDiff(gateCfg.SampleSize, gateCfg.MaxChangedRatio, candidate, *current); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+
+	if len(failures) > 0 {
+		err := &QualityGateError{Provider: provider, Version: version, Failures: failures}
+		for _, failure := range failures {
+			logx.Errorf("quality gate failed, provider: %s, version: %s, %s", provider, version, failure)
+		}
+		return err
+	}
+	logx.Infof("quality gate passed, provider: %s, version: %s, records: %d", provider, version, candidate.records)
+	return nil
+}
+
+func checkGoldenSet(goldenSet []config.GoldenRecord, candidate datasetProbe) []string {
+	var failures []string
+	for _, golden := range goldenSet {
+		ip := net.ParseIP(golden.Ip)
+		if ip == nil {
+			failures = append(failures, fmt.Sprintf("golden %s: invalid ip", golden.Ip))
+			continue
+		}
+		info, err := candidate.query(ip)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("golden %s: query failed: %v", golden.Ip, err))
+			continue
+		}
+		for _, field := range []struct{ name, expected, got string }{
+			{"country", golden.Country, info.Country},
+			{"country_code", golden.CountryCode, info.CountryCode},
+			{"region", golden.Region, info.Region},
+		} {
+			if field.expected != "" && field.expected != field.got {
+				failures = append(failures, fmt.Sprintf("golden %s: %s expected %q, but got %q",
+					golden.Ip, field.name, field.expected, field.got))
+			}
+		}
+	}
+	return failures
+}
+
+// 记录数变化超过比例时返回原因，任一方记录数未知时不检查
+func checkRecordDelta(maxDelta float64, candidate datasetProbe, current datasetProbe) string {
+	if maxDelta <= 0 || candidate.records <= 0 || current.records <= 0 {
+		return ""
+	}
+	delta := float64(candidate.records-current.records) / float64(current.records)
+	if math.Abs(delta) <= maxDelta {
+		return ""
+	}
+	return fmt.Sprintf("record count changed by %+.2f%% (%d -> %d), max %.2f%%",
+		delta*100, current.records, candidate.records, maxDelta*100)
+}
+
+// 随机抽取公网IPv4地址与当前库对比国家，变化比例超过上限时返回原因和变化示例
+// 两个库都查不到的地址不计入
+func checkSampledDiff(sampleSize int, maxChanged float64, candidate datasetProbe, current datasetProbe) string {
+	if maxChanged <= 0 || sampleSize <= 0 {
+		return ""
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	compared, changed := 0, 0
+	var examples []string
+	for i := 0; i < sampleSize; i++ {
+		ip := randomPublicIPv4(r)
+		newInfo, newErr := candidate.query(ip)
+		oldInfo, oldErr := current.query(ip)
+		if newErr != nil && oldErr != nil {
+			continue
+		}
+		compared++
+		oldCountry, newCountry := countryLabel(oldInfo, oldErr), countryLabel(newInfo, newErr)
+		if oldCountry == newCountry {
+			continue
+		}
+		changed++
+		if len(examples) < qualitySampleExamples {
+			examples = append(examples, fmt.Sprintf("%s: %s -> %s", ip, oldCountry, newCountry))
+		}
+	}
+	if compared == 0 {
+		return ""
+	}
+
+	ratio := float64(changed) / float64(compared)
+	if ratio <= maxChanged {
+		logx.Infof("sampled diff passed, compared: %d, changed countries: %d (%.2f%%)", compared, changed, ratio*100)
+		return ""
+	}
+	return fmt.Sprintf("country changed for %d of %d sampled ips (%.2f%%), max %.2f%%, examples: %s",
+		changed, compared, ratio*100, maxChanged*100, strings.Join(examples, ", "))
+}
+
+func randomPublicIPv4(r *rand.Rand) net.IP {
+	for {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], r.Uint32())
+		if ClassifyAddress(netip.AddrFrom4(b)) == AddressTypePublic {
+			return net.IP(b[:])
+		}
+	}
+}
+
+// 对比用的国家标识，查不到时为<none>
+func countryLabel(info *GeoInfo, err error) string {
+	if err != nil || info == nil || info.Country == "" && info.CountryCode == "" {
+		return "<none>"
+	}
+	if info.CountryCode == "" {
+		return info.Country
+	}
+	return info.Country + "(" + info.CountryCode + ")"
+}
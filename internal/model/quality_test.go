@@ -0,0 +1,198 @@
+package model
+
+import (
+	"errors"
+	"io"
+	"ip_geo/internal/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 按IP返回固定国家的数据集，countries中没有的地址查询失败
+func testProbe(records int64, countries map[string]string) datasetProbe {
+	return datasetProbe{records: records, query: func(ip net.IP) (*GeoInfo, error) {
+		code, ok := countries[ip.String()]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return &GeoInfo{CountryCode: code}, nil
+	}}
+}
+
+func TestCheckGoldenSet(t *testing.T) {
+	candidate := testProbe(0, map[string]string{"1.0.0.1": "US", "8.8.8.8": "US"})
+	tests := []struct {
+		name         string
+		golden       []config.GoldenRecord
+		wantFailures []string
+	}{
+		{"pass", []config.GoldenRecord{{Ip: "1.0.0.1", CountryCode: "US"}}, nil},
+		// 期望值为空的字段不比较
+		{"empty fields ignored", []config.GoldenRecord{{Ip: "1.0.0.1"}}, nil},
+		{"mismatch", []config.GoldenRecord{{Ip: "1.0.0.1", CountryCode: "US"}, {Ip: "8.8.8.8", CountryCode: "CN"}},
+			[]string{`golden 8.8.8.8: country_code expected "CN", but got "US"`}},
+		{"invalid ip", []config.GoldenRecord{{Ip: "1.0.0"}}, []string{"golden 1.0.0: invalid ip"}},
+		{"query failed", []config.GoldenRecord{{Ip: "9.9.9.9", CountryCode: "US"}}, []string{"golden 9.9.9.9: query failed: not found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := checkGoldenSet(tt.golden, candidate)
+			if strings.Join(failures, "\n") != strings.Join(tt.wantFailures, "\n") {
+				t.Errorf("failures = %q, want %q", failures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestCheckRecordDelta(t *testing.T) {
+	tests := []struct {
+		maxDelta  float64
+		current   int64
+		candidate int64
+		wantFail  bool
+	}{
+		{0.1, 1000, 1100, false},
+		{0.1, 1000, 1101, true},
+		{0.1, 1000, 900, false},
+		{0.1, 1000, 899, true},
+		{0, 1000, 10, false},
+		// 记录数未知时不检查
+		{0.1, 0, 10, false},
+		{0.1, 1000, 0, false},
+	}
+	for _, tt := range tests {
+		failure := checkRecordDelta(tt.maxDelta, testProbe(tt.candidate, nil), testProbe(tt.current, nil))
+		if (failure != "") != tt.wantFail {
+			t.Errorf("max %g, %d -> %d: failure = %q, want fail %v", tt.maxDelta, tt.current, tt.candidate, failure, tt.wantFail)
+		}
+	}
+}
+
+// 按地址最后一字节奇偶返回国家，changeEven为true时偶数地址的国家变化
+func testSampleProbe(changeEven bool, missing bool) datasetProbe {
+	return datasetProbe{query: func(ip net.IP) (*GeoInfo, error) {
+		if missing {
+			return nil, errors.New("not found")
+		}
+		if changeEven && ip.To4()[3]%2 == 0 {
+			return &GeoInfo{Country: "中国", CountryCode: "CN"}, nil
+		}
+		return &GeoInfo{Country: "美国", CountryCode: "US"}, nil
+	}}
+}
+
+func TestCheckSampledDiff(t *testing.T) {
+	current := testSampleProbe(false, false)
+	tests := []struct {
+		name       string
+		maxChanged float64
+		candidate  datasetProbe
+		current    datasetProbe
+		wantFail   bool
+	}{
+		{"unchanged", 0.01, current, current, false},
+		{"half changed within max", 0.7, testSampleProbe(true, false), current, false},
+		{"half changed over max", 0.3, testSampleProbe(true, false), current, true},
+		{"not checked", 0, testSampleProbe(true, false), current, false},
+		// 新库查不到原有的地址算作变化
+		{"candidate missing", 0.3, testSampleProbe(false, true), current, true},
+		// 两个库都查不到的地址不计入
+		{"both missing", 0.01, testSampleProbe(false, true), testSampleProbe(false, true), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := checkSampledDiff(1000, tt.maxChanged, tt.candidate, tt.current)
+			if (failure != "") != tt.wantFail {
+				t.Errorf("failure = %q, want fail %v", failure, tt.wantFail)
+			}
+			if tt.wantFail && !strings.Contains(failure, "examples: ") {
+				t.Errorf("failure without examples: %q", failure)
+			}
+		})
+	}
+}
+
+func TestCheckDatasetQuality(t *testing.T) {
+	gateCfg := &config.QualityGateConfig{
+		GoldenSet:       []config.GoldenRecord{{Ip: "1.0.0.1", CountryCode: "US"}},
+		MaxRecordDelta:  0.1,
+		SampleSize:      100,
+		MaxChangedRatio: 0.01,
+	}
+	candidate := testProbe(500, map[string]string{"1.0.0.1": "CN"})
+
+	// 首次加载只检查黄金集
+	err := checkDatasetQuality(gateCfg, ProviderCsv, "v2", candidate, nil)
+	var gateErr *QualityGateError
+	if !errors.As(err, &gateErr) || len(gateErr.Failures) != 1 || gateErr.Version != "v2" || gateErr.Provider != ProviderCsv {
+		t.Fatalf("err = %v, want golden failure only", err)
+	}
+
+	current := testProbe(1000, map[string]string{"1.0.0.1": "US"})
+	current.query = testSampleProbe(false, false).query
+	if err = checkDatasetQuality(gateCfg, ProviderCsv, "v2", candidate, &current); !errors.As(err, &gateErr) || len(gateErr.Failures) != 3 {
+		t.Fatalf("err = %v, want golden, record delta and sampled diff failures", err)
+	}
+}
+
+// 新库未通过质量检查时不切换，也不保存快照，当前库和缓存中的快照保持不变
+func TestQualityGateKeepsCurrentSnapshot(t *testing.T) {
+	const v1 = "\"1.0.0.0\",\"1.0.0.255\",\"US\",\"United States of America\",\"California\",\"Los Angeles\"\n" +
+		"\"8.8.8.0\",\"8.8.8.255\",\"US\",\"United States of America\",\"California\",\"Mountain View\"\n"
+	const v2 = "\"1.0.0.0\",\"1.0.0.255\",\"CN\",\"China\",\"Beijing\",\"Beijing\"\n" +
+		"\"8.8.8.0\",\"8.8.8.255\",\"US\",\"United States of America\",\"California\",\"Mountain View\"\n"
+	var content atomic.Value
+	content.Store(v1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content.Load().(string))
+	}))
+	defer server.Close()
+
+	cfgPtr := &atomic.Pointer[config.Config]{}
+	cfgPtr.Store(&config.Config{CsvConfig: ip2LocationCsvCfg, DataSyncConfig: &config.DataSyncConfig{
+		DownloadUrl:    server.URL + "/db.csv",
+		ForTest:        true,
+		RereshInterval: "1h",
+		Storage:        DbStorageMemory,
+		Retry:          config.RetryPolicy{MaxAttempts: 1, AttemptTimeout: 5 * time.Second},
+		Archive:        config.ArchiveConfig{MaxSize: 1 << 20},
+		Quality:        config.QualityGateConfig{GoldenSet: []config.GoldenRecord{{Ip: "1.0.0.1", CountryCode: "US"}}},
+		CacheDir:       t.TempDir(),
+		CacheKeep:      2,
+	}})
+	helper, err := NewCsvRangeHelper(cfgPtr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Clean()
+
+	if err = helper.dataset.doRefresh(); err != nil {
+		t.Fatalf("refresh v1: %v", err)
+	}
+	version := helper.version.Load().version
+
+	content.Store(v2)
+	err = helper.dataset.doRefresh()
+	var gateErr *QualityGateError
+	if !errors.As(err, &gateErr) {
+		t.Fatalf("refresh v2 err = %v, want quality gate error", err)
+	}
+	info, err := helper.QueryGeo("1.0.0.1")
+	if err != nil || info.CountryCode != "US" || info.DBVersion != version {
+		t.Errorf("after rejected refresh: info = %+v, err = %v, want US from %s", info, err, version)
+	}
+
+	cache := helper.dataset.cache()
+	names, _ := cache.snapshotNames()
+	if len(names) != 1 {
+		t.Fatalf("snapshots = %v, want only the accepted one", names)
+	}
+	if snap, _, err := cache.loadSnapshot(names[0]); err != nil || snap.Version != version {
+		t.Errorf("cached snapshot version = %q, err = %v, want %s", snap.Version, err, version)
+	}
+}
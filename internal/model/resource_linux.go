@@ -0,0 +1,77 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroup内存限制文件，依次为v2和v1
+var cgroupMemoryFiles = [][2]string{
+	{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory.current"},
+	{"/sys/fs/cgroup/memory/memory.limit_in_bytes", "/sys/fs/cgroup/memory/memory.usage_in_bytes"},
+}
+
+// 目录所在文件系统中非特权用户可用的空间
+func availableDisk(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+// 可用内存，取系统MemAvailable与cgroup剩余额度中的较小者
+func availableMemory() (int64, bool) {
+	avail, ok := memAvailable()
+	for _, files := range cgroupMemoryFiles {
+		limit, limitOk := readInt64File(files[0])
+		usage, usageOk := readInt64File(files[1])
+		if !limitOk || !usageOk {
+			continue
+		}
+		// v1未设置限制时为一个接近int64上限的值
+		if remain := max(limit-usage, 0); !ok || remain < avail {
+			avail, ok = remain, true
+		}
+		break
+	}
+	return avail, ok
+}
+
+func memAvailable() (int64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb * 1024, true
+		}
+	}
+	return 0, false
+}
+
+// 读取只含一个整数的文件，cgroup v2未设置限制时内容为max
+func readInt64File(file string) (int64, bool) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
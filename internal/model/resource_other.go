@@ -0,0 +1,12 @@
+//go:build !linux
+
+package model
+
+// 非linux平台无法获取剩余磁盘空间和内存，不做检查
+func availableDisk(dir string) (int64, bool) {
+	return 0, false
+}
+
+func availableMemory() (int64, bool) {
+	return 0, false
+}
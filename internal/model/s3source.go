@@ -0,0 +1,204 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3数据源：从S3兼容的对象存储读取内部镜像的离线库，请求按AWS Signature V4签名，
+// 其余与http数据源相同，变化检测依赖对象的ETag（If-None-Match）
+
+const (
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+	s3Service       = "s3"
+	// GET请求没有请求体，使用空内容的sha256
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// 按数据源类型返回下载使用的客户端，s3数据源的每个请求都会签名
+func sourceHttpClient(dsCfg *config.DataSyncConfig) *http.Client {
+	if dsCfg.SourceType != DbSourceS3 {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &s3Transport{cfg: &dsCfg.S3, base: http.DefaultTransport}}
+}
+
+// 对象键转为访问地址：key或s3://bucket/key，路径中的字符按S3的规则编码
+func s3ObjectUrl(s3Cfg *config.S3Config, key string) (string, error) {
+	bucket := s3Cfg.Bucket
+	if rest, ok := strings.CutPrefix(key, "s3://"); ok {
+		bucket, key, _ = strings.Cut(rest, "/")
+	}
+	key = strings.TrimPrefix(key, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("invalid s3 object, bucket: %q, key: %q", bucket, key)
+	}
+
+	endpoint := s3Cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s3Cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if s3Cfg.PathStyle {
+		prefix += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = prefix + "/" + key
+	u.RawPath = s3UriEncode(u.Path, false)
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// 凭证优先从文件读取，便于挂载轮换的密钥，每次请求都重新读取
+// 都未配置时返回空凭证，以匿名方式访问
+func loadS3Credentials(s3Cfg *config.S3Config) (cred s3Credentials, err error) {
+	read := func(file string, env string) (string, error) {
+		if file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("read s3 credential file failed: %v", err)
+			}
+			return strings.TrimSpace(string(b)), nil
+		}
+		if env != "" {
+			return strings.TrimSpace(os.Getenv(env)), nil
+		}
+		return "", nil
+	}
+	if cred.accessKey, err = read(s3Cfg.AccessKeyFile, s3Cfg.AccessKeyEnv); err != nil {
+		return cred, err
+	}
+	if cred.secretKey, err = read(s3Cfg.SecretKeyFile, s3Cfg.SecretKeyEnv); err != nil {
+		return cred, err
+	}
+	if cred.sessionToken, err = read(s3Cfg.SessionTokenFile, s3Cfg.SessionTokenEnv); err != nil {
+		return cred, err
+	}
+	if (cred.accessKey == "") != (cred.secretKey == "") {
+		return cred, fmt.Errorf("incomplete s3 credentials, both access key and secret key are required")
+	}
+	return cred, nil
+}
+
+// 对经过的请求签名，重定向后的请求也会重新签名
+type s3Transport struct {
+	cfg  *config.S3Config
+	base http.RoundTripper
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cred, err := loadS3Credentials(t.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cred.accessKey == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	signS3Request(req, cred, t.cfg.Region, time.Now())
+	return t.base.RoundTrip(req)
+}
+
+// 按AWS Signature V4签名，签名包含host、range及x-amz-*请求头
+func signS3Request(req *http.Request, cred s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if cred.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cred.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3UriEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + s3Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3SignAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + cred.secretKey)
+	for _, part := range []string{date, region, s3Service, "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, cred.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3UriEncode(name, true)+"="+s3UriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// 除A-Za-z0-9-._~外的字节都编码为%XX，路径中的/按encodeSlash决定是否编码
+func s3UriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,242 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"golang.org/x/crypto/blake2b"
+)
+
+// 下载文件的校验：sha256（校验文件或指定值），以及ed25519、minisign签名
+
+// 签名类型
+const (
+	SignatureTypeNone     = "none"
+	SignatureTypeEd25519  = "ed25519"
+	SignatureTypeMinisign = "minisign"
+)
+
+// 校验文件的后缀
+const (
+	sha256SidecarSuffix   = ".sha256"
+	ed25519SidecarSuffix  = ".sig"
+	minisignSidecarSuffix = ".minisig"
+)
+
+const (
+	sidecarTimeout = time.Minute
+	sidecarMaxSize = 64 * 1024
+)
+
+// minisign的签名算法，Ed对文件内容签名，ED对文件的BLAKE2b-512哈希签名
+var (
+	minisignAlgLegacy    = []byte("Ed")
+	minisignAlgPrehashed = []byte("ED")
+)
+
+// 下载文件校验失败
+type VerifyError struct {
+	Url    string
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify db file failed, url: %s, reason: %s", e.Url, e.Reason)
+}
+
+// 按配置校验下载文件，返回通过的校验方式，多个以逗号分隔，未配置校验时返回空串
+func verifyDbFile(verifyCfg *config.VerifyConfig, client *http.Client, req dbFileRequest, meta dbFileMeta, blob *dbBlob) (string, error) {
+	var methods []string
+	fail := func(format string, args ...any) (string, error) {
+		return "", &VerifyError{Url: meta.Source, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if expected := verifyCfg.Sha256[req.Url]; expected != "" {
+		if !strings.EqualFold(expected, meta.DownloadHash) {
+			return fail("sha256 mismatch, expected %s, but got %s", expected, meta.DownloadHash)
+		}
+		methods = append(methods, "sha256")
+	}
+
+	if verifyCfg.Sha256Sidecar {
+		body, err := fetchSidecar(client, meta.Source, sha256SidecarSuffix)
+		if err != nil {
+			return fail("fetch sha256 file failed: %v", err)
+		}
+		// 兼容sha256sum的输出格式：哈希 文件名
+		fields := strings.Fields(string(body))
+		if len(fields) == 0 {
+			return fail("empty sha256 file")
+		}
+		if !strings.EqualFold(fields[0], meta.DownloadHash) {
+			return fail("sha256 mismatch with sidecar, expected %s, but got %s", fields[0], meta.DownloadHash)
+		}
+		methods = append(methods, "sha256-sidecar")
+	}
+
+	switch verifyCfg.SignatureType {
+	case "", SignatureTypeNone:
+	case SignatureTypeEd25519:
+		if err := verifyEd25519(client, verifyCfg.PublicKey, meta.Source, blob); err != nil {
+			return fail("%v", err)
+		}
+		methods = append(methods, SignatureTypeEd25519)
+	case SignatureTypeMinisign:
+		if err := verifyMinisign(client, verifyCfg.PublicKey, meta.Source, blob); err != nil {
+			return fail("%v", err)
+		}
+		methods = append(methods, SignatureTypeMinisign)
+	default:
+		return fail("unknown signature type: %s", verifyCfg.SignatureType)
+	}
+
+	if len(methods) > 0 {
+		logx.Infof("db file verified, url: %s, methods: %s", meta.Source, strings.Join(methods, ","))
+	}
+	return strings.Join(methods, ","), nil
+}
+
+// 签名为64字节的原始签名或其base64编码
+func verifyEd25519(client *http.Client, publicKey string, source string, blob *dbBlob) error {
+	pk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid ed25519 public key")
+	}
+	body, err := fetchSidecar(client, source, ed25519SidecarSuffix)
+	if err != nil {
+		return fmt.Errorf("fetch signature failed: %v", err)
+	}
+	sig := body
+	if len(sig) != ed25519.SignatureSize {
+		sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+		if err != nil || len(sig) != ed25519.SignatureSize {
+			return fmt.Errorf("invalid ed25519 signature")
+		}
+	}
+
+	data, err := blob.bytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pk, data, sig) {
+		return fmt.Errorf("ed25519 signature mismatch")
+	}
+	return nil
+}
+
+// minisign公钥：算法(2)、密钥ID(8)、公钥(32)；
+// 签名文件：不可信注释行、签名行（算法(2)、密钥ID(8)、签名(64)）、可信注释行、对签名和可信注释的全局签名行
+func verifyMinisign(client *http.Client, publicKey string, source string, blob *dbBlob) error {
+	pk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(pk) != 2+8+ed25519.PublicKeySize || !bytes.Equal(pk[:2], minisignAlgLegacy) {
+		return fmt.Errorf("invalid minisign public key")
+	}
+	keyId, key := pk[2:10], ed25519.PublicKey(pk[10:])
+
+	body, err := fetchSidecar(client, source, minisignSidecarSuffix)
+	if err != nil {
+		return fmt.Errorf("fetch signature failed: %v", err)
+	}
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("invalid minisign signature file")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign global signature")
+	}
+	if !bytes.Equal(sig[2:10], keyId) {
+		return fmt.Errorf("minisign key id mismatch, expected %X, but got %X", keyId, sig[2:10])
+	}
+
+	var message []byte
+	switch alg := sig[:2]; {
+	case bytes.Equal(alg, minisignAlgLegacy):
+		message, err = blob.bytes()
+	case bytes.Equal(alg, minisignAlgPrehashed):
+		message, err = blake2bBlob(blob)
+	default:
+		return fmt.Errorf("unknown minisign signature algorithm: %q", alg)
+	}
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, message, sig[10:]) {
+		return fmt.Errorf("minisign signature mismatch")
+	}
+
+	trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	signed := append(bytes.Clone(sig[10:]), trustedComment...)
+	if !ed25519.Verify(key, signed, globalSig) {
+		return fmt.Errorf("minisign trusted comment signature mismatch")
+	}
+	return nil
+}
+
+func blake2bBlob(blob *dbBlob) ([]byte, error) {
+	sr, closer, err := blob.open()
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	h, _ := blake2b.New512(nil)
+	if _, err = io.Copy(h, sr); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// 下载与source同目录的校验文件，路径加suffix后缀，保留查询参数
+// file数据源的source为本地路径，直接读取同目录的文件；client为下载文件使用的客户端
+func fetchSidecar(client *http.Client, source string, suffix string) ([]byte, error) {
+	if filepath.IsAbs(source) {
+		f, err := os.Open(source + suffix)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, sidecarMaxSize))
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += suffix
+	if u.RawPath != "" {
+		u.RawPath += suffix
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), sidecarTimeout)
+	defer cf()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected status code 200, but got %d, url: %s", resp.StatusCode, u)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, sidecarMaxSize))
+}
@@ -0,0 +1,180 @@
+package model
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"ip_geo/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 由固定种子（0x00..0x1f）生成的密钥对对verifyTestData签名，密钥ID为1a2b3c4d5e6f7081，
+// minisign签名文件与minisign -S（默认预哈希）及-l（旧版）的输出格式一致
+const (
+	verifyTestData = "ip geo test db\n"
+
+	verifyTestEd25519Key = "A6EHv/POEL4dcN0Y50vAmWfk1jCbpQ1fHdyGZBJVMbg="
+	verifyTestEd25519Sig = "jLnYoObKdahKYQa+QAJl1pJAZNQcqe4Driicl6MrZQiPXDdST4g7+62KFGMjrLma9HhpeHToSeVjw5ZhmJONBw=="
+
+	verifyTestMinisignKey       = "RWQaKzxNXm9wgQOhB7/zzhC+HXDdGOdLwJln5NYwm6UNXx3chmQSVTG4"
+	verifyTestMinisignPrehashed = "untrusted comment: signature from minisign secret key\n" +
+		"RUQaKzxNXm9wgVFgvlNFVwRuBCWth0ygsn/hU8mGy9BwKb0iI96EGUKzIEs6hQdHxoDkB9pBpg3cIFZUmqXny/0Vn9GSXxgqvgo=\n" +
+		"trusted comment: timestamp:1700000000\tfile:db.bin\thashed\n" +
+		"BsB++1VFZKGyV63cYMCCHvXohISzKgoF7xppJvd/45I7wLeBKhsalfeRdH6M5w9FSizZPH1WHcQWp+B/gdi+Dw==\n"
+	verifyTestMinisignLegacy = "untrusted comment: signature from minisign secret key\n" +
+		"RWQaKzxNXm9wgYy52KDmynWoSmEGvkACZdaSQGTUHKnuA64onJejK2UIj1w3Uk+IO/utihRjI6y5mvR4aXh06EnlY8OWYZiTjQc=\n" +
+		"trusted comment: timestamp:1700000000\tfile:db.bin\n" +
+		"B//siloXGm9oGa0YXwsPlULp7XZCQY+gAGaBALWZLNyu4jf7TlWc0e0xZtwsXy33aY3zfOBzlmM6k+tNfu/qCw==\n"
+)
+
+func TestVerifyDbFile(t *testing.T) {
+	sum := sha256.Sum256([]byte(verifyTestData))
+	hash := hex.EncodeToString(sum[:])
+	rawSig, _ := base64.StdEncoding.DecodeString(verifyTestEd25519Sig)
+	otherKey := base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey))
+	// 公钥相同但密钥ID不同
+	pk, _ := base64.StdEncoding.DecodeString(verifyTestMinisignKey)
+	pk[2] ^= 0xff
+	otherIdKey := base64.StdEncoding.EncodeToString(pk)
+
+	tests := []struct {
+		name         string
+		data         string
+		verify       config.VerifyConfig
+		sidecars     map[string]string
+		wantVerified string
+		wantErr      string
+	}{
+		{name: "none", data: verifyTestData},
+		{name: "sha256", data: verifyTestData, verify: config.VerifyConfig{Sha256: map[string]string{"db.bin": strings.ToUpper(hash)}},
+			wantVerified: "sha256"},
+		{name: "sha256 mismatch", data: verifyTestData + "x", verify: config.VerifyConfig{Sha256: map[string]string{"db.bin": hash}},
+			wantErr: "sha256 mismatch"},
+		{name: "sha256 of other url ignored", data: verifyTestData, verify: config.VerifyConfig{Sha256: map[string]string{"other.bin": "00"}}},
+		{name: "sha256 sidecar", data: verifyTestData, verify: config.VerifyConfig{Sha256Sidecar: true},
+			sidecars: map[string]string{sha256SidecarSuffix: hash + "  db.bin\n"}, wantVerified: "sha256-sidecar"},
+		{name: "sha256 sidecar mismatch", data: verifyTestData + "x", verify: config.VerifyConfig{Sha256Sidecar: true},
+			sidecars: map[string]string{sha256SidecarSuffix: hash + "  db.bin\n"}, wantErr: "sha256 mismatch with sidecar"},
+		{name: "sha256 sidecar empty", data: verifyTestData, verify: config.VerifyConfig{Sha256Sidecar: true},
+			sidecars: map[string]string{sha256SidecarSuffix: "\n"}, wantErr: "empty sha256 file"},
+		{name: "sha256 sidecar missing", data: verifyTestData, verify: config.VerifyConfig{Sha256Sidecar: true},
+			wantErr: "fetch sha256 file failed"},
+		{name: "sha256 and sidecar", data: verifyTestData,
+			verify:   config.VerifyConfig{Sha256: map[string]string{"db.bin": hash}, Sha256Sidecar: true},
+			sidecars: map[string]string{sha256SidecarSuffix: hash}, wantVerified: "sha256,sha256-sidecar"},
+
+		{name: "ed25519 base64", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: verifyTestEd25519Key},
+			sidecars: map[string]string{ed25519SidecarSuffix: verifyTestEd25519Sig + "\n"}, wantVerified: "ed25519"},
+		{name: "ed25519 raw", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: verifyTestEd25519Key},
+			sidecars: map[string]string{ed25519SidecarSuffix: string(rawSig)}, wantVerified: "ed25519"},
+		{name: "ed25519 tampered data", data: verifyTestData + "x",
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: verifyTestEd25519Key},
+			sidecars: map[string]string{ed25519SidecarSuffix: verifyTestEd25519Sig}, wantErr: "ed25519 signature mismatch"},
+		{name: "ed25519 other key", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: otherKey},
+			sidecars: map[string]string{ed25519SidecarSuffix: verifyTestEd25519Sig}, wantErr: "ed25519 signature mismatch"},
+		{name: "ed25519 invalid key", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: "AAAA"},
+			sidecars: map[string]string{ed25519SidecarSuffix: verifyTestEd25519Sig}, wantErr: "invalid ed25519 public key"},
+		{name: "ed25519 invalid signature", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeEd25519, PublicKey: verifyTestEd25519Key},
+			sidecars: map[string]string{ed25519SidecarSuffix: "not a signature"}, wantErr: "invalid ed25519 signature"},
+
+		{name: "minisign prehashed", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignPrehashed}, wantVerified: "minisign"},
+		{name: "minisign legacy", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignLegacy}, wantVerified: "minisign"},
+		{name: "minisign crlf", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: strings.ReplaceAll(verifyTestMinisignPrehashed, "\n", "\r\n")}, wantVerified: "minisign"},
+		{name: "minisign prehashed tampered data", data: verifyTestData + "x",
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignPrehashed}, wantErr: "minisign signature mismatch"},
+		{name: "minisign legacy tampered data", data: verifyTestData + "x",
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignLegacy}, wantErr: "minisign signature mismatch"},
+		{name: "minisign tampered trusted comment", data: verifyTestData,
+			verify: config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: strings.Replace(verifyTestMinisignPrehashed,
+				"file:db.bin", "file:other.bin", 1)}, wantErr: "minisign trusted comment signature mismatch"},
+		{name: "minisign key id mismatch", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: otherIdKey},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignPrehashed}, wantErr: "minisign key id mismatch"},
+		{name: "minisign invalid key", data: verifyTestData,
+			verify:   config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestEd25519Key},
+			sidecars: map[string]string{minisignSidecarSuffix: verifyTestMinisignPrehashed}, wantErr: "invalid minisign public key"},
+		{name: "minisign missing trusted comment", data: verifyTestData,
+			verify: config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: strings.Join(
+				strings.Split(verifyTestMinisignPrehashed, "\n")[:2], "\n")}, wantErr: "invalid minisign signature file"},
+		{name: "minisign unknown algorithm", data: verifyTestData,
+			verify: config.VerifyConfig{SignatureType: SignatureTypeMinisign, PublicKey: verifyTestMinisignKey},
+			sidecars: map[string]string{minisignSidecarSuffix: strings.Replace(verifyTestMinisignPrehashed,
+				"\nRUQa", "\nRXka", 1)}, wantErr: "unknown minisign signature algorithm"},
+
+		{name: "unknown signature type", data: verifyTestData, verify: config.VerifyConfig{SignatureType: "rsa"},
+			wantErr: "unknown signature type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := filepath.Join(t.TempDir(), "db.bin")
+			for suffix, content := range tt.sidecars {
+				os.WriteFile(source+suffix, []byte(content), 0o644)
+			}
+			blob := &dbBlob{mem: []byte(tt.data)}
+			downloadHash, _ := blob.hash()
+			meta := dbFileMeta{Source: source, DownloadHash: downloadHash}
+
+			verified, err := verifyDbFile(&tt.verify, http.DefaultClient, dbFileRequest{Url: "db.bin"}, meta, blob)
+			if tt.wantErr != "" {
+				var verifyErr *VerifyError
+				if !errors.As(err, &verifyErr) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want VerifyError containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if verified != tt.wantVerified {
+				t.Errorf("verified = %q, want %q", verified, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestFetchSidecarHttp(t *testing.T) {
+	var gotPath, gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery = r.URL.Path, r.URL.RawQuery
+		if r.URL.Path != "/geo/db.bin.sha256" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("abc"))
+	}))
+	defer server.Close()
+
+	// 校验文件与下载地址同路径，保留查询参数
+	body, err := fetchSidecar(http.DefaultClient, server.URL+"/geo/db.bin?token=1", sha256SidecarSuffix)
+	if err != nil || string(body) != "abc" {
+		t.Fatalf("body = %q, err = %v", body, err)
+	}
+	if gotPath != "/geo/db.bin.sha256" || gotQuery != "token=1" {
+		t.Errorf("requested %s?%s", gotPath, gotQuery)
+	}
+	if _, err = fetchSidecar(http.DefaultClient, server.URL+"/geo/missing.bin", sha256SidecarSuffix); err == nil {
+		t.Error("want error for missing sidecar")
+	}
+}
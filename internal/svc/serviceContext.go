@@ -7,7 +7,6 @@ import (
 	"ip_geo/internal/model"
 	"sync/atomic"
 
-	"github.com/zeromicro/go-zero/core/logx"
 	"github.com/zeromicro/go-zero/core/stores/redis"
 	"github.com/zeromicro/go-zero/rest"
 )
@@ -15,9 +14,11 @@ import (
 type ServiceContext struct {
 	CfgPtr                *atomic.Pointer[config.Config]
 	IpRateLimitMiddleware rest.Middleware
+	AdminAuthMiddleware   rest.Middleware
 	RedisClient           *redis.Redis
 	IpGeoHelper           model.IpGeoHelper
-	GeoHelperReady        chan bool // 标识Helper是否ready
+	OverrideHelper        *model.OverrideHelper // 未配置覆盖规则时为nil
+	GeoHelperReady        chan bool             // 标识Helper是否ready
 }
 
 func NewServiceContext(cfgPtr *atomic.Pointer[config.Config]) *ServiceContext {
@@ -29,22 +30,34 @@ func NewServiceContext(cfgPtr *atomic.Pointer[config.Config]) *ServiceContext {
 		CfgPtr:                cfgPtr,
 		RedisClient:           redisClient,
 		IpRateLimitMiddleware: middleware.NewIpRateLimitMiddleware(cfgPtr, redisClient).Handle,
+		AdminAuthMiddleware:   middleware.NewAdminAuthMiddleware(cfgPtr).Handle,
 		GeoHelperReady:        make(chan bool),
 	}
 
-	helper, err := model.NewIpCloudDataHelper(cfgPtr)
+	// 配置了协调刷新时，各实例通过Redis协调下载和切换
+	cluster, err := model.NewClusterSync(cfgPtr.Load(), redisClient)
 	if err != nil {
-		panic(fmt.Errorf("new ip cloud data helper failed: %v", err))
+		panic(fmt.Errorf("new cluster sync failed: %v", err))
+	}
+	helper, err := model.NewIpGeoHelper(cfgPtr, cluster)
+	if err != nil {
+		panic(fmt.Errorf("new ip geo helper failed: %v", err))
+	}
+	// 特殊用途地址不查询离线库
+	helper = model.NewSpecialAddressHelper(helper)
+	// 配置了覆盖规则时，在查询助手之前加一层覆盖，覆盖规则对特殊地址同样生效
+	if cfgPtr.Load().OverrideConfig != nil {
+		svcCtx.OverrideHelper, err = model.NewOverrideHelper(cfgPtr, helper)
+		if err != nil {
+			panic(fmt.Errorf("new override helper failed: %v", err))
+		}
+		helper = svcCtx.OverrideHelper
 	}
 	svcCtx.IpGeoHelper = helper
 
-	// 初始化查询助手
+	// 初始化查询助手，失败时在后台重试，成功加载前保持未就绪
 	go func() {
-		initErr := helper.Init()
-		if initErr != nil {
-			logx.Errorf("init ip geo helper failed: %v", initErr)
-			panic(initErr)
-		}
+		model.InitWithRetry("ip geo helper", helper, cfgPtr.Load().DataSyncConfig.Retry, nil)
 		close(svcCtx.GeoHelperReady)
 	}()
 
@@ -1,23 +1,106 @@
 // Code generated by goctl. DO NOT EDIT.
 package types
 
+type AddOverrideRequest struct {
+	Operator string `header:"X-Operator,optional"` // 操作人，由调用方自报，审计时与请求来源地址一起记录
+	OverrideRule
+}
+
+type DownloadStatus struct {
+	Url        string `json:"url"`                // 下载地址
+	State      string `json:"state"`              // downloading、done、failed、rejected
+	Bytes      int64  `json:"bytes"`              // 已下载字节数
+	Total      int64  `json:"total"`              // 文件总大小，未知时为-1
+	Rate       int64  `json:"rate"`               // 下载速度，字节每秒
+	Eta        int64  `json:"eta"`                // 预计剩余秒数，未知时为-1
+	Resumed    int    `json:"resumed"`            // 断点续传次数
+	Verified   string `json:"verified,omitempty"` // 通过的校验方式
+	StartTime  string `json:"start_time"`         // 开始时间
+	UpdateTime string `json:"update_time"`        // 最近更新时间
+	Error      string `json:"error,omitempty"`    // 失败原因
+}
+
 type GetIpGeoRequest struct {
 	IpAddr string `form:"ip_addr"`
 }
 
 type GetIpGeoResponse struct {
-	DBVersion     string `json:"db_version"`     // 数据库版本
-	ContinentCode string `json:"continent_code"` // 大洲代码
-	Country       string `json:"country"`        // 国家/地区
-	CountryCode   string `json:"country_code"`   // 国家代码
-	Region        string `json:"region"`         // 省、州
-	City          string `json:"city"`           // 城市
-	District      string `json:"district"`       // 区县
-	AreaCode      string `json:"area_code"`      // 区域代码
-	Isp           string `json:"isp"`            // 运营商
-	ISPDomain     string `json:"isp_domain"`     // 运营商域名
-	ZipCode       string `json:"zip_code"`       // 邮编
-	Latitude      string `json:"latitude"`       // 纬度
-	Longitude     string `json:"longitude"`      // 经度
-	Timezone      string `json:"timezone"`       // 时区
+	DBVersion     string            `json:"db_version"`        // 数据库版本
+	DBLoadTime    string            `json:"db_load_time"`      // 数据库加载时间
+	AddressType   string            `json:"address_type"`      // 地址类型
+	ContinentCode string            `json:"continent_code"`    // 大洲代码
+	Country       string            `json:"country"`           // 国家/地区
+	CountryCode   string            `json:"country_code"`      // 国家代码
+	Region        string            `json:"region"`            // 省、州
+	City          string            `json:"city"`              // 城市
+	District      string            `json:"district"`          // 区县
+	AreaCode      string            `json:"area_code"`         // 区域代码
+	Isp           string            `json:"isp"`               // 运营商
+	ISPDomain     string            `json:"isp_domain"`        // 运营商域名
+	ZipCode       string            `json:"zip_code"`          // 邮编
+	Latitude      string            `json:"latitude"`          // 纬度
+	Longitude     string            `json:"longitude"`         // 经度
+	Timezone      string            `json:"timezone"`          // 时区
+	Line          string            `json:"line"`              // 线路
+	Asn           uint32            `json:"asn"`               // 自治域编号
+	AsnOrg        string            `json:"asn_org"`           // 自治域所属组织
+	Idc           string            `json:"idc"`               // idc
+	Station       string            `json:"station"`           // 基站
+	Sources       map[string]string `json:"sources,omitempty"` // 字段来源
+}
+
+type GetSnapshotFileRequest struct {
+	Id   string `form:"id"`            // 快照标识
+	Name string `form:"name"`          // 快照中的文件名
+	Hash string `form:"hash,optional"` // 快照哈希，指定时可获取尚未切换的快照
+}
+
+type GetSyncStatusResponse struct {
+	Downloads []DownloadStatus `json:"downloads"`
+}
+
+type ListOverridesResponse struct {
+	Rules []OverrideRule `json:"rules"`
+}
+
+type ListSnapshotsRequest struct {
+	Hash string `form:"hash,optional"` // 只返回该哈希的快照，包括协调刷新中已保存、尚未切换的快照
+}
+
+type ListSnapshotsResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+type OverrideRule struct {
+	Cidr    string            `json:"cidr"`             // CIDR
+	Fields  map[string]string `json:"fields"`           // 覆盖的字段，字段名同GetIpGeoResponse的json名
+	Comment string            `json:"comment,optional"` // 备注
+}
+
+type RemoveOverrideRequest struct {
+	Operator string `header:"X-Operator,optional"` // 操作人，由调用方自报，审计时与请求来源地址一起记录
+	Cidr     string `form:"cidr"`
+}
+
+type Snapshot struct {
+	Id       string         `json:"id"`       // 快照标识，由提供方和下载地址确定
+	Provider string         `json:"provider"` // 离线库提供方
+	Version  string         `json:"version"`  // 数据库版本
+	Hash     string         `json:"hash"`     // 各文件哈希的sha256
+	SavedAt  string         `json:"saved_at"` // 快照保存时间
+	Files    []SnapshotFile `json:"files"`
+}
+
+type SnapshotFile struct {
+	Url          string `json:"url"`            // 主下载地址
+	Name         string `json:"name"`           // 快照中的文件名
+	Size         int64  `json:"size"`           // 文件大小
+	Hash         string `json:"hash"`           // 文件的sha256
+	Source       string `json:"source"`         // 实际下载的地址，可能为镜像
+	ETag         string `json:"etag"`           // 下载时的ETag
+	LastModified string `json:"last_modified"`  // 下载时的Last-Modified
+	EntryModTime string `json:"entry_mod_time"` // 压缩包内文件的修改时间
+	DownloadHash string `json:"download_hash"`  // 下载文件的sha256
+	DownloadSize int64  `json:"download_size"`  // 下载文件的大小
+	Verified     string `json:"verified"`       // 通过的校验方式
 }
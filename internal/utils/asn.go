@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 解析asn字段，兼容 "4134"、"AS4134"、"AS4134 CHINANET-BACKBONE"、"AS4134,Chinanet" 等格式，
+// 无法解析出编号时，整个字段作为组织名称返回
+func ParseAsn(s string) (asn uint32, org string) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, ""
+	}
+
+	numStr, org := s, ""
+	if i := strings.IndexAny(s, " \t,;|-_"); i >= 0 {
+		numStr, org = s[:i], strings.TrimLeft(s[i:], " \t,;|-_")
+	}
+	if len(numStr) > 2 && strings.EqualFold(numStr[:2], "AS") {
+		numStr = numStr[2:]
+	}
+
+	n, err := strconv.ParseUint(numStr, 10, 32)
+	if err != nil {
+		return 0, s
+	}
+	return uint32(n), strings.TrimSpace(org)
+}
@@ -0,0 +1,40 @@
+package utils
+
+import "testing"
+
+func TestParseAsn(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantAsn uint32
+		wantOrg string
+	}{
+		{"", 0, ""},
+		{"  ", 0, ""},
+		{"4134", 4134, ""},
+		{" 4134 ", 4134, ""},
+		{"AS4134", 4134, ""},
+		{"as4134", 4134, ""},
+		{"AS4134 CHINANET", 4134, "CHINANET"},
+		{"AS4134 CHINANET-BACKBONE", 4134, "CHINANET-BACKBONE"},
+		{"AS4134,Chinanet", 4134, "Chinanet"},
+		{"AS4134 - China Telecom", 4134, "China Telecom"},
+		{"4134\tCHINANET", 4134, "CHINANET"},
+		{"AS4134|CHINANET", 4134, "CHINANET"},
+		{"AS4294967295", 4294967295, ""},
+		// 无法解析出编号时整个字段作为组织名称
+		{"AS4294967296", 0, "AS4294967296"},
+		{"CHINANET", 0, "CHINANET"},
+		{"中国电信 AS4134", 0, "中国电信 AS4134"},
+		{"AS", 0, "AS"},
+		{"ASN4134", 0, "ASN4134"},
+		{"AS-4134", 0, "AS-4134"},
+		{"AS+4134", 0, "AS+4134"},
+		{"-1", 0, "-1"},
+	}
+	for _, tt := range tests {
+		asn, org := ParseAsn(tt.s)
+		if asn != tt.wantAsn || org != tt.wantOrg {
+			t.Errorf("ParseAsn(%q) = %d, %q, want %d, %q", tt.s, asn, org, tt.wantAsn, tt.wantOrg)
+		}
+	}
+}
@@ -10,6 +10,17 @@ var (
 		"非洲":  "AF",
 		"南极洲": "AQ",
 	}
+
+	// ISO大洲代码（MaxMind等使用）到本服务大洲代码的映射
+	isoContinents = map[string]string{
+		"AS": "AP",
+		"OC": "OA",
+		"NA": "NA",
+		"SA": "LA",
+		"EU": "EU",
+		"AF": "AF",
+		"AN": "AQ",
+	}
 )
 
 func GetContinentCodeByName(name string) string {
@@ -18,3 +29,10 @@ func GetContinentCodeByName(name string) string {
 	}
 	return name
 }
+
+func GetContinentCodeByIsoCode(code string) string {
+	if v, ok := isoContinents[code]; ok {
+		return v
+	}
+	return code
+}